@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/pistatium/planing_poker/internal"
+	"github.com/pistatium/planing_poker/internal/entities"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CreateRoomRequest struct {
+	Deck         []string `json:"deck"`
+	Passcode     string   `json:"passcode"`
+	Facilitators []string `json:"facilitators"`
+	// "permanent" か "72h" のような期間。省略時はデプロイの設定に従う
+	Retention string `json:"retention"`
+	// "team" にするとメンバーと履歴を残し続けるチームルームになる
+	Type string `json:"type"`
+	// true にすると公開した見積もりや履歴に誰が出したかを含めない
+	Anonymous bool `json:"anonymous"`
+}
+
+type CreateRoomResponse struct {
+	RoomID       string            `json:"room_id"`
+	Deck         []string          `json:"deck"`
+	Facilitators []string          `json:"facilitators"`
+	Protected    bool              `json:"protected"`
+	Retention    string            `json:"retention,omitempty"`
+	Type         entities.RoomType `json:"type,omitempty"`
+	Anonymous    bool              `json:"anonymous,omitempty"`
+}
+
+// createRoomHandler POST /api/rooms
+func (s *Server) createRoomHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	var req CreateRoomRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	retention, err := entities.ParseRetention(req.Retention)
+	if err != nil {
+		writeJSONError(w, httpStatus(err), err)
+		return
+	}
+	roomType, err := entities.ParseRoomType(req.Type)
+	if err != nil {
+		writeJSONError(w, httpStatus(err), err)
+		return
+	}
+	room, err := s.eventManager.CreateRoom(r.Context(), internal.RoomSettings{
+		Deck:         req.Deck,
+		Passcode:     req.Passcode,
+		Facilitators: req.Facilitators,
+		Retention:    retention,
+		Type:         roomType,
+		Anonymous:    req.Anonymous,
+	}, s.clientAddr(r))
+	if err != nil {
+		writeJSONError(w, httpStatus(err), err)
+		return
+	}
+	facilitators := []string{}
+	for name, role := range room.Roles() {
+		if role == entities.RoleFacilitator {
+			facilitators = append(facilitators, name)
+		}
+	}
+	writeJSON(w, http.StatusCreated, &CreateRoomResponse{
+		RoomID:       room.ID(),
+		Deck:         room.Deck(),
+		Facilitators: facilitators,
+		Protected:    room.IsProtected(),
+		Retention:    room.Retention().String(),
+		Type:         room.Type(),
+		Anonymous:    room.Anonymous(),
+	})
+}
+
+const (
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+)
+
+type EventsResponse struct {
+	RoomID string               `json:"room_id"`
+	Events []entities.RoomEvent `json:"events"`
+	// 続きを取得するときに after に指定する
+	NextAfter int64 `json:"next_after"`
+}
+
+type ReplayResponse struct {
+	RoomID         string            `json:"room_id"`
+	Seq            int64             `json:"seq"`
+	State          entities.State    `json:"state"`
+	LastModifiedAt time.Time         `json:"last_modified_at"`
+	Participants   []RespParticipant `json:"participants"`
+	Anonymous      bool              `json:"anonymous,omitempty"`
+	// 公開された時点の場合のみ。匿名のルームでは名前を含めない
+	Estimates []RepsEstimate          `json:"estimates,omitempty"`
+	Stats     *entities.EstimateStats `json:"stats,omitempty"`
+}
+
+// roomResourceHandler /api/rooms/{room_id}/events、/api/rooms/{room_id}/replay、/api/rooms/{room_id}/audit
+// 保護されたルームは ?passcode= が必要
+func (s *Server) roomResourceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	roomID, resource, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/rooms/"), "/")
+	if !ok || (resource != "events" && resource != "replay" && resource != "audit") {
+		writeJSONError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	query := r.URL.Query()
+	room, err := s.eventManager.Authorize(r.Context(), roomID, query.Get("passcode"), s.clientAddr(r))
+	if err == nil && room == nil {
+		err = internal.RoomNotFoundError
+	}
+	if err != nil {
+		writeJSONError(w, httpStatus(err), err)
+		return
+	}
+	switch resource {
+	case "events":
+		s.writeEvents(w, r, room)
+	case "replay":
+		s.writeReplay(w, r, room)
+	case "audit":
+		s.writeAudit(w, r, room)
+	}
+}
+
+type AuditLogResponse struct {
+	RoomID  string                `json:"room_id"`
+	Entries []entities.AuditEntry `json:"entries"`
+}
+
+// writeAudit GET /api/rooms/{room_id}/audit?user_name=
+// 進行役の名前と、その名前で join したときのトークンを Authorization: Bearer で渡す
+func (s *Server) writeAudit(w http.ResponseWriter, r *http.Request, room *entities.Room) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		writeJSONError(w, http.StatusUnauthorized, entities.InvalidTokenError)
+		return
+	}
+	userName, err := entities.NormalizeUserName(r.URL.Query().Get("user_name"))
+	if err != nil {
+		writeJSONError(w, httpStatus(err), err)
+		return
+	}
+	actor := internal.Actor{UserName: userName, Token: token, ClientAddr: s.clientAddr(r)}
+	entries, err := s.eventManager.AuditLog(r.Context(), room.ID(), actor)
+	if err != nil {
+		writeJSONError(w, httpStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &AuditLogResponse{
+		RoomID:  room.ID(),
+		Entries: entries,
+	})
+}
+
+// writeEvents GET /api/rooms/{room_id}/events?after=&limit=
+// 公開されなかった見積もりと、匿名のルームで出された見積もりは値を伏せる
+// 公開前にリセットしたラウンドの見積もりは、後で別のラウンドを公開しても伏せる
+func (s *Server) writeEvents(w http.ResponseWriter, r *http.Request, room *entities.Room) {
+	after, err := queryInt(r, "after", 0)
+	if err != nil {
+		writeJSONError(w, httpStatus(err), err)
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultEventsLimit)
+	if err != nil {
+		writeJSONError(w, httpStatus(err), err)
+		return
+	}
+	limit = min(max(limit, 1), maxEventsLimit)
+	events, err := s.eventManager.Events(r.Context(), room.ID(), after, int(limit))
+	if err != nil {
+		writeJSONError(w, httpStatus(err), err)
+		return
+	}
+	// ページ内の見積もりが公開されたかは、その後の最後の公開までのイベントで決まる
+	var following []entities.RoomEvent
+	if revealedSeq := room.RevealedSeq(); len(events) > 0 && events[len(events)-1].Seq < revealedSeq {
+		lastSeq := events[len(events)-1].Seq
+		following, err = s.eventManager.Events(r.Context(), room.ID(), lastSeq, int(revealedSeq-lastSeq))
+		if err != nil {
+			writeJSONError(w, httpStatus(err), err)
+			return
+		}
+	}
+	unrevealed := entities.UnrevealedEstimates(events, following)
+	for i := range events {
+		_, hidden := unrevealed[events[i].Seq]
+		if events[i].Type == entities.EventEstimateSet && (hidden || events[i].Anonymous) {
+			events[i].Point = ""
+			events[i].Rationale = ""
+		}
+	}
+	nextAfter := after
+	if len(events) > 0 {
+		nextAfter = events[len(events)-1].Seq
+	}
+	writeJSON(w, http.StatusOK, &EventsResponse{
+		RoomID:    room.ID(),
+		Events:    events,
+		NextAfter: nextAfter,
+	})
+}
+
+// writeReplay GET /api/rooms/{room_id}/replay?seq=
+// seq の時点のルームをイベントから組み立て直す。省略時は最新
+func (s *Server) writeReplay(w http.ResponseWriter, r *http.Request, room *entities.Room) {
+	seq, err := queryInt(r, "seq", 0)
+	if err != nil {
+		writeJSONError(w, httpStatus(err), err)
+		return
+	}
+	replayed, err := s.eventManager.Replay(r.Context(), room.ID(), seq)
+	if err != nil {
+		writeJSONError(w, httpStatus(err), err)
+		return
+	}
+	resp := &ReplayResponse{
+		RoomID:         replayed.ID(),
+		Seq:            replayed.Seq(),
+		State:          replayed.State(),
+		LastModifiedAt: replayed.LastModifiedAt(),
+		Participants:   []RespParticipant{},
+		Anonymous:      replayed.Anonymous(),
+	}
+	for _, e := range replayed.Estimates() {
+		resp.Participants = append(resp.Participants, RespParticipant{
+			UserName:    e.User.Name,
+			IsEstimated: e.Point != &entities.PointNotSet,
+		})
+	}
+	if replayed.State().Revealed() {
+		estimates, stats := revealedEstimates(replayed)
+		resp.Estimates = estimates
+		resp.Stats = &stats
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// queryInt 省略時は def
+func queryInt(r *http.Request, name string, def int64) (int64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, &entities.ValidationError{Field: name, Reason: "must be a non-negative integer"}
+	}
+	return n, nil
+}
+
+// healthzHandler GET /healthz プロセスが生きていれば200
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyzHandler GET /readyz リポジトリに接続でき、シャットダウン中でなければ200
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting down"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+	if err := s.eventManager.Ping(ctx); err != nil {
+		slog.Error("readiness check failed", slog.Any("error", err))
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "repository unreachable"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// httpStatus エラーに対応するHTTPステータス
+func httpStatus(err error) int {
+	switch errorCode(err) {
+	case "":
+		return http.StatusInternalServerError
+	case "room_not_found", "user_not_found":
+		return http.StatusNotFound
+	case "passcode_required", "invalid_passcode", "invalid_token":
+		return http.StatusUnauthorized
+	case "permission_denied":
+		return http.StatusForbidden
+	case "too_many_attempts", "rate_limited":
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("write error:", slog.Any("error", err))
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	if status >= http.StatusInternalServerError {
+		slog.Error("api error:", slog.Any("error", err))
+	}
+	code := errorCode(err)
+	if code == "" {
+		internal.Errors.WithLabelValues("internal").Inc()
+	} else {
+		internal.Errors.WithLabelValues(code).Inc()
+	}
+	writeJSON(w, status, &Response{
+		Type:    "error",
+		Message: err.Error(),
+		Code:    code,
+	})
+}
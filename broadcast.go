@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/pistatium/planing_poker/internal"
+	"sync"
+	"time"
+)
+
+// defaultFanoutWindow ルームの変更を各接続が拾うまでの時間。ポーリングの間隔 (100ms) より十分長くする
+const defaultFanoutWindow = time.Second
+
+// broadcastKey 1回の配信。同じルームの同じ変更を各接続に送ったものをまとめる
+type broadcastKey struct {
+	roomID      string
+	seq         int64
+	messageType string
+}
+
+// fanoutCounter 配信ごとに送れた接続の数を数えてメトリクスに出す
+// 接続ごとにルームの変更を拾って送るので、最初に送ってから window の間に送れた数を1回の配信とみなす
+type fanoutCounter struct {
+	window time.Duration
+	// 配信ごとに送れた接続の数を受け取る
+	observe func(messageType string, connections int)
+
+	mu      sync.Mutex
+	pending map[broadcastKey]int
+}
+
+func newFanoutCounter(window time.Duration) *fanoutCounter {
+	return &fanoutCounter{
+		window: window,
+		observe: func(messageType string, connections int) {
+			internal.BroadcastFanout.WithLabelValues(messageType).Observe(float64(connections))
+		},
+		pending: map[broadcastKey]int{},
+	}
+}
+
+// written 1つの接続に送れた
+func (f *fanoutCounter) written(roomID string, seq int64, messageType string) {
+	key := broadcastKey{roomID: roomID, seq: seq, messageType: messageType}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.pending[key]; !ok {
+		time.AfterFunc(f.window, func() { f.flush(key) })
+	}
+	f.pending[key]++
+}
+
+func (f *fanoutCounter) flush(key broadcastKey) {
+	f.mu.Lock()
+	n := f.pending[key]
+	delete(f.pending, key)
+	f.mu.Unlock()
+	f.observe(key.messageType, n)
+}
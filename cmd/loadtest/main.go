@@ -0,0 +1,308 @@
+// loadtest 多数のルームと投票者をシミュレートして /ws に負荷をかける
+//
+//	go run ./cmd/loadtest -url ws://localhost:8080/ws -rooms 50 -voters 8 -cycles 5
+//
+// サーバー側の接続元IPごとの制限に引っかからないよう、IP_MESSAGE_RATE=0 で起動しておくこと
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type message struct {
+	Type       string `json:"type"`
+	UserName   string `json:"user_name,omitempty"`
+	PointLabel string `json:"point,omitempty"`
+}
+
+type response struct {
+	Type         string `json:"type"`
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+	Participants []struct {
+		UserName    string `json:"user_name"`
+		IsEstimated bool   `json:"is_estimated"`
+	} `json:"participants"`
+	Estimates []struct {
+		UserName string `json:"user_name"`
+	} `json:"estimates"`
+}
+
+var cards = []string{"1", "2", "3", "5", "8", "13", "?"}
+
+type config struct {
+	url     string
+	rooms   int
+	voters  int
+	cycles  int
+	think   time.Duration
+	timeout time.Duration
+}
+
+// stats 全ルーム分の集計
+type stats struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	// 受信したエラーのコード別件数
+	errors      map[string]int
+	connectFail atomic.Int64
+	dropped     atomic.Int64
+	timeouts    atomic.Int64
+}
+
+func (s *stats) observe(action string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latencies[action] = append(s.latencies[action], d)
+}
+
+func (s *stats) error(code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors[code]++
+}
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.url, "url", "ws://localhost:8080/ws", "WebSocket endpoint")
+	flag.IntVar(&cfg.rooms, "rooms", 10, "number of rooms")
+	flag.IntVar(&cfg.voters, "voters", 5, "number of voters per room")
+	flag.IntVar(&cfg.cycles, "cycles", 3, "number of estimate/reveal cycles per room")
+	flag.DurationVar(&cfg.think, "think", 500*time.Millisecond, "pause between actions")
+	flag.DurationVar(&cfg.timeout, "timeout", 10*time.Second, "how long to wait for a broadcast")
+	flag.Parse()
+	if cfg.rooms < 1 || cfg.voters < 1 || cfg.cycles < 1 {
+		fmt.Fprintln(os.Stderr, "rooms, voters and cycles must be positive")
+		os.Exit(2)
+	}
+
+	st := &stats{latencies: map[string][]time.Duration{}, errors: map[string]int{}}
+	runID := time.Now().UnixNano()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.rooms; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			runRoom(cfg, fmt.Sprintf("loadtest-%d-%d", runID, i), st)
+		}(i)
+	}
+	wg.Wait()
+	report(cfg, st, time.Since(start))
+}
+
+// voter 1人分の接続
+type voter struct {
+	name string
+	conn *websocket.Conn
+	// 受信したメッセージ。切断されると閉じる
+	incoming chan response
+	closing  atomic.Bool
+	writeMu  sync.Mutex
+}
+
+// close 正常に切断する
+func (v *voter) close() {
+	v.closing.Store(true)
+	v.writeMu.Lock()
+	_ = v.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	v.writeMu.Unlock()
+	v.conn.Close()
+}
+
+func (v *voter) send(m message) error {
+	v.writeMu.Lock()
+	defer v.writeMu.Unlock()
+	return v.conn.WriteJSON(m)
+}
+
+func connect(cfg config, roomID string, name string, st *stats) (*voter, error) {
+	u, err := url.Parse(cfg.url)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("room", roomID)
+	u.RawQuery = q.Encode()
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	v := &voter{name: name, conn: conn, incoming: make(chan response, 64)}
+	go func() {
+		defer close(v.incoming)
+		for {
+			_, raw, err := conn.ReadMessage()
+			if err != nil {
+				// 自分から閉じた場合以外は切断されたとみなす
+				if !v.closing.Load() && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					st.dropped.Add(1)
+				}
+				return
+			}
+			var resp response
+			if err := json.Unmarshal(raw, &resp); err != nil {
+				st.error("invalid_json")
+				continue
+			}
+			if resp.Type == "error" {
+				st.error(resp.Code)
+			}
+			v.incoming <- resp
+		}
+	}()
+	return v, nil
+}
+
+// waitUntil 条件を満たすメッセージが届くまで待つ
+func (v *voter) waitUntil(timeout time.Duration, match func(response) bool) (time.Time, bool) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case resp, ok := <-v.incoming:
+			if !ok {
+				return time.Time{}, false
+			}
+			if match(resp) {
+				return time.Now(), true
+			}
+		case <-deadline:
+			return time.Time{}, false
+		}
+	}
+}
+
+func runRoom(cfg config, roomID string, st *stats) {
+	var voters []*voter
+	defer func() {
+		for _, v := range voters {
+			v.close()
+		}
+	}()
+	for i := 0; i < cfg.voters; i++ {
+		v, err := connect(cfg, roomID, fmt.Sprintf("voter%d", i), st)
+		if err != nil {
+			log.Printf("%s: connect: %v", roomID, err)
+			st.connectFail.Add(1)
+			continue
+		}
+		voters = append(voters, v)
+	}
+	if len(voters) == 0 {
+		return
+	}
+	for _, v := range voters {
+		sentAt := time.Now()
+		if err := v.send(message{Type: "join", UserName: v.name}); err != nil {
+			st.error("send")
+			continue
+		}
+		if at, ok := v.waitUntil(cfg.timeout, func(r response) bool { return r.Type == "joined" }); ok {
+			st.observe("join", at.Sub(sentAt))
+		} else {
+			st.timeouts.Add(1)
+		}
+	}
+
+	for cycle := 0; cycle < cfg.cycles; cycle++ {
+		// 全員が見積もり、他の全員にそれが届くまで
+		sentAt := time.Now()
+		for _, v := range voters {
+			if err := v.send(message{Type: "estimate", UserName: v.name, PointLabel: cards[rand.Intn(len(cards))]}); err != nil {
+				st.error("send")
+			}
+		}
+		observeAll(cfg, voters, st, "estimate", sentAt, func(r response) bool {
+			if r.Type != "participants" || len(r.Participants) < len(voters) {
+				return false
+			}
+			for _, p := range r.Participants {
+				if !p.IsEstimated {
+					return false
+				}
+			}
+			return true
+		})
+		time.Sleep(cfg.think)
+
+		// 公開して全員に estimates が届くまで
+		sentAt = time.Now()
+		if err := voters[0].send(message{Type: "reveal", UserName: voters[0].name}); err != nil {
+			st.error("send")
+		}
+		observeAll(cfg, voters, st, "reveal", sentAt, func(r response) bool {
+			return r.Type == "estimates" && len(r.Estimates) >= len(voters)
+		})
+		time.Sleep(cfg.think)
+	}
+}
+
+// observeAll 全員が条件を満たすメッセージを受け取るまでのレイテンシを記録する
+func observeAll(cfg config, voters []*voter, st *stats, action string, sentAt time.Time, match func(response) bool) {
+	var wg sync.WaitGroup
+	for _, v := range voters {
+		wg.Add(1)
+		go func(v *voter) {
+			defer wg.Done()
+			if at, ok := v.waitUntil(cfg.timeout, match); ok {
+				st.observe(action, at.Sub(sentAt))
+			} else {
+				st.timeouts.Add(1)
+			}
+		}(v)
+	}
+	wg.Wait()
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+func report(cfg config, st *stats, elapsed time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	fmt.Printf("rooms=%d voters=%d cycles=%d elapsed=%s\n", cfg.rooms, cfg.voters, cfg.cycles, elapsed.Round(time.Millisecond))
+	fmt.Printf("%-10s %8s %10s %10s %10s %10s\n", "action", "count", "p50", "p90", "p99", "max")
+	actions := make([]string, 0, len(st.latencies))
+	for action := range st.latencies {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	for _, action := range actions {
+		l := st.latencies[action]
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		fmt.Printf("%-10s %8d %10s %10s %10s %10s\n", action, len(l),
+			percentile(l, 0.5).Round(time.Millisecond),
+			percentile(l, 0.9).Round(time.Millisecond),
+			percentile(l, 0.99).Round(time.Millisecond),
+			l[len(l)-1].Round(time.Millisecond),
+		)
+	}
+	fmt.Printf("connect failures: %d\n", st.connectFail.Load())
+	fmt.Printf("dropped connections: %d\n", st.dropped.Load())
+	fmt.Printf("broadcast timeouts: %d\n", st.timeouts.Load())
+	total := 0
+	for _, n := range st.errors {
+		total += n
+	}
+	fmt.Printf("errors: %d", total)
+	for code, n := range st.errors {
+		fmt.Printf(" %s=%d", code, n)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/pistatium/planing_poker/internal"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// SlowConsumerError 送信待ちのメッセージが溜まりすぎて切断した
+var SlowConsumerError = fmt.Errorf("slow consumer")
+
+// ConnClosedError 切断済みの接続に送ろうとした
+var ConnClosedError = fmt.Errorf("connection closed")
+
+// rawConn connWriter が使う *websocket.Conn のメソッド
+type rawConn interface {
+	WriteJSON(v interface{}) error
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetWriteDeadline(t time.Time) error
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// outbound 送信待ちのメッセージ。closeMessage が設定されていればクローズフレームを送って切断する
+type outbound struct {
+	v            interface{}
+	closeMessage []byte
+}
+
+// connWriter 1つの接続への書き込みを専用の goroutine にまとめる
+// gorilla/websocket は複数の goroutine から同時に書き込めないので、送信はすべてここを通す
+// 遅いクライアントに書き込んでいる間もハンドラのループは止まらない
+type connWriter struct {
+	conn rawConn
+	// 送信待ちがこれを超えたら切断する。0以下で無制限
+	maxBacklog   int
+	writeTimeout time.Duration
+
+	mu    sync.Mutex
+	queue []outbound
+	// true になったらそれ以上受け付けない。残りを送り終えたら run が終わる
+	closed bool
+	wake   chan struct{}
+	done   chan struct{}
+}
+
+func newConnWriter(conn rawConn, maxBacklog int, writeTimeout time.Duration) *connWriter {
+	return &connWriter{
+		conn:         conn,
+		maxBacklog:   maxBacklog,
+		writeTimeout: writeTimeout,
+		wake:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+}
+
+// WriteJSON 送信キューに積む。実際の書き込みは run で行う
+// まだ送っていない participants は新しいもので置き換える
+func (w *connWriter) WriteJSON(v interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ConnClosedError
+	}
+	if isParticipants(v) {
+		queue := w.queue[:0]
+		for _, out := range w.queue {
+			if isParticipants(out.v) {
+				internal.DroppedMessages.WithLabelValues("coalesced").Inc()
+				continue
+			}
+			queue = append(queue, out)
+		}
+		w.queue = queue
+	}
+	if w.maxBacklog > 0 && len(w.queue) >= w.maxBacklog {
+		slog.Warn("slow consumer",
+			slog.Int("backlog", len(w.queue)),
+			slog.String("remote_addr", w.conn.RemoteAddr().String()),
+		)
+		internal.DroppedMessages.WithLabelValues("slow_consumer").Add(float64(len(w.queue) + 1))
+		internal.SlowConsumers.Inc()
+		// 溜まっているメッセージは捨てて、すぐに切断する
+		w.queue = []outbound{{closeMessage: websocket.FormatCloseMessage(websocket.ClosePolicyViolation, SlowConsumerError.Error())}}
+		w.closed = true
+		w.signal()
+		return SlowConsumerError
+	}
+	w.queue = append(w.queue, outbound{v: v})
+	w.signal()
+	return nil
+}
+
+func (w *connWriter) RemoteAddr() net.Addr {
+	return w.conn.RemoteAddr()
+}
+
+// Close 送信待ちのメッセージを送ってからクローズフレームを送って切断する
+func (w *connWriter) Close(closeCode int, reason string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.queue = append(w.queue, outbound{closeMessage: websocket.FormatCloseMessage(closeCode, reason)})
+	w.closed = true
+	w.signal()
+}
+
+// Stop 受け付けを止め、送信待ちのメッセージを送り終えるまで待つ
+func (w *connWriter) Stop() {
+	w.mu.Lock()
+	w.closed = true
+	w.signal()
+	w.mu.Unlock()
+	<-w.done
+}
+
+// Done 書き込みが終わって接続を閉じたら閉じられる
+func (w *connWriter) Done() <-chan struct{} {
+	return w.done
+}
+
+// signal 呼び出し元でロックを取ること
+func (w *connWriter) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next 次に送るメッセージ。受け付けを止めていて送るものがなければ false
+func (w *connWriter) next() (outbound, bool) {
+	for {
+		w.mu.Lock()
+		if len(w.queue) > 0 {
+			out := w.queue[0]
+			w.queue = w.queue[1:]
+			w.mu.Unlock()
+			return out, true
+		}
+		closed := w.closed
+		w.mu.Unlock()
+		if closed {
+			return outbound{}, false
+		}
+		<-w.wake
+	}
+}
+
+// run 送信キューのメッセージを順に書き込む。接続ごとに1つの goroutine で動かす
+// 書き込みに失敗するか切断を送ったら接続を閉じ、読み込み側のループも終わらせる
+func (w *connWriter) run() {
+	defer close(w.done)
+	defer w.conn.Close()
+	for {
+		out, ok := w.next()
+		if !ok {
+			return
+		}
+		if out.closeMessage != nil {
+			deadline := time.Now().Add(time.Second)
+			if err := w.conn.WriteControl(websocket.CloseMessage, out.closeMessage, deadline); err != nil {
+				slog.Error("close error:", slog.Any("error", err))
+			}
+			w.discard()
+			return
+		}
+		if w.writeTimeout > 0 {
+			if err := w.conn.SetWriteDeadline(time.Now().Add(w.writeTimeout)); err != nil {
+				slog.Error("write deadline error:", slog.Any("error", err))
+			}
+		}
+		if err := w.conn.WriteJSON(out.v); err != nil {
+			slog.Error("write error:",
+				slog.Any("error", err),
+				slog.String("remote_addr", w.conn.RemoteAddr().String()),
+			)
+			w.discard()
+			return
+		}
+	}
+}
+
+// discard 受け付けを止め、送れなかったメッセージを捨てる
+func (w *connWriter) discard() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	w.queue = nil
+}
+
+func isParticipants(v interface{}) bool {
+	p, ok := v.(*ParticipantResponse)
+	return ok && p.Type == "participants"
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingConn release されるまで書き込みを止める rawConn
+type blockingConn struct {
+	release chan struct{}
+	mu      sync.Mutex
+	written []Response
+	closes  [][]byte
+	closed  bool
+}
+
+func newBlockingConn() *blockingConn {
+	return &blockingConn{release: make(chan struct{})}
+}
+
+func (c *blockingConn) WriteJSON(v interface{}) error {
+	<-c.release
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var resp Response
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written = append(c.written, resp)
+	return nil
+}
+
+func (c *blockingConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closes = append(c.closes, data)
+	return nil
+}
+
+func (c *blockingConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *blockingConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+}
+
+func (c *blockingConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func participants(message string) *ParticipantResponse {
+	return &ParticipantResponse{Response: Response{Type: "participants", Message: message}}
+}
+
+func TestConnWriter_CoalescesParticipants(t *testing.T) {
+	conn := newBlockingConn()
+	close(conn.release)
+	w := newConnWriter(conn, 10, time.Second)
+
+	// 書き込みを始める前に積む
+	for _, v := range []interface{}{
+		participants("1"),
+		participants("2"),
+		&Response{Type: "estimates"},
+		participants("3"),
+		&ParticipantResponse{Response: Response{Type: "joined"}},
+		participants("4"),
+	} {
+		if err := w.WriteJSON(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go w.run()
+	w.Stop()
+
+	var got []string
+	for _, resp := range conn.written {
+		got = append(got, resp.Type+resp.Message)
+	}
+	want := []string{"estimates", "joined", "participants4"}
+	if len(got) != len(want) {
+		t.Fatalf("written = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("written = %v, want %v", got, want)
+		}
+	}
+	if !conn.closed {
+		t.Error("conn is not closed after Stop")
+	}
+}
+
+func TestConnWriter_DisconnectsSlowConsumer(t *testing.T) {
+	conn := newBlockingConn()
+	w := newConnWriter(conn, 3, time.Second)
+	go w.run()
+
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = w.WriteJSON(&Response{Type: "estimates"})
+	}
+	if !errors.Is(err, SlowConsumerError) {
+		t.Fatalf("WriteJSON error = %v, want SlowConsumerError", err)
+	}
+	if err := w.WriteJSON(&Response{Type: "estimates"}); !errors.Is(err, ConnClosedError) {
+		t.Errorf("WriteJSON after disconnect = %v, want ConnClosedError", err)
+	}
+	close(conn.release)
+	select {
+	case <-w.Done():
+	case <-time.After(time.Second):
+		t.Fatal("writer did not stop")
+	}
+	// 書き込み中だった1件だけが送られ、溜まっていたものは捨てられる
+	if len(conn.written) > 1 {
+		t.Errorf("written %d messages, want at most 1", len(conn.written))
+	}
+	if len(conn.closes) != 1 {
+		t.Fatalf("close frames = %d, want 1", len(conn.closes))
+	}
+	if code := int(conn.closes[0][0])<<8 | int(conn.closes[0][1]); code != websocket.ClosePolicyViolation {
+		t.Errorf("close code = %d, want %d", code, websocket.ClosePolicyViolation)
+	}
+	if !conn.closed {
+		t.Error("conn is not closed")
+	}
+}
@@ -20,7 +20,7 @@ const App = ({roomID}: Props): ReactElement => {
     const [userName, setUserName] = useState('');
     const [participants, setParticipants] = useState<Participant[]>([]);
     const [estimates, setEstimates] = useState<Estimate[]>([]);
-    const [status, setStatus] = useState<RoomState>('open');
+    const [status, setStatus] = useState<RoomState>('lobby');
     const [histories, setHistories] = useState<History[]>([]);
     const [timeoutHandler, setTimeoutHandler] = useState<NodeJS.Timeout | null>(null);
     useEffect(() => {
@@ -38,6 +38,7 @@ const App = ({roomID}: Props): ReactElement => {
                     receiveError(msg);
                     break;
                 case "joined":
+                    localStorage.setItem(`token:${room}:${localStorage.getItem('savedName')}`, msg.token);
                     break;
                 case "participants":
                     receiveParticipants(msg);
@@ -112,7 +113,8 @@ const App = ({roomID}: Props): ReactElement => {
     };
 
     const onClickJoin = () => {
-        socket?.send(JSON.stringify({type: 'join', user_name: userName}));
+        const token = localStorage.getItem(`token:${room}:${userName}`) || undefined;
+        socket?.send(JSON.stringify({type: 'join', user_name: userName, token}));
     };
 
     const onClickReveal = () => {
@@ -144,7 +146,7 @@ const App = ({roomID}: Props): ReactElement => {
     });
     const receiverListElements = participants.map((participant, i) => {
         let point = ''
-        if (status === 'estimated') {
+        if (status === 'revealed' || status === 'discussion' || status === 'finalized') {
             point = estimates.find((e) => e.user_name === participant.user_name)?.point || '';
         }
         return (
@@ -1,4 +1,4 @@
-type RoomState = 'open' | 'estimated'
+type RoomState = 'lobby' | 'voting' | 'locked' | 'revealed' | 'discussion' | 'finalized'
 
 type Participant = {
     user_name: string
@@ -7,6 +7,8 @@ type Participant = {
 
 type MessageJoined = {
     type: 'joined'
+    // 同じ名前で入り直すときに join に付ける
+    token: string
 }
 type MessageParticipants = {
     type: 'participants'
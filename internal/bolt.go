@@ -0,0 +1,445 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pistatium/planing_poker/internal/entities"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
+	"time"
+)
+
+// BoltPath ルームを保存するファイルのパス
+type BoltPath string
+
+// BoltRoomRepository ローカルの1ファイル(bbolt)に保存するリポジトリ
+// GCPを使わずに1台のVMやdocker-composeで動かす場合に使う
+type BoltRoomRepository struct {
+	db  *bolt.DB
+	ttl time.Duration
+}
+
+var _ RoomRepository = (*BoltRoomRepository)(nil)
+
+/*
+	読み込み:
+		毎回ファイルから読み込む。bboltはmmapなのでFirestoreのようなキャッシュは持たない
+	書き込み:
+		Save の時点でファイルに書き込む。Transaction 中は最後にまとめてコミットする
+	有効期限:
+		Firestore の ExpiresAt と同じく期限切れのルームは存在しないものとして扱い、起動時と Sweep で削除する
+	イベント:
+		ルームIDごとのバケットに Seq をキーにして保存する。ルームと同じトランザクションで書き込み、ルームと一緒に削除する
+*/
+
+var (
+	boltMetaBucket       = []byte("meta")
+	boltRoomsBucket      = []byte("rooms")
+	boltExpiresBucket    = []byte("expires")
+	boltEventsBucket     = []byte("events")
+	boltSnapshotsBucket  = []byte("snapshots")
+	boltSchemaVersionKey = []byte("schema_version")
+)
+
+// boltMigrations i番目を適用するとスキーマのバージョンが i+1 になる
+// 既存のものは変更せず、末尾に追加していく
+var boltMigrations = []func(tx *bolt.Tx) error{
+	// 1: ルームID -> RoomWithExpiresAt(JSON)
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltRoomsBucket)
+		return err
+	},
+	// 2: 期限切れのルームを古い順に消せるように、有効期限+ルームIDのインデックスを作る
+	func(tx *bolt.Tx) error {
+		expires, err := tx.CreateBucketIfNotExists(boltExpiresBucket)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltRoomsBucket).ForEach(func(k, v []byte) error {
+			stored, err := decodeBoltRoom(v)
+			if err != nil {
+				// 読めないルームは起動時の削除で消えるように期限切れにしておく
+				return expires.Put(boltExpiresKey(time.Unix(0, 0), string(k)), nil)
+			}
+			if stored.ExpiresAt == nil {
+				return nil
+			}
+			return expires.Put(boltExpiresKey(*stored.ExpiresAt, string(k)), nil)
+		})
+	},
+	// 3: ルームID -> (Seq -> RoomEvent / RoomSnapshot(JSON))
+	func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltEventsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltSnapshotsBucket)
+		return err
+	},
+}
+
+type boltTxKey struct{}
+
+// NewBoltRoomRepository ttl は Retention がデフォルトのルームの有効期限
+func NewBoltRoomRepository(path BoltPath, ttl time.Duration) (*BoltRoomRepository, error) {
+	// 他のプロセスが開いている場合はロックを待たずにエラーにする
+	db, err := bolt.Open(string(path), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("fail to open %s: %v", path, err)
+	}
+	b := &BoltRoomRepository{db: db, ttl: ttl}
+	if err := b.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	deleted, err := b.deleteExpired(time.Now())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	slog.Info("bolt repository opened", slog.String("path", string(path)), slog.Int("expired_rooms_deleted", deleted))
+	return b, nil
+}
+
+// migrate 未適用のマイグレーションを1つのトランザクションでまとめて適用する
+func (b *BoltRoomRepository) migrate() error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		version := 0
+		if v := meta.Get(boltSchemaVersionKey); v != nil {
+			version = int(binary.BigEndian.Uint64(v))
+		}
+		if version > len(boltMigrations) {
+			// 新しいバージョンで作られたファイルを古いバイナリで開いた
+			return fmt.Errorf("unsupported schema version %d (supported up to %d)", version, len(boltMigrations))
+		}
+		for i := version; i < len(boltMigrations); i++ {
+			if err := boltMigrations[i](tx); err != nil {
+				return fmt.Errorf("fail to migrate schema to version %d: %v", i+1, err)
+			}
+			slog.Info("bolt schema migrated", slog.Int("version", i+1))
+		}
+		return meta.Put(boltSchemaVersionKey, binary.BigEndian.AppendUint64(nil, uint64(len(boltMigrations))))
+	})
+}
+
+// schemaVersion 適用済みのマイグレーションの数
+func (b *BoltRoomRepository) schemaVersion() (int, error) {
+	version := 0
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltMetaBucket).Get(boltSchemaVersionKey); v != nil {
+			version = int(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	return version, err
+}
+
+// boltExpiresKey 有効期限の順に並ぶインデックスのキー
+func boltExpiresKey(expiresAt time.Time, roomID string) []byte {
+	nanos := expiresAt.UnixNano()
+	if expiresAt.Before(time.Unix(0, 0)) {
+		nanos = 0
+	}
+	key := binary.BigEndian.AppendUint64(nil, uint64(nanos))
+	return append(key, roomID...)
+}
+
+func boltSeqKey(seq int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(seq))
+}
+
+// putBoltLog ルームIDのバケットに Seq をキーにして JSON で保存する
+func putBoltLog(tx *bolt.Tx, name []byte, roomID string, seq int64, v interface{}) error {
+	bucket, err := tx.Bucket(name).CreateBucketIfNotExists([]byte(roomID))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("fail to serialize %s: %v", name, err)
+	}
+	return bucket.Put(boltSeqKey(seq), data)
+}
+
+// deleteBoltLogs ルームのイベントとスナップショットを削除する
+func deleteBoltLogs(tx *bolt.Tx, roomID string) error {
+	for _, name := range [][]byte{boltEventsBucket, boltSnapshotsBucket} {
+		err := tx.Bucket(name).DeleteBucket([]byte(roomID))
+		if err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeBoltRoom(data []byte) (*RoomWithExpiresAt, error) {
+	stored := &RoomWithExpiresAt{SerializedRoom: &entities.SerializedRoom{}}
+	if err := json.Unmarshal(data, stored); err != nil {
+		return nil, fmt.Errorf("fail to decode room: %v", err)
+	}
+	return stored, nil
+}
+
+func getBoltRoom(tx *bolt.Tx, roomID string) (*RoomWithExpiresAt, error) {
+	data := tx.Bucket(boltRoomsBucket).Get([]byte(roomID))
+	if data == nil {
+		return nil, nil
+	}
+	return decodeBoltRoom(data)
+}
+
+// boltError 閉じた後の呼び出しは他のリポジトリと同じく RepositoryClosedError にする
+func boltError(message string, err error) error {
+	if errors.Is(err, bolt.ErrDatabaseNotOpen) {
+		return RepositoryClosedError
+	}
+	return fmt.Errorf("%s: %v", message, err)
+}
+
+// view Transaction の中であればそのトランザクションで読む
+func (b *BoltRoomRepository) view(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if tx, ok := ctx.Value(boltTxKey{}).(*bolt.Tx); ok {
+		return fn(tx)
+	}
+	return b.db.View(fn)
+}
+
+// update Transaction の中であればそのトランザクションに含める
+func (b *BoltRoomRepository) update(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	if tx, ok := ctx.Value(boltTxKey{}).(*bolt.Tx); ok {
+		return fn(tx)
+	}
+	return b.db.Update(fn)
+}
+
+// Transaction f の中の Find から Save までを1つの書き込みトランザクションにする
+// f がエラーを返した場合は Save した内容も含めてロールバックする
+func (b *BoltRoomRepository) Transaction(ctx context.Context, f func(ctx context.Context) (*entities.Room, error)) (*entities.Room, error) {
+	if _, ok := ctx.Value(boltTxKey{}).(*bolt.Tx); ok {
+		return f(ctx)
+	}
+	var room *entities.Room
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		room, err = f(context.WithValue(ctx, boltTxKey{}, tx))
+		return err
+	})
+	if errors.Is(err, bolt.ErrDatabaseNotOpen) {
+		return nil, RepositoryClosedError
+	}
+	if err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+func (b *BoltRoomRepository) Find(ctx context.Context, roomID string) (_ *entities.Room, err error) {
+	defer observeRepository("find", time.Now(), &err)
+	ctx, span := startChildSpan(ctx, "BoltRoomRepository.Find", attribute.String("room.id", roomID))
+	defer endSpan(span, &err)
+	var stored *RoomWithExpiresAt
+	err = b.view(ctx, func(tx *bolt.Tx) error {
+		var err error
+		stored, err = getBoltRoom(tx, roomID)
+		return err
+	})
+	if err != nil {
+		return nil, boltError("fail to get room", err)
+	}
+	// 期限切れでまだ削除されていないだけのルームは存在しないものとして扱う
+	if stored == nil || stored.ExpiresAt != nil && !stored.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	room, err := entities.NewFromSerializedRoom(*stored.SerializedRoom)
+	if err != nil {
+		return nil, fmt.Errorf("fail to deserialize room: %v", err)
+	}
+	return room, nil
+}
+
+func (b *BoltRoomRepository) Save(ctx context.Context, room *entities.Room) (err error) {
+	defer observeRepository("save", time.Now(), &err)
+	ctx, span := startChildSpan(ctx, "BoltRoomRepository.Save", attribute.String("room.id", room.ID()))
+	defer endSpan(span, &err)
+	serialized := room.Serialize()
+	stored := RoomWithExpiresAt{
+		SerializedRoom: &serialized,
+		ExpiresAt:      room.ExpiresAt(time.Now(), b.ttl),
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("fail to serialize room: %v", err)
+	}
+	events, snapshots := room.PendingChanges()
+	err = b.update(ctx, func(tx *bolt.Tx) error {
+		for _, event := range events {
+			if err := putBoltLog(tx, boltEventsBucket, room.ID(), event.Seq, event); err != nil {
+				return err
+			}
+		}
+		for _, snapshot := range snapshots {
+			if err := putBoltLog(tx, boltSnapshotsBucket, room.ID(), snapshot.Seq, snapshot); err != nil {
+				return err
+			}
+		}
+		expires := tx.Bucket(boltExpiresBucket)
+		// 前回の有効期限のインデックスを付け替える
+		// 読めない場合は古いインデックスが残るが、削除時にルーム側の有効期限を確認するので問題ない
+		if old, _ := getBoltRoom(tx, room.ID()); old != nil && old.ExpiresAt != nil {
+			if err := expires.Delete(boltExpiresKey(*old.ExpiresAt, room.ID())); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(boltRoomsBucket).Put([]byte(room.ID()), data); err != nil {
+			return err
+		}
+		// 永続的なルームはインデックスに入れない
+		if stored.ExpiresAt == nil {
+			return nil
+		}
+		return expires.Put(boltExpiresKey(*stored.ExpiresAt, room.ID()), nil)
+	})
+	if err != nil {
+		return boltError("fail to save room", err)
+	}
+	room.ChangesSaved(lastSeq(events, snapshots))
+	slog.Info("room saved",
+		slog.String("room_id", room.ID()),
+		slog.Any("last_modified", room.LastModifiedAt()),
+	)
+	return nil
+}
+
+func (b *BoltRoomRepository) Events(ctx context.Context, roomID string, afterSeq int64, limit int) (_ []entities.RoomEvent, err error) {
+	defer observeRepository("events", time.Now(), &err)
+	ctx, span := startChildSpan(ctx, "BoltRoomRepository.Events", attribute.String("room.id", roomID))
+	defer endSpan(span, &err)
+	var events []entities.RoomEvent
+	err = b.view(ctx, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltEventsBucket).Bucket([]byte(roomID))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.Seek(boltSeqKey(afterSeq + 1)); k != nil && len(events) < limit; k, v = c.Next() {
+			var event entities.RoomEvent
+			if err := json.Unmarshal(v, &event); err != nil {
+				return fmt.Errorf("fail to decode event: %v", err)
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, boltError("fail to get events", err)
+	}
+	return events, nil
+}
+
+func (b *BoltRoomRepository) FindSnapshot(ctx context.Context, roomID string, seq int64) (_ *entities.RoomSnapshot, err error) {
+	defer observeRepository("find_snapshot", time.Now(), &err)
+	ctx, span := startChildSpan(ctx, "BoltRoomRepository.FindSnapshot", attribute.String("room.id", roomID))
+	defer endSpan(span, &err)
+	var snapshot *entities.RoomSnapshot
+	err = b.view(ctx, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltSnapshotsBucket).Bucket([]byte(roomID))
+		if bucket == nil {
+			return nil
+		}
+		// seq より後の最初のキーの1つ前が seq 以前で最新のもの
+		c := bucket.Cursor()
+		k, v := c.Seek(boltSeqKey(seq + 1))
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		if k == nil {
+			return nil
+		}
+		snapshot = &entities.RoomSnapshot{}
+		if err := json.Unmarshal(v, snapshot); err != nil {
+			return fmt.Errorf("fail to decode snapshot: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, boltError("fail to get snapshot", err)
+	}
+	return snapshot, nil
+}
+
+// deleteExpired now の時点で期限切れのルームを削除し、削除した数を返す
+func (b *BoltRoomRepository) deleteExpired(now time.Time) (int, error) {
+	deleted := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		rooms := tx.Bucket(boltRoomsBucket)
+		expires := tx.Bucket(boltExpiresBucket)
+		// カーソルで走査しながらは消せないので、先にキーを集める
+		limit := boltExpiresKey(now, "")
+		var keys [][]byte
+		c := expires.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, limit) < 0; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			roomID := string(k[8:])
+			stored, err := getBoltRoom(tx, roomID)
+			// 読めないルームも消す。保存し直されて期限が延びたものや永続になったものは残す
+			if err != nil || stored != nil && stored.ExpiresAt != nil && !stored.ExpiresAt.After(now) {
+				if err := rooms.Delete([]byte(roomID)); err != nil {
+					return err
+				}
+				if err := deleteBoltLogs(tx, roomID); err != nil {
+					return err
+				}
+				deleted++
+			}
+			if err := expires.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, boltError("fail to delete expired rooms", err)
+	}
+	return deleted, nil
+}
+
+// Sweep 期限切れのルームを削除する。メモリ上のキャッシュは持たない
+func (b *BoltRoomRepository) Sweep(ctx context.Context, now time.Time) (_ SweepResult, err error) {
+	defer observeRepository("sweep", time.Now(), &err)
+	deleted, err := b.deleteExpired(now)
+	if err != nil {
+		return SweepResult{}, err
+	}
+	return SweepResult{Deleted: deleted}, nil
+}
+
+func (b *BoltRoomRepository) Ping(ctx context.Context) (err error) {
+	defer observeRepository("ping", time.Now(), &err)
+	err = b.db.View(func(tx *bolt.Tx) error { return nil })
+	if err != nil {
+		return boltError("fail to ping bolt", err)
+	}
+	return nil
+}
+
+// Flush Save の時点でファイルに書き込んでいるので何もしない
+func (b *BoltRoomRepository) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Close ファイルを閉じる。以降の呼び出しは RepositoryClosedError を返す
+func (b *BoltRoomRepository) Close() error {
+	return b.db.Close()
+}
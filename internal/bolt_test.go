@@ -0,0 +1,272 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pistatium/planing_poker/internal/entities"
+	bolt "go.etcd.io/bbolt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestBoltRepository(t *testing.T, path string) *BoltRoomRepository {
+	t.Helper()
+	repo, err := NewBoltRoomRepository(BoltPath(path), DefaultRoomTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+func TestBoltRoomRepository_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rooms.db")
+	repo := newTestBoltRepository(t, path)
+	ctx := context.Background()
+
+	room := entities.NewRoom("room1")
+	for _, name := range []string{"alice", "bob"} {
+		if err := room.AddUser(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := room.SetPasscode("secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.SetRole("alice", entities.RoleFacilitator); err != nil {
+		t.Fatal(err)
+	}
+	point, err := entities.NewPoint("5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := room.SetEstimate("bob", point, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.RevealEstimates(); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Save(ctx, room); err != nil {
+		t.Fatal(err)
+	}
+
+	// 開き直しても残っている
+	if err := repo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	repo = newTestBoltRepository(t, path)
+	got, err := repo.Find(ctx, "room1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil {
+		t.Fatal("room not found after reopen")
+	}
+	assertSameRoom(t, room.Serialize(), got.Serialize())
+
+	missing, err := repo.Find(ctx, "room2")
+	if err != nil || missing != nil {
+		t.Errorf("Find(room2) = %v, %v, want nil, nil", missing, err)
+	}
+}
+
+func TestBoltRoomRepository_TransactionRollback(t *testing.T) {
+	repo := newTestBoltRepository(t, filepath.Join(t.TempDir(), "rooms.db"))
+	ctx := context.Background()
+	wantErr := fmt.Errorf("something went wrong")
+
+	_, err := repo.Transaction(ctx, func(ctx context.Context) (*entities.Room, error) {
+		if err := repo.Save(ctx, entities.NewRoom("room1")); err != nil {
+			return nil, err
+		}
+		// トランザクション内では保存した内容が見える
+		room, err := repo.Find(ctx, "room1")
+		if err != nil || room == nil {
+			t.Errorf("Find in transaction = %v, %v", room, err)
+		}
+		return nil, wantErr
+	})
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("Transaction = %v, want %v", err, wantErr)
+	}
+	room, err := repo.Find(ctx, "room1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room != nil {
+		t.Error("room was saved although the transaction failed")
+	}
+}
+
+func TestBoltRoomRepository_Expiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rooms.db")
+	repo := newTestBoltRepository(t, path)
+	ctx := context.Background()
+	for _, id := range []string{"old", "fresh"} {
+		if err := repo.Save(ctx, entities.NewRoom(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	permanent := entities.NewRoom("permanent")
+	if err := permanent.SetRetention(entities.RetentionPermanent); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Save(ctx, permanent); err != nil {
+		t.Fatal(err)
+	}
+
+	// 期限を過ぎたものは見つからない
+	deleted, err := repo.deleteExpired(time.Now().Add(DefaultRoomTTL + time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Errorf("deleted = %d, want 2", deleted)
+	}
+	if err := repo.Save(ctx, entities.NewRoom("fresh")); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := repo.deleteExpired(time.Now()); err != nil || deleted != 0 {
+		t.Errorf("deleteExpired(now) = %d, %v, want 0, nil", deleted, err)
+	}
+	for id, want := range map[string]bool{"old": false, "fresh": true, "permanent": true} {
+		room, err := repo.Find(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (room != nil) != want {
+			t.Errorf("Find(%s) found = %v, want %v", id, room != nil, want)
+		}
+	}
+}
+
+func TestBoltRoomRepository_Migration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rooms.db")
+	// バージョン1のファイルにルームが入っている状態を作る
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().Add(time.Hour)
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := boltMigrations[0](tx); err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucket(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		if err := meta.Put(boltSchemaVersionKey, []byte{0, 0, 0, 0, 0, 0, 0, 1}); err != nil {
+			return err
+		}
+		rooms := tx.Bucket(boltRoomsBucket)
+		if err := rooms.Put([]byte("room1"), []byte(fmt.Sprintf(`{"id":"room1","state":"open","estimates":null,"expires_at":%q}`, expiresAt.Format(time.RFC3339Nano)))); err != nil {
+			return err
+		}
+		return rooms.Put([]byte("broken"), []byte(`{`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := newTestBoltRepository(t, path)
+	version, err := repo.schemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != len(boltMigrations) {
+		t.Errorf("schema version = %d, want %d", version, len(boltMigrations))
+	}
+	room, err := repo.Find(context.Background(), "room1")
+	if err != nil || room == nil {
+		t.Fatalf("Find(room1) = %v, %v", room, err)
+	}
+	// 読めないルームは起動時に削除されている
+	err = repo.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltRoomsBucket).Get([]byte("broken")) != nil {
+			t.Error("broken room was not deleted")
+		}
+		if tx.Bucket(boltExpiresBucket).Get(boltExpiresKey(expiresAt, "room1")) == nil {
+			t.Error("expires index of room1 was not created")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// より新しいスキーマのファイルは開けない
+	repo.Close()
+	db, err = bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMetaBucket).Put(boltSchemaVersionKey, []byte{0, 0, 0, 0, 0, 0, 0, 99})
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBoltRoomRepository(BoltPath(path), DefaultRoomTTL); err == nil {
+		t.Error("opened a file with a newer schema version")
+	}
+}
+
+func TestBoltRoomRepository_Close(t *testing.T) {
+	repo := newTestBoltRepository(t, filepath.Join(t.TempDir(), "rooms.db"))
+	if err := repo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Find(context.Background(), "room1"); !errors.Is(err, RepositoryClosedError) {
+		t.Errorf("Find after Close = %v, want %v", err, RepositoryClosedError)
+	}
+	if err := repo.Ping(context.Background()); !errors.Is(err, RepositoryClosedError) {
+		t.Errorf("Ping after Close = %v, want %v", err, RepositoryClosedError)
+	}
+}
+
+func TestEventManager_BoltConcurrentSetEstimate(t *testing.T) {
+	repo := newTestBoltRepository(t, filepath.Join(t.TempDir(), "rooms.db"))
+	manager := NewEventManager(repo, EventManagerConfig{AllowImplicitRoomCreation: true})
+	ctx := context.Background()
+
+	const users = 10
+	for i := 0; i < users; i++ {
+		if _, err := manager.Join(ctx, "room1", fmt.Sprintf("user%d", i), "", fmt.Sprintf("token%d", i), "127.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			point, _ := entities.NewPoint(fmt.Sprint(i + 1))
+			if _, err := manager.SetEstimate(ctx, "room1", fmt.Sprintf("user%d", i), point, ""); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	room, err := manager.Get(ctx, "room1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, est := range room.Estimates() {
+		if est.Point.Label() == "" {
+			t.Errorf("estimate of %s was lost", est.User.Name)
+		}
+	}
+}
+
+func TestBoltRoomRepository_Replay(t *testing.T) {
+	assertReplayMatchesRoom(t, newTestBoltRepository(t, filepath.Join(t.TempDir(), "rooms.db")))
+}
@@ -0,0 +1,52 @@
+package entities
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// AnonymityLockedError 見積もりが出ている間に匿名かどうかを変えようとした
+// 公開済みの見積もりの名前が後から見えたり、出した後で名前が伏せられたりしないようにする
+var AnonymityLockedError = fmt.Errorf("cannot change anonymity while estimates are cast")
+
+// Anonymous 匿名のルームでは公開した見積もりや履歴に誰が出したかを含めない
+func (r *Room) Anonymous() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.anonymous
+}
+
+// SetAnonymous 誰も見積もりを出していないときのみ変えられる
+func (r *Room) SetAnonymous(anonymous bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.anonymous == anonymous {
+		return nil
+	}
+	for _, est := range r.estimates {
+		if est.Point != &PointNotSet {
+			return AnonymityLockedError
+		}
+	}
+	r.anonymous = anonymous
+	r.lastModifiedAt = time.Now()
+	r.record(RoomEvent{Type: EventSettingsChanged, At: r.lastModifiedAt, Setting: SettingAnonymous})
+	return nil
+}
+
+// SortedEstimates 見積もりをカードの ComparePoints の順に並べたもの。匿名で見せるときに参加した順が分からないようにする
+func (r *Room) SortedEstimates() []*Estimate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.sortedEstimates()
+}
+
+// sortedEstimates 呼び出し元でロックを取ること
+func (r *Room) sortedEstimates() []*Estimate {
+	estimates := append([]*Estimate(nil), r.estimates...)
+	slices.SortStableFunc(estimates, func(a, b *Estimate) int {
+		return ComparePoints(a.Point, b.Point)
+	})
+	return estimates
+}
@@ -0,0 +1,61 @@
+package entities
+
+import "time"
+
+// AuditAction 監査ログに残す進行役の操作
+type AuditAction string
+
+const (
+	AuditRoomCreated     AuditAction = "room_created"
+	AuditReveal          AuditAction = "reveal"
+	AuditReset           AuditAction = "reset"
+	AuditRevote          AuditAction = "revote"
+	AuditLock            AuditAction = "lock"
+	AuditUnlock          AuditAction = "unlock"
+	AuditDiscuss         AuditAction = "discuss"
+	AuditFinalize        AuditAction = "finalize"
+	AuditKick            AuditAction = "kick"
+	AuditRemoveMember    AuditAction = "remove_member"
+	AuditSettingsChanged AuditAction = "settings_changed"
+	AuditRoleChanged     AuditAction = "role_changed"
+)
+
+// MaxAuditEntries ルームに残す監査ログの件数。古いものから消える
+// すべての記録は構造化ログに残る
+const MaxAuditEntries = 200
+
+// AuditEntry 誰がどこから何をしたか
+type AuditEntry struct {
+	At         time.Time   `json:"at"`
+	Action     AuditAction `json:"action"`
+	Actor      string      `json:"actor,omitempty"`
+	RemoteAddr string      `json:"remote_addr"`
+	// 操作の対象になった参加者
+	Target string `json:"target,omitempty"`
+	// 変更した設定や役割など
+	Detail string `json:"detail,omitempty"`
+}
+
+// RecordAudit 監査ログに追加する。At が空の場合は現在時刻
+func (r *Room) RecordAudit(entry AuditEntry) {
+	if entry.At.IsZero() {
+		entry.At = time.Now()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.audit = append(r.audit, &entry)
+	if over := len(r.audit) - MaxAuditEntries; over > 0 {
+		r.audit = append([]*AuditEntry(nil), r.audit[over:]...)
+	}
+}
+
+// AuditLog 古い順
+func (r *Room) AuditLog() []AuditEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entries := make([]AuditEntry, 0, len(r.audit))
+	for _, entry := range r.audit {
+		entries = append(entries, *entry)
+	}
+	return entries
+}
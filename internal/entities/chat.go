@@ -0,0 +1,95 @@
+package entities
+
+import (
+	"slices"
+	"time"
+)
+
+// ChatKind チャットに流れるものの種類
+type ChatKind string
+
+const (
+	ChatKindMessage  ChatKind = "message"
+	ChatKindReaction ChatKind = "reaction"
+)
+
+// MaxChatMessages ルームに残すチャットの件数。古いものから消える
+const MaxChatMessages = 100
+
+// Reactions react で送れる絵文字
+var Reactions = []string{"👍", "👎", "🎉", "😄", "🤔", "😮", "❤️", "👀", "☕"}
+
+// ChatMessage チャットの発言かリアクション。Seq は記録したイベントの番号で、ルームの中で増え続ける
+type ChatMessage struct {
+	Seq      int64     `json:"seq"`
+	At       time.Time `json:"at"`
+	Kind     ChatKind  `json:"kind"`
+	UserName string    `json:"user_name"`
+	// 発言の本文かリアクションの絵文字
+	Text string `json:"text"`
+}
+
+// NormalizeReaction Reactions にある絵文字のみ
+func NormalizeReaction(reaction string) (string, error) {
+	if !slices.Contains(Reactions, reaction) {
+		return "", &ValidationError{Field: FieldReaction, Reason: "not an allowed reaction"}
+	}
+	return reaction, nil
+}
+
+// PostChat 参加中の人のみ発言できる。text は NormalizeChatText で検証しておくこと
+func (r *Room) PostChat(userName string, text string) error {
+	return r.chat(EventChatPosted, ChatKindMessage, userName, text)
+}
+
+// React 参加中の人のみ送れる。reaction は NormalizeReaction で検証しておくこと
+func (r *Room) React(userName string, reaction string) error {
+	return r.chat(EventReactionAdded, ChatKindReaction, userName, reaction)
+}
+
+func (r *Room) chat(eventType RoomEventType, kind ChatKind, userName string, text string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if err := r.addChatMessage(kind, userName, text, r.seq+1, now); err != nil {
+		return err
+	}
+	r.record(RoomEvent{Type: eventType, At: now, UserName: userName, Text: text})
+	return nil
+}
+
+// addChatMessage 呼び出し元でロックを取ること。seq はこの発言を記録するイベントの番号
+func (r *Room) addChatMessage(kind ChatKind, userName string, text string, seq int64, now time.Time) error {
+	if r.findEstimate(userName) == nil {
+		return UserNotFoundError
+	}
+	r.messages = append(r.messages, &ChatMessage{Seq: seq, At: now, Kind: kind, UserName: userName, Text: text})
+	if over := len(r.messages) - MaxChatMessages; over > 0 {
+		r.messages = append([]*ChatMessage(nil), r.messages[over:]...)
+	}
+	r.lastModifiedAt = now
+	return nil
+}
+
+// ChatMessages afterSeq より後の発言とリアクション。古い順
+func (r *Room) ChatMessages(afterSeq int64) []ChatMessage {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	messages := []ChatMessage{}
+	for _, m := range r.messages {
+		if m.Seq > afterSeq {
+			messages = append(messages, *m)
+		}
+	}
+	return messages
+}
+
+// LastChatSeq 最後の発言かリアクションの番号。なければ0
+func (r *Room) LastChatSeq() int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.messages) == 0 {
+		return 0
+	}
+	return r.messages[len(r.messages)-1].Seq
+}
@@ -0,0 +1,240 @@
+package entities
+
+import (
+	"fmt"
+	"time"
+)
+
+// RoomEventType ルームへの変更の種類
+type RoomEventType string
+
+const (
+	EventUserAdded         RoomEventType = "user_added"
+	EventUserRemoved       RoomEventType = "user_removed"
+	EventEstimateSet       RoomEventType = "estimate_set"
+	EventEstimatesRevealed RoomEventType = "estimates_revealed"
+	EventEstimatesReset    RoomEventType = "estimates_reset"
+	EventRevoteStarted     RoomEventType = "revote_started"
+	EventVotesLocked       RoomEventType = "votes_locked"
+	EventVotesUnlocked     RoomEventType = "votes_unlocked"
+	EventDiscussionStarted RoomEventType = "discussion_started"
+	EventStoryFinalized    RoomEventType = "story_finalized"
+	EventMemberRemoved     RoomEventType = "member_removed"
+	EventChatPosted        RoomEventType = "chat_posted"
+	EventReactionAdded     RoomEventType = "reaction_added"
+	// EventSettingsChanged 変更後の状態はスナップショットに残すので、リプレイでは何もしない
+	EventSettingsChanged RoomEventType = "settings_changed"
+)
+
+// settings_changed で変わった設定
+const (
+	SettingDeck      = "deck"
+	SettingPasscode  = "passcode"
+	SettingRole      = "role"
+	SettingRetention = "retention"
+	SettingType      = "type"
+	SettingAnonymous = "anonymous"
+)
+
+// SnapshotInterval このイベント数ごとにスナップショットを残す
+const SnapshotInterval = 50
+
+// RoomEvent ルームへの1回の変更。Seq はルームごとに1から連番
+type RoomEvent struct {
+	Seq      int64         `json:"seq"`
+	Type     RoomEventType `json:"type"`
+	At       time.Time     `json:"at"`
+	UserName string        `json:"user_name,omitempty"`
+	Point    string        `json:"point,omitempty"`
+	Setting  string        `json:"setting,omitempty"`
+	// estimate_set で添えられた理由
+	Rationale string `json:"rationale,omitempty"`
+	// chat_posted の本文か reaction_added の絵文字
+	Text string `json:"text,omitempty"`
+	// 匿名のルームで出した見積もり。API では値を返さない
+	Anonymous bool `json:"anonymous,omitempty"`
+	// estimates_revealed でチームルームの履歴に残したラウンド
+	// ルームのドキュメントの大きさに制限されないよう、履歴はルームではなくイベントに残す
+	Round *Round `json:"round,omitempty"`
+}
+
+// RoomSnapshot Seq までのイベントを反映した時点のルーム
+type RoomSnapshot struct {
+	Seq  int64          `json:"seq"`
+	Room SerializedRoom `json:"room"`
+}
+
+// Seq 最後に記録したイベントの番号
+func (r *Room) Seq() int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.seq
+}
+
+// RevealedSeq 最後に公開したときのイベントの番号。これより後の見積もりはまだ公開されていない
+func (r *Room) RevealedSeq() int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.revealedSeq
+}
+
+// UnrevealedEstimates events の estimate_set のうち、公開されなかった見積もりの番号
+// 公開より前にリセットや退出で消えた見積もりと、同じ人が出し直す前の見積もりは、後で公開があっても含む
+// following には events の後に続くイベントを渡す。最後の公開までなければ、決まらない見積もりは未公開とみなす
+func UnrevealedEstimates(events []RoomEvent, following []RoomEvent) map[int64]struct{} {
+	unrevealed := map[int64]struct{}{}
+	// 参加者ごとに、まだ公開されていない最新の見積もり
+	pending := map[string]int64{}
+	hide := func(userName string) {
+		if seq, ok := pending[userName]; ok {
+			unrevealed[seq] = struct{}{}
+			delete(pending, userName)
+		}
+	}
+	for _, list := range [][]RoomEvent{events, following} {
+		for _, event := range list {
+			switch event.Type {
+			case EventEstimateSet:
+				hide(event.UserName)
+				pending[event.UserName] = event.Seq
+			case EventEstimatesRevealed:
+				pending = map[string]int64{}
+			case EventEstimatesReset, EventRevoteStarted:
+				for userName := range pending {
+					hide(userName)
+				}
+			case EventUserRemoved, EventMemberRemoved:
+				hide(event.UserName)
+			}
+		}
+	}
+	for userName := range pending {
+		hide(userName)
+	}
+	return unrevealed
+}
+
+// PendingChanges まだ保存していないイベントとスナップショット
+// リポジトリは Save でルームと一緒に書き込み、書き込めたら ChangesSaved を呼ぶ
+func (r *Room) PendingChanges() ([]RoomEvent, []RoomSnapshot) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]RoomEvent(nil), r.pendingEvents...), append([]RoomSnapshot(nil), r.pendingSnapshots...)
+}
+
+// ChangesSaved seq までのイベントとスナップショットを保存済みにする
+// 書き込んでいる間に記録されたものは次の Save まで残る
+func (r *Room) ChangesSaved(seq int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := r.pendingEvents[:0]
+	for _, event := range r.pendingEvents {
+		if event.Seq > seq {
+			events = append(events, event)
+		}
+	}
+	r.pendingEvents = events
+	snapshots := r.pendingSnapshots[:0]
+	for _, snapshot := range r.pendingSnapshots {
+		if snapshot.Seq > seq {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	r.pendingSnapshots = snapshots
+}
+
+// record 変更をイベントとして記録する。呼び出し元でロックを取り、変更を反映してから呼ぶこと
+// 設定の変更はイベントだけでは再現できないので、その時点のスナップショットも残す
+func (r *Room) record(event RoomEvent) {
+	r.seq++
+	event.Seq = r.seq
+	if event.Type == EventEstimatesRevealed {
+		r.revealedSeq = r.seq
+	}
+	r.pendingEvents = append(r.pendingEvents, event)
+	if event.Type == EventSettingsChanged || r.seq%SnapshotInterval == 0 {
+		r.pendingSnapshots = append(r.pendingSnapshots, RoomSnapshot{Seq: r.seq, Room: r.serialize()})
+	}
+}
+
+// Replay スナップショットにその後のイベントを順に適用してルームを組み立て直す
+// snapshot が nil の場合は空のルームから始める
+func Replay(roomID string, snapshot *RoomSnapshot, events []RoomEvent) (*Room, error) {
+	room := NewRoom(roomID)
+	if snapshot != nil {
+		var err error
+		room, err = NewFromSerializedRoom(snapshot.Room)
+		if err != nil {
+			return nil, err
+		}
+		if room.seq != snapshot.Seq {
+			return nil, fmt.Errorf("%w: snapshot seq %d does not match room seq %d", CorruptedRoomError, snapshot.Seq, room.seq)
+		}
+	}
+	for _, event := range events {
+		if event.Seq <= room.seq {
+			continue
+		}
+		if event.Seq != room.seq+1 {
+			return nil, fmt.Errorf("%w: missing event %d", CorruptedRoomError, room.seq+1)
+		}
+		if err := room.apply(event); err != nil {
+			return nil, fmt.Errorf("fail to replay event %d: %w", event.Seq, err)
+		}
+	}
+	return room, nil
+}
+
+// apply 記録されたときと同じ変更を、記録された時刻で反映する
+func (r *Room) apply(event RoomEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var err error
+	switch event.Type {
+	case EventUserAdded:
+		err = r.addUser(event.UserName, event.At)
+	case EventUserRemoved:
+		err = r.removeUser(event.UserName, event.At)
+	case EventEstimateSet:
+		// 山札の確認は記録したときに済んでいる
+		var point *Point
+		point, err = NewPoint(event.Point)
+		// 以前のバージョンでは join せずに見積もれたので、参加していなければ加えてから適用する
+		if err == nil && r.findEstimate(event.UserName) == nil {
+			err = r.addUser(event.UserName, event.At)
+		}
+		if err == nil {
+			err = r.setEstimate(event.UserName, point, event.Rationale, event.At)
+		}
+	case EventEstimatesRevealed:
+		_, err = r.revealEstimates(event.At)
+		r.revealedSeq = event.Seq
+	case EventEstimatesReset:
+		r.resetEstimates(event.At)
+	case EventRevoteStarted:
+		err = r.revote(event.At)
+	case EventVotesLocked:
+		err = r.lockVotes(event.At)
+	case EventVotesUnlocked:
+		err = r.unlockVotes(event.At)
+	case EventDiscussionStarted:
+		err = r.startDiscussion(event.At)
+	case EventStoryFinalized:
+		err = r.finalize(event.At)
+	case EventMemberRemoved:
+		err = r.removeMember(event.UserName, event.At)
+	case EventChatPosted:
+		err = r.addChatMessage(ChatKindMessage, event.UserName, event.Text, event.Seq, event.At)
+	case EventReactionAdded:
+		err = r.addChatMessage(ChatKindReaction, event.UserName, event.Text, event.Seq, event.At)
+	case EventSettingsChanged:
+		r.lastModifiedAt = event.At
+	default:
+		err = fmt.Errorf("%w: unknown event type %q", CorruptedRoomError, event.Type)
+	}
+	if err != nil {
+		return err
+	}
+	r.seq = event.Seq
+	return nil
+}
@@ -0,0 +1,64 @@
+package entities
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestUnrevealedEstimates(t *testing.T) {
+	estimate := func(seq int64, userName string) RoomEvent {
+		return RoomEvent{Seq: seq, Type: EventEstimateSet, UserName: userName, Point: "3"}
+	}
+	for _, tt := range []struct {
+		name      string
+		events    []RoomEvent
+		following []RoomEvent
+		want      []int64
+	}{
+		{
+			name:   "revealed",
+			events: []RoomEvent{estimate(1, "alice"), estimate(2, "bob"), {Seq: 3, Type: EventEstimatesRevealed}},
+		},
+		{
+			name:   "not revealed yet",
+			events: []RoomEvent{estimate(1, "alice"), {Seq: 2, Type: EventEstimatesRevealed}, estimate(3, "alice")},
+			want:   []int64{3},
+		},
+		{
+			name:   "reset before a later reveal",
+			events: []RoomEvent{estimate(1, "alice"), {Seq: 2, Type: EventEstimatesReset}, estimate(3, "bob"), {Seq: 4, Type: EventEstimatesRevealed}},
+			want:   []int64{1},
+		},
+		{
+			name:   "changed before reveal",
+			events: []RoomEvent{estimate(1, "alice"), estimate(2, "alice"), {Seq: 3, Type: EventEstimatesRevealed}},
+			want:   []int64{1},
+		},
+		{
+			name:   "left before reveal",
+			events: []RoomEvent{estimate(1, "alice"), {Seq: 2, Type: EventUserRemoved, UserName: "alice"}, estimate(3, "bob"), {Seq: 4, Type: EventEstimatesRevealed}},
+			want:   []int64{1},
+		},
+		{
+			name:      "revealed after the page",
+			events:    []RoomEvent{estimate(1, "alice")},
+			following: []RoomEvent{estimate(2, "bob"), {Seq: 3, Type: EventEstimatesRevealed}},
+		},
+		{
+			name:      "reset after the page",
+			events:    []RoomEvent{estimate(1, "alice")},
+			following: []RoomEvent{{Seq: 2, Type: EventEstimatesReset}, estimate(3, "bob"), {Seq: 4, Type: EventEstimatesRevealed}},
+			want:      []int64{1},
+		},
+	} {
+		var got []int64
+		for seq := range UnrevealedEstimates(tt.events, tt.following) {
+			got = append(got, seq)
+		}
+		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: unrevealed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
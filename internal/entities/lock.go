@@ -0,0 +1,49 @@
+package entities
+
+import (
+	"fmt"
+	"time"
+)
+
+var VotesLockedError = fmt.Errorf("votes are locked")
+
+// LockVotes 公開する前に見積もりを締め切る。締め切った後は公開かリセットまで見積もりを変えられない
+// 使うかどうかは任意で、見積もり中から直接公開してもよい
+func (r *Room) LockVotes() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if err := r.lockVotes(now); err != nil {
+		return err
+	}
+	r.record(RoomEvent{Type: EventVotesLocked, At: now})
+	return nil
+}
+
+func (r *Room) lockVotes(now time.Time) error {
+	if err := r.transition(TransitionLock); err != nil {
+		return err
+	}
+	r.lastModifiedAt = now
+	return nil
+}
+
+// UnlockVotes 締め切りを取り消して見積もりを受け付け直す
+func (r *Room) UnlockVotes() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if err := r.unlockVotes(now); err != nil {
+		return err
+	}
+	r.record(RoomEvent{Type: EventVotesUnlocked, At: now})
+	return nil
+}
+
+func (r *Room) unlockVotes(now time.Time) error {
+	if err := r.transition(TransitionUnlock); err != nil {
+		return err
+	}
+	r.lastModifiedAt = now
+	return nil
+}
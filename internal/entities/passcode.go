@@ -0,0 +1,58 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"time"
+)
+
+var PasscodeRequiredError = fmt.Errorf("passcode required")
+var InvalidPasscodeError = fmt.Errorf("invalid passcode")
+
+// IsProtected パスコードで保護されたルームかどうか
+func (r *Room) IsProtected() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.passcodeHash != ""
+}
+
+// SetPasscode パスコードを設定する。空文字の場合は保護を解除する
+// 平文は保持せずハッシュのみ保存する
+func (r *Room) SetPasscode(passcode string) error {
+	var hash string
+	if passcode != "" {
+		b, err := bcrypt.GenerateFromPassword([]byte(passcode), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("fail to hash passcode: %v", err)
+		}
+		hash = string(b)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.passcodeHash = hash
+	r.lastModifiedAt = time.Now()
+	r.record(RoomEvent{Type: EventSettingsChanged, At: r.lastModifiedAt, Setting: SettingPasscode})
+	return nil
+}
+
+// VerifyPasscode パスコードを検証する。保護されていないルームは常に成功する
+func (r *Room) VerifyPasscode(passcode string) error {
+	r.mu.RLock()
+	hash := r.passcodeHash
+	r.mu.RUnlock()
+	if hash == "" {
+		return nil
+	}
+	if passcode == "" {
+		return PasscodeRequiredError
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(passcode))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return InvalidPasscodeError
+	}
+	if err != nil {
+		return fmt.Errorf("fail to verify passcode: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package entities
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaxStoryRounds 1つのストーリーで見積もり直せる回数の上限
+const MaxStoryRounds = 20
+
+var NotRevealedError = fmt.Errorf("estimates are not revealed")
+var TooManyRoundsError = fmt.Errorf("too many rounds for one story")
+
+// Revote 公開した見積もりを今のストーリーのラウンドとして残し、次のラウンドの見積もりを始める
+// 議論の前後で見積もりがどう収束したかを比べられるようにする
+func (r *Room) Revote() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if err := r.revote(now); err != nil {
+		return err
+	}
+	r.record(RoomEvent{Type: EventRevoteStarted, At: now})
+	return nil
+}
+
+func (r *Room) revote(now time.Time) error {
+	if !r.state.Revealed() || r.lastRevealedAt == nil {
+		return NotRevealedError
+	}
+	if len(r.storyRounds)+1 >= MaxStoryRounds {
+		return TooManyRoundsError
+	}
+	// 確定したストーリーは見積もり直せない
+	if err := r.transition(TransitionRevote); err != nil {
+		return err
+	}
+	r.storyRounds = append(r.storyRounds, r.currentRound(*r.lastRevealedAt))
+	r.clearEstimates()
+	r.lastModifiedAt = now
+	return nil
+}
+
+// Round 今のストーリーで何回目の見積もりか。1から
+func (r *Room) Round() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.roundNumber()
+}
+
+// roundNumber 呼び出し元でロックを取ること
+func (r *Room) roundNumber() int {
+	return len(r.storyRounds) + 1
+}
+
+// StoryRounds 今のストーリーで見積もり直す前に公開したラウンド。古い順
+func (r *Room) StoryRounds() []*Round {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*Round(nil), r.storyRounds...)
+}
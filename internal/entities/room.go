@@ -7,26 +7,42 @@ import (
 	"time"
 )
 
-type State string
-
-const (
-	StateOpen      State = "open"      // 見積もり可能
-	StateEstimated State = "estimated" // 見積もり完了して表示
-)
-
 type Room struct {
 	id             string
 	state          State
 	estimates      []*Estimate
 	lastModifiedAt time.Time
 	lastRevealedAt *time.Time
-	mu             sync.RWMutex
+	passcodeHash   string
+	deck           []string
+	roles          map[string]Role
+	// 参加者の名前と join で渡したトークンのハッシュ
+	tokens    map[string]string
+	retention Retention
+	roomType  RoomType
+	anonymous bool
+	// チームルームのみ
+	members []*Member
+	// 以前のバージョンでルームに残していた履歴。今の履歴は estimates_revealed のイベントに残す
+	legacyRounds []*Round
+	audit        []*AuditEntry
+	// 今のストーリーで見積もり直す前に公開したラウンド。リセットすると新しいストーリーになる
+	storyRounds []*Round
+	// 直近 MaxChatMessages 件のチャット
+	messages []*ChatMessage
+	// 最後に記録したイベントと、最後に公開したときのイベントの番号
+	seq         int64
+	revealedSeq int64
+	// まだ保存していないイベントとスナップショット
+	pendingEvents    []RoomEvent
+	pendingSnapshots []RoomSnapshot
+	mu               sync.RWMutex
 }
 
 func NewRoom(id string) *Room {
 	return &Room{
 		id:             id,
-		state:          StateOpen,
+		state:          StateLobby,
 		estimates:      []*Estimate{},
 		lastModifiedAt: time.Now(),
 	}
@@ -43,14 +59,20 @@ func (r *Room) Estimates() []*Estimate {
 }
 
 func (r *Room) LastModifiedAt() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.lastModifiedAt
 }
 
 func (r *Room) LastRevealedAt() *time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.lastRevealedAt
 }
 
 func (r *Room) State() State {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.state
 }
 
@@ -60,49 +82,173 @@ type SerializedRoom struct {
 	Estimates      []*SerializedEstimate `json:"estimates"`
 	LastModifiedAt time.Time             `json:"last_modified_at"`
 	LastRevealedAt *time.Time            `json:"last_revealed_at"`
+	PasscodeHash   string                `json:"passcode_hash,omitempty"`
+	Deck           []string              `json:"deck,omitempty"`
+	Roles          map[string]Role       `json:"roles,omitempty"`
+	Tokens         map[string]string     `json:"tokens,omitempty"`
+	Retention      Retention             `json:"retention,omitempty"`
+	Type           RoomType              `json:"type,omitempty"`
+	Anonymous      bool                  `json:"anonymous,omitempty"`
+	Members        []*Member             `json:"members,omitempty"`
+	Rounds         []*Round              `json:"rounds,omitempty"` // 以前のバージョンの履歴。読み込むだけで追加しない
+	Seq            int64                 `json:"seq,omitempty"`
+	RevealedSeq    int64                 `json:"revealed_seq,omitempty"`
+	Audit          []*AuditEntry         `json:"audit,omitempty"`
+	Messages       []*ChatMessage        `json:"messages,omitempty"`
+	StoryRounds    []*Round              `json:"story_rounds,omitempty"`
 }
 
 type SerializedEstimate struct {
-	User  User   `json:"user"`
-	Point string `json:"point"`
+	User      User   `json:"user"`
+	Point     string `json:"point"`
+	Rationale string `json:"rationale,omitempty"`
+	Changes   int    `json:"changes,omitempty"`
 }
 
 func (r *Room) Serialize() SerializedRoom {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.serialize()
+}
+
+// serialize 呼び出し元でロックを取ること
+func (r *Room) serialize() SerializedRoom {
 	var estimates []*SerializedEstimate
 	for _, est := range r.estimates {
 		estimates = append(estimates, &SerializedEstimate{
-			User:  *est.User,
-			Point: est.Point.Label(),
+			User:      *est.User,
+			Point:     est.Point.Label(),
+			Rationale: est.Rationale,
+			Changes:   est.Changes,
 		})
 	}
+	// LastSeenAt は後から書き換えるのでコピーしておく
+	var members []*Member
+	for _, m := range r.members {
+		member := *m
+		members = append(members, &member)
+	}
+	// スナップショットを保存するまでに SetRole で書き換わらないようにする
+	var roles map[string]Role
+	if r.roles != nil {
+		roles = make(map[string]Role, len(r.roles))
+		for name, role := range r.roles {
+			roles[name] = role
+		}
+	}
+	var tokens map[string]string
+	if r.tokens != nil {
+		tokens = make(map[string]string, len(r.tokens))
+		for name, hash := range r.tokens {
+			tokens[name] = hash
+		}
+	}
 	return SerializedRoom{
 		ID:             r.id,
 		State:          r.state,
 		Estimates:      estimates,
 		LastModifiedAt: r.lastModifiedAt,
 		LastRevealedAt: r.lastRevealedAt,
+		PasscodeHash:   r.passcodeHash,
+		Deck:           r.deck,
+		Roles:          roles,
+		Tokens:         tokens,
+		Retention:      r.retention,
+		Type:           r.roomType,
+		Anonymous:      r.anonymous,
+		Members:        members,
+		Rounds:         r.legacyRounds,
+		Seq:            r.seq,
+		RevealedSeq:    r.revealedSeq,
+		Audit:          r.audit,
+		Messages:       r.messages,
+		StoryRounds:    r.storyRounds,
 	}
 }
 
+var CorruptedRoomError = fmt.Errorf("corrupted room")
+
 func NewFromSerializedRoom(s SerializedRoom) (*Room, error) {
+	if s.Seq < 0 || s.RevealedSeq < 0 || s.RevealedSeq > s.Seq {
+		return nil, fmt.Errorf("%w: invalid seq %d (revealed %d)", CorruptedRoomError, s.Seq, s.RevealedSeq)
+	}
+	if s.Retention < RetentionPermanent {
+		return nil, fmt.Errorf("%w: invalid retention %d", CorruptedRoomError, s.Retention)
+	}
+	if _, err := ParseRoomType(string(s.Type)); err != nil {
+		return nil, fmt.Errorf("%w: %v", CorruptedRoomError, err)
+	}
+	var members []*Member
+	for _, m := range s.Members {
+		if m == nil {
+			return nil, fmt.Errorf("%w: null member", CorruptedRoomError)
+		}
+		member := *m
+		members = append(members, &member)
+	}
+	for _, rounds := range [][]*Round{s.Rounds, s.StoryRounds} {
+		for _, round := range rounds {
+			if round == nil {
+				return nil, fmt.Errorf("%w: null round", CorruptedRoomError)
+			}
+		}
+	}
+	for _, entry := range s.Audit {
+		if entry == nil {
+			return nil, fmt.Errorf("%w: null audit entry", CorruptedRoomError)
+		}
+	}
+	for _, m := range s.Messages {
+		if m == nil {
+			return nil, fmt.Errorf("%w: null chat message", CorruptedRoomError)
+		}
+	}
 	var estimates []*Estimate
 	for _, est := range s.Estimates {
+		if est == nil {
+			return nil, fmt.Errorf("%w: null estimate", CorruptedRoomError)
+		}
 		point, err := NewPoint(est.Point)
 		if err != nil {
 			return nil, err
 		}
 		estimates = append(estimates, &Estimate{
-			User:  &est.User,
-			Point: point,
+			User:      &est.User,
+			Point:     point,
+			Rationale: est.Rationale,
+			Changes:   est.Changes,
 		})
 	}
-	return &Room{
+	state := migrateState(s.State, estimates)
+	if !state.valid() {
+		return nil, fmt.Errorf("%w: unknown state %q", CorruptedRoomError, s.State)
+	}
+	room := &Room{
 		id:             s.ID,
-		state:          s.State,
+		state:          state,
 		estimates:      estimates,
 		lastModifiedAt: s.LastModifiedAt,
 		lastRevealedAt: s.LastRevealedAt,
-	}, nil
+		passcodeHash:   s.PasscodeHash,
+		deck:           s.Deck,
+		roles:          s.Roles,
+		tokens:         s.Tokens,
+		retention:      s.Retention,
+		roomType:       s.Type,
+		anonymous:      s.Anonymous,
+		members:        members,
+		legacyRounds:   s.Rounds,
+		seq:            s.Seq,
+		revealedSeq:    s.RevealedSeq,
+		audit:          s.Audit,
+		messages:       s.Messages,
+		storyRounds:    s.StoryRounds,
+	}
+	// イベントを記録する前に保存されたルームは、今の状態をリプレイの起点にする
+	if s.Seq == 0 {
+		room.pendingSnapshots = []RoomSnapshot{{Seq: 0, Room: room.serialize()}}
+	}
+	return room, nil
 }
 
 var UserAlreadyExistsError = fmt.Errorf("user already exists")
@@ -111,82 +257,180 @@ var UserNotFoundError = fmt.Errorf("user not found")
 func (r *Room) AddUser(userName string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	now := time.Now()
+	if err := r.addUser(userName, now); err != nil {
+		return err
+	}
+	r.record(RoomEvent{Type: EventUserAdded, At: now, UserName: userName})
+	return nil
+}
+
+func (r *Room) addUser(userName string, now time.Time) error {
 	for _, est := range r.estimates {
 		if est.User.Name == userName {
-			est.User.LastUsedAt = time.Now()
+			est.User.LastUsedAt = now
+			r.touchMember(userName, now)
 			return UserAlreadyExistsError
 		}
+		if userNameKey(est.User.Name) == userNameKey(userName) {
+			return UserNameConflictError
+		}
 	}
-	user := NewUser(userName)
 	estimate := &Estimate{
-		User:  user,
+		User:  &User{Name: userName, LastUsedAt: now},
 		Point: &PointNotSet,
 	}
 	r.estimates = append(r.estimates, estimate)
-	r.lastModifiedAt = time.Now()
+	r.lastModifiedAt = now
+	r.touchMember(userName, now)
 	return nil
 }
 
+// HasParticipant 今参加しているか。チームルームのオフラインのメンバーは含まない
+func (r *Room) HasParticipant(userName string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.findEstimate(userName) != nil
+}
+
+// RemoveUser 退出させる。チームルームではメンバーとしては残り、オフラインになる
 func (r *Room) RemoveUser(userName string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	now := time.Now()
+	if err := r.removeUser(userName, now); err != nil {
+		return err
+	}
+	r.record(RoomEvent{Type: EventUserRemoved, At: now, UserName: userName})
+	return nil
+}
+
+func (r *Room) removeUser(userName string, now time.Time) error {
 	for i, est := range r.estimates {
 		if est.User.Name == userName {
 			r.estimates = append(r.estimates[:i], r.estimates[i+1:]...)
-			r.lastModifiedAt = time.Now()
+			r.lastModifiedAt = now
+			r.touchMember(userName, now)
 			return nil
 		}
 	}
 	return UserNotFoundError
 }
 
-func (r *Room) SetEstimate(userName string, point *Point) error {
+// SetEstimate rationale はカードを選んだ理由。NormalizeRationale で検証しておくこと
+func (r *Room) SetEstimate(userName string, point *Point, rationale string) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	// 見積もり後最初の変更は全員の見積もりをリセット
-	if r.state == StateEstimated {
-		for _, est := range r.estimates {
-			est.Point = &PointNotSet
-			est.User.LastUsedAt = time.Now()
-		}
-		r.state = StateOpen
+	if !r.inDeck(point) {
+		return PointNotInDeckError
+	}
+	now := time.Now()
+	if err := r.setEstimate(userName, point, rationale, now); err != nil {
+		return err
 	}
+	r.record(RoomEvent{Type: EventEstimateSet, At: now, UserName: userName, Point: point.Label(), Rationale: rationale, Anonymous: r.anonymous})
+	return nil
+}
 
+func (r *Room) setEstimate(userName string, point *Point, rationale string, now time.Time) error {
+	if r.state == StateLocked {
+		return VotesLockedError
+	}
+	// エラーを返す場合はルームを変更しないよう、先にすべて確かめる
+	next, err := r.state.Next(TransitionVote)
+	if err != nil {
+		return err
+	}
+	var estimate *Estimate
 	for _, est := range r.estimates {
 		if est.User.Name == userName {
-			est.Point = point
-			est.User.LastUsedAt = time.Now()
-			r.lastModifiedAt = time.Now()
-			return nil
+			estimate = est
+			break
+		}
+		if userNameKey(est.User.Name) == userNameKey(userName) {
+			return UserNameConflictError
 		}
 	}
-	user := NewUser(userName)
-	estimate := &Estimate{
-		User:  user,
-		Point: point,
+	// 参加者として加えるのは join だけ。退出させられた人が見積もりで戻らないようにする
+	if estimate == nil {
+		return UserNotFoundError
 	}
-	r.estimates = append(r.estimates, estimate)
-	r.lastModifiedAt = time.Now()
+
+	// 見積もり後最初の変更は全員の見積もりをリセットし、新しいストーリーにする
+	// 前のラウンドと比べたい場合は先に Revote する
+	if r.state.Revealed() {
+		r.clearEstimates()
+		for _, est := range r.estimates {
+			est.User.LastUsedAt = now
+		}
+		r.storyRounds = nil
+	}
+	r.state = next
+	// 出したカードを別のカードに変えた回数を数える
+	if estimate.Point != &PointNotSet && estimate.Point.Label() != point.Label() {
+		estimate.Changes++
+	}
+	estimate.Point = point
+	estimate.Rationale = rationale
+	estimate.User.LastUsedAt = now
+	r.lastModifiedAt = now
+	r.touchMember(userName, now)
 	return nil
 }
 
-func (r *Room) RevealEstimates() {
+// RevealEstimates 確定したストーリーは公開し直せない
+func (r *Room) RevealEstimates() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	now := time.Now()
-	r.state = StateEstimated
+	round, err := r.revealEstimates(now)
+	if err != nil {
+		return err
+	}
+	r.record(RoomEvent{Type: EventEstimatesRevealed, At: now, Round: round})
+	return nil
+}
+
+// revealEstimates チームルームでは履歴に残すラウンドを返す
+func (r *Room) revealEstimates(now time.Time) (*Round, error) {
+	// 公開し直しただけでは同じ見積もりを履歴に重ねない
+	revealed := r.state.Revealed()
+	if err := r.transition(TransitionReveal); err != nil {
+		return nil, err
+	}
+	var round *Round
+	if !revealed {
+		round = r.historyRound(now)
+	}
 	r.lastModifiedAt = now
 	r.lastRevealedAt = &now
+	return round, nil
 }
 
 func (r *Room) ResetEstimates() {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	now := time.Now()
+	r.resetEstimates(now)
+	r.record(RoomEvent{Type: EventEstimatesReset, At: now})
+}
+
+func (r *Room) resetEstimates(now time.Time) {
+	r.clearEstimates()
+	r.storyRounds = nil
+	// どの状態からでもリセットできる
+	_ = r.transition(TransitionReset)
+	r.lastModifiedAt = now
+}
+
+// clearEstimates 次のラウンドのために全員の見積もりを空にする。呼び出し元でロックを取ること
+func (r *Room) clearEstimates() {
 	for _, est := range r.estimates {
 		est.Point = &PointNotSet
+		est.Rationale = ""
+		est.Changes = 0
 	}
-	r.lastModifiedAt = time.Now()
 }
 
 type User struct {
@@ -204,6 +448,11 @@ type Point struct {
 	label       string
 }
 
+var InvalidPointError = fmt.Errorf("invalid point")
+
+// MaxPointValue 数値のカードの絶対値の上限。集計で桁あふれしないようにする
+const MaxPointValue = 1_000_000
+
 var PointNotSet = Point{}
 var PointUnknown = Point{isCountable: false, value: 0, label: "?"}
 var PointInfinite = Point{isCountable: false, value: 0, label: "∞"}
@@ -219,17 +468,27 @@ func NewPoint(label string) (*Point, error) {
 	default:
 	}
 	i, err := strconv.Atoi(label)
-	if err != nil {
-		return nil, fmt.Errorf("invalid point: %s", label)
+	if err != nil || i > MaxPointValue || i < -MaxPointValue {
+		return nil, fmt.Errorf("%w: %s", InvalidPointError, label)
 	}
-	return &Point{isCountable: true, value: i, label: label}, nil
+	// "05" や "+5" も "5" として扱い、同じ値のカードが別々に集計されないようにする
+	return &Point{isCountable: true, value: i, label: strconv.Itoa(i)}, nil
 }
 
 func (p *Point) Label() string {
 	return p.label
 }
 
+// Value 数値のカードの場合のみ ok
+func (p *Point) Value() (int, bool) {
+	return p.value, p.isCountable
+}
+
 type Estimate struct {
 	User  *User
 	Point *Point
+	// カードを選んだ理由。公開したときにカードと一緒に見せる
+	Rationale string
+	// このラウンドで出したカードを変えた回数
+	Changes int
 }
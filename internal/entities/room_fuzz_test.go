@@ -0,0 +1,101 @@
+package entities
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func FuzzNewPoint(f *testing.F) {
+	for _, label := range []string{"", "?", "∞", "0", "1", "13", "-1", "+5", "007", "1.5", "abc", "9999999999999999999999", "1000000", "1000001", "-1000001"} {
+		f.Add(label)
+	}
+	f.Fuzz(func(t *testing.T, label string) {
+		point, err := NewPoint(label)
+		if err != nil {
+			if !errors.Is(err, InvalidPointError) {
+				t.Fatalf("NewPoint(%q) error = %v, want %v", label, err, InvalidPointError)
+			}
+			return
+		}
+		// 数値のカードは値から作り直したラベルになる
+		want := label
+		if v, ok := point.Value(); ok {
+			want = strconv.Itoa(v)
+		}
+		if point.Label() != want {
+			t.Fatalf("NewPoint(%q).Label() = %q, want %q", label, point.Label(), want)
+		}
+		if v, ok := point.Value(); ok && (v > MaxPointValue || v < -MaxPointValue) {
+			t.Fatalf("NewPoint(%q).Value() = %d, out of range", label, v)
+		}
+		// ラベルから作り直しても同じポイントになる
+		again, err := NewPoint(point.Label())
+		if err != nil {
+			t.Fatalf("NewPoint(%q) again: %v", point.Label(), err)
+		}
+		if *again != *point {
+			t.Fatalf("NewPoint(%q) = %+v, then %+v", label, *point, *again)
+		}
+	})
+}
+
+func FuzzNewFromSerializedRoom(f *testing.F) {
+	room := NewRoom("room1")
+	for _, name := range []string{"alice", "bob"} {
+		if err := room.AddUser(name); err != nil {
+			f.Fatal(err)
+		}
+	}
+	point, err := NewPoint("3")
+	if err != nil {
+		f.Fatal(err)
+	}
+	if err := room.SetEstimate("alice", point, ""); err != nil {
+		f.Fatal(err)
+	}
+	if err := room.SetRole("alice", RoleFacilitator); err != nil {
+		f.Fatal(err)
+	}
+	if err := room.RevealEstimates(); err != nil {
+		f.Fatal(err)
+	}
+	seed, err := json.Marshal(room.Serialize())
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(seed)
+	f.Add([]byte(`{"id":"room1","state":"open","estimates":[null]}`))
+	f.Add([]byte(`{"id":"room1","state":"open","estimates":[{"user":{"Name":"alice"},"point":"x"}]}`))
+	f.Add([]byte(`{"id":"room1","state":"broken"}`))
+	f.Add([]byte(`{"id":"room1","state":"open","deck":["1","1"],"roles":{"alice":"owner"}}`))
+
+	// 保存されたデータが壊れていてもパニックせず、読み込めたものは何度保存し直しても同じになる
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var serialized SerializedRoom
+		if err := json.Unmarshal(data, &serialized); err != nil {
+			return
+		}
+		room, err := NewFromSerializedRoom(serialized)
+		if err != nil {
+			return
+		}
+		first := room.Serialize()
+		restored, err := NewFromSerializedRoom(first)
+		if err != nil {
+			t.Fatalf("NewFromSerializedRoom(%+v) after round trip: %v", first, err)
+		}
+		second := restored.Serialize()
+		if !reflect.DeepEqual(first, second) {
+			t.Fatalf("serialization is not idempotent:\n%+v\n%+v", first, second)
+		}
+		// 読み込んだルームの読み取りもパニックしない
+		for _, est := range restored.Estimates() {
+			_ = est.Point.Label()
+		}
+		_ = restored.IsProtected()
+		_ = restored.Roles()
+	})
+}
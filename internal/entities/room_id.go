@@ -0,0 +1,34 @@
+package entities
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// 読み間違えやすい I L O U を除いた Crockford's Base32
+const roomIDAlphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+
+const (
+	roomIDGroups    = 3
+	roomIDGroupSize = 4
+)
+
+// GenerateRoomID 推測されにくく、口頭でも伝えやすいルームIDを生成する
+// 例: 7k2m-qx9d-a4tz (60bit)
+func GenerateRoomID() (string, error) {
+	b := make([]byte, roomIDGroups*roomIDGroupSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("fail to generate room id: %v", err)
+	}
+	groups := make([]string, 0, roomIDGroups)
+	for i := 0; i < roomIDGroups; i++ {
+		var sb strings.Builder
+		for _, c := range b[i*roomIDGroupSize : (i+1)*roomIDGroupSize] {
+			// 256 は 32 で割り切れるので偏りは出ない
+			sb.WriteByte(roomIDAlphabet[int(c)%len(roomIDAlphabet)])
+		}
+		groups = append(groups, sb.String())
+	}
+	return strings.Join(groups, "-"), nil
+}
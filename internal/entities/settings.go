@@ -0,0 +1,184 @@
+package entities
+
+import (
+	"fmt"
+	"time"
+)
+
+type Role string
+
+const (
+	RoleFacilitator Role = "facilitator" // 公開・リセットなどの進行ができる
+	RoleVoter       Role = "voter"       // 見積もりのみ
+)
+
+var PointNotInDeckError = fmt.Errorf("point is not in the deck")
+var PermissionDeniedError = fmt.Errorf("permission denied")
+var InvalidRoleError = fmt.Errorf("invalid role")
+
+// Deck ルームで使えるカード。空の場合は任意の値を受け付ける
+func (r *Room) Deck() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.deck
+}
+
+// SetDeck 使えるカードを設定する
+func (r *Room) SetDeck(labels []string) error {
+	deck := make([]string, 0, len(labels))
+	for _, label := range labels {
+		point, err := NewPoint(label)
+		if err != nil {
+			return err
+		}
+		if point == &PointNotSet {
+			return fmt.Errorf("%w: empty label", InvalidPointError)
+		}
+		deck = append(deck, point.Label())
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deck = deck
+	r.lastModifiedAt = time.Now()
+	r.record(RoomEvent{Type: EventSettingsChanged, At: r.lastModifiedAt, Setting: SettingDeck})
+	return nil
+}
+
+// inDeck 呼び出し元でロックを取ること
+func (r *Room) inDeck(point *Point) bool {
+	if len(r.deck) == 0 || point == &PointNotSet {
+		return true
+	}
+	for _, label := range r.deck {
+		// 以前のバージョンで保存した山札には "05" のようなラベルが残っている
+		if card, err := NewPoint(label); err == nil && card.Label() == point.Label() {
+			return true
+		}
+	}
+	return false
+}
+
+// Roles 役割が明示されている参加者
+func (r *Room) Roles() map[string]Role {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	roles := make(map[string]Role, len(r.roles))
+	for name, role := range r.roles {
+		roles[name] = role
+	}
+	return roles
+}
+
+// RoleOf 明示されていない参加者は voter
+func (r *Room) RoleOf(userName string) Role {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if role, ok := r.roles[userName]; ok {
+		return role
+	}
+	return RoleVoter
+}
+
+func (r *Room) SetRole(userName string, role Role) error {
+	if role != RoleFacilitator && role != RoleVoter {
+		return fmt.Errorf("%w: %s", InvalidRoleError, role)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.roles == nil {
+		r.roles = map[string]Role{}
+	}
+	r.roles[userName] = role
+	r.lastModifiedAt = time.Now()
+	r.record(RoomEvent{Type: EventSettingsChanged, At: r.lastModifiedAt, UserName: userName, Setting: SettingRole})
+	return nil
+}
+
+// CanFacilitate 進行役が決まっていないルームでは誰でも進行できる
+func (r *Room) CanFacilitate(userName string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	hasFacilitator := false
+	for name, role := range r.roles {
+		if role != RoleFacilitator {
+			continue
+		}
+		if name == userName {
+			return true
+		}
+		hasFacilitator = true
+	}
+	return !hasFacilitator
+}
+
+// Retention 最後に保存してからルームを残しておく期間
+type Retention time.Duration
+
+const (
+	// RetentionDefault デプロイの設定 (ROOM_TTL) に従う
+	RetentionDefault Retention = 0
+	// RetentionPermanent 期限切れで削除しない。チームで使い続けるルーム向け
+	RetentionPermanent Retention = -1
+)
+
+var InvalidRetentionError = fmt.Errorf("invalid retention")
+
+// ParseRetention 空文字はデフォルト、"permanent" は永続、それ以外は "72h" のような期間
+func ParseRetention(s string) (Retention, error) {
+	switch s {
+	case "":
+		return RetentionDefault, nil
+	case "permanent":
+		return RetentionPermanent, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%w: %s", InvalidRetentionError, s)
+	}
+	return Retention(d), nil
+}
+
+func (r Retention) String() string {
+	switch r {
+	case RetentionDefault:
+		return ""
+	case RetentionPermanent:
+		return "permanent"
+	default:
+		return time.Duration(r).String()
+	}
+}
+
+func (r *Room) Retention() Retention {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.retention
+}
+
+func (r *Room) SetRetention(retention Retention) error {
+	if retention < RetentionPermanent {
+		return fmt.Errorf("%w: %d", InvalidRetentionError, retention)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.retention = retention
+	r.lastModifiedAt = time.Now()
+	r.record(RoomEvent{Type: EventSettingsChanged, At: r.lastModifiedAt, Setting: SettingRetention})
+	return nil
+}
+
+// ExpiresAt savedAt に保存した場合の有効期限。永続的なルームは nil
+func (r *Room) ExpiresAt(savedAt time.Time, defaultTTL time.Duration) *time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ttl := defaultTTL
+	switch r.retention {
+	case RetentionPermanent:
+		return nil
+	case RetentionDefault:
+	default:
+		ttl = time.Duration(r.retention)
+	}
+	expiresAt := savedAt.Add(ttl)
+	return &expiresAt
+}
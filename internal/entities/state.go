@@ -0,0 +1,122 @@
+package entities
+
+import "fmt"
+
+// State ルームの進行状況。クライアントや連携先はこの名前で判別する
+type State string
+
+const (
+	StateLobby      State = "lobby"      // 今のストーリーでまだ誰も見積もっていない
+	StateVoting     State = "voting"     // 見積もり中
+	StateLocked     State = "locked"     // 公開前に見積もりを締め切った。変更できない
+	StateRevealed   State = "revealed"   // 見積もりを公開した
+	StateDiscussion State = "discussion" // 公開した見積もりについて話し合っている
+	StateFinalized  State = "finalized"  // ストーリーの見積もりを確定した
+)
+
+// 以前のバージョンで保存されたルームの状態。読み込むときに置き換える
+const (
+	legacyStateOpen      State = "open"
+	legacyStateEstimated State = "estimated"
+)
+
+var InvalidStateError = fmt.Errorf("invalid state for this operation")
+
+// Transition 状態を変える操作
+type Transition string
+
+const (
+	TransitionVote     Transition = "vote"
+	TransitionLock     Transition = "lock"
+	TransitionUnlock   Transition = "unlock"
+	TransitionReveal   Transition = "reveal"
+	TransitionDiscuss  Transition = "discuss"
+	TransitionFinalize Transition = "finalize"
+	TransitionRevote   Transition = "revote"
+	TransitionReset    Transition = "reset"
+)
+
+// transitions 状態ごとに受け付ける操作と、その後の状態
+// 公開した後の見積もりは新しいストーリーの始まりになる
+var transitions = map[State]map[Transition]State{
+	StateLobby: {
+		TransitionVote:   StateVoting,
+		TransitionReveal: StateRevealed,
+		TransitionReset:  StateLobby,
+	},
+	StateVoting: {
+		TransitionVote:   StateVoting,
+		TransitionLock:   StateLocked,
+		TransitionReveal: StateRevealed,
+		TransitionReset:  StateLobby,
+	},
+	StateLocked: {
+		TransitionUnlock: StateVoting,
+		TransitionReveal: StateRevealed,
+		TransitionReset:  StateLobby,
+	},
+	StateRevealed: {
+		TransitionVote:     StateVoting,
+		TransitionReveal:   StateRevealed,
+		TransitionDiscuss:  StateDiscussion,
+		TransitionFinalize: StateFinalized,
+		TransitionRevote:   StateVoting,
+		TransitionReset:    StateLobby,
+	},
+	StateDiscussion: {
+		TransitionVote:     StateVoting,
+		TransitionReveal:   StateRevealed,
+		TransitionFinalize: StateFinalized,
+		TransitionRevote:   StateVoting,
+		TransitionReset:    StateLobby,
+	},
+	StateFinalized: {
+		TransitionVote:  StateVoting,
+		TransitionReset: StateLobby,
+	},
+}
+
+// Next 操作した後の状態。受け付けない操作なら InvalidStateError
+func (s State) Next(t Transition) (State, error) {
+	next, ok := transitions[s][t]
+	if !ok {
+		return s, fmt.Errorf("%w: cannot %s in %s", InvalidStateError, t, s)
+	}
+	return next, nil
+}
+
+// Revealed 見積もりを公開した後の状態か
+func (s State) Revealed() bool {
+	return s == StateRevealed || s == StateDiscussion || s == StateFinalized
+}
+
+func (s State) valid() bool {
+	_, ok := transitions[s]
+	return ok
+}
+
+// transition 状態を変える。呼び出し元でロックを取ること
+func (r *Room) transition(t Transition) error {
+	next, err := r.state.Next(t)
+	if err != nil {
+		return err
+	}
+	r.state = next
+	return nil
+}
+
+// migrateState 以前のバージョンの状態を今の状態に置き換える
+func migrateState(state State, estimates []*Estimate) State {
+	switch state {
+	case legacyStateOpen:
+		for _, est := range estimates {
+			if est.Point != &PointNotSet {
+				return StateVoting
+			}
+		}
+		return StateLobby
+	case legacyStateEstimated:
+		return StateRevealed
+	}
+	return state
+}
@@ -0,0 +1,92 @@
+package entities
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestState_Next(t *testing.T) {
+	for _, tt := range []struct {
+		from State
+		t    Transition
+		want State
+	}{
+		{from: StateLobby, t: TransitionVote, want: StateVoting},
+		{from: StateLobby, t: TransitionLock},
+		{from: StateVoting, t: TransitionLock, want: StateLocked},
+		{from: StateLocked, t: TransitionVote},
+		{from: StateLocked, t: TransitionUnlock, want: StateVoting},
+		{from: StateLocked, t: TransitionReveal, want: StateRevealed},
+		{from: StateVoting, t: TransitionDiscuss},
+		{from: StateRevealed, t: TransitionDiscuss, want: StateDiscussion},
+		{from: StateDiscussion, t: TransitionRevote, want: StateVoting},
+		{from: StateDiscussion, t: TransitionFinalize, want: StateFinalized},
+		{from: StateFinalized, t: TransitionRevote},
+		{from: StateFinalized, t: TransitionReveal},
+		{from: StateFinalized, t: TransitionVote, want: StateVoting},
+		{from: StateFinalized, t: TransitionReset, want: StateLobby},
+	} {
+		got, err := tt.from.Next(tt.t)
+		if tt.want == "" {
+			if !errors.Is(err, InvalidStateError) || got != tt.from {
+				t.Errorf("%s in %s = %s, %v, want InvalidStateError", tt.t, tt.from, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s in %s = %s, %v, want %s", tt.t, tt.from, got, err, tt.want)
+		}
+	}
+}
+
+func TestNewFromSerializedRoom_MigratesState(t *testing.T) {
+	alice := &SerializedEstimate{User: User{Name: "alice"}, Point: "3"}
+	bob := &SerializedEstimate{User: User{Name: "bob"}}
+	for _, tt := range []struct {
+		state     State
+		estimates []*SerializedEstimate
+		want      State
+	}{
+		{state: "open", estimates: []*SerializedEstimate{bob}, want: StateLobby},
+		{state: "open", estimates: []*SerializedEstimate{alice, bob}, want: StateVoting},
+		{state: "estimated", estimates: []*SerializedEstimate{alice, bob}, want: StateRevealed},
+		{state: StateDiscussion, want: StateDiscussion},
+	} {
+		room, err := NewFromSerializedRoom(SerializedRoom{ID: "room1", State: tt.state, Estimates: tt.estimates})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := room.State(); got != tt.want {
+			t.Errorf("state %s = %s, want %s", tt.state, got, tt.want)
+		}
+	}
+	if _, err := NewFromSerializedRoom(SerializedRoom{ID: "room1", State: "broken"}); !errors.Is(err, CorruptedRoomError) {
+		t.Errorf("unknown state error = %v, want CorruptedRoomError", err)
+	}
+}
+
+func TestRoom_SetEstimateRejectedInRevealedRoom(t *testing.T) {
+	room := NewRoom("room1")
+	if err := room.AddUser("Alice"); err != nil {
+		t.Fatal(err)
+	}
+	three, _ := NewPoint("3")
+	if err := room.SetEstimate("Alice", three, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.RevealEstimates(); err != nil {
+		t.Fatal(err)
+	}
+	seq := room.Seq()
+	five, _ := NewPoint("5")
+	if err := room.SetEstimate("alice", five, ""); !errors.Is(err, UserNameConflictError) {
+		t.Fatalf("estimate with a case-folded name = %v, want UserNameConflictError", err)
+	}
+	// 拒否した見積もりで公開済みのストーリーが消えないこと
+	if room.State() != StateRevealed || room.Seq() != seq {
+		t.Errorf("rejected estimate changed the room: state %s, seq %d -> %d", room.State(), seq, room.Seq())
+	}
+	if est := room.Estimates(); len(est) != 1 || est[0].Point.Label() != "3" {
+		t.Errorf("rejected estimate cleared the revealed cards: %+v", est)
+	}
+}
@@ -0,0 +1,85 @@
+package entities
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+)
+
+// CardCount 同じカードを出した人数
+type CardCount struct {
+	Point string `json:"point"`
+	Count int    `json:"count"`
+}
+
+// EstimateStats 公開した見積もりの集計。誰が出したかは含まない
+type EstimateStats struct {
+	// 見積もりを出した人数
+	Votes int `json:"votes"`
+	// カードごとの人数。ComparePoints の順
+	Distribution []CardCount `json:"distribution"`
+	// 数値のカードだけで計算する。数値のカードがなければ nil
+	Average *float64 `json:"average,omitempty"`
+	Median  *float64 `json:"median,omitempty"`
+	Min     *int     `json:"min,omitempty"`
+	Max     *int     `json:"max,omitempty"`
+}
+
+// Summarize 出されていない見積もりは数えない
+func Summarize(points []*Point) EstimateStats {
+	stats := EstimateStats{Distribution: []CardCount{}}
+	var cast []*Point
+	for _, p := range points {
+		if p != nil && p != &PointNotSet {
+			cast = append(cast, p)
+		}
+	}
+	slices.SortStableFunc(cast, ComparePoints)
+	var values []int
+	for _, p := range cast {
+		stats.Votes++
+		if n := len(stats.Distribution); n > 0 && stats.Distribution[n-1].Point == p.Label() {
+			stats.Distribution[n-1].Count++
+		} else {
+			stats.Distribution = append(stats.Distribution, CardCount{Point: p.Label(), Count: 1})
+		}
+		if v, ok := p.Value(); ok {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return stats
+	}
+	// cast を並べ替えてあるので values も小さい順
+	// 合計は桁あふれしないよう float64 で取る
+	var sum float64
+	for _, v := range values {
+		sum += float64(v)
+	}
+	average := sum / float64(len(values))
+	median := float64(values[len(values)/2])
+	if len(values)%2 == 0 {
+		median = (float64(values[len(values)/2-1]) + float64(values[len(values)/2])) / 2
+	}
+	stats.Average = &average
+	stats.Median = &median
+	stats.Min = &values[0]
+	stats.Max = &values[len(values)-1]
+	return stats
+}
+
+// ComparePoints 数値のカードを小さい順、その後に ? などのカードをラベル順
+func ComparePoints(a, b *Point) int {
+	av, aok := a.Value()
+	bv, bok := b.Value()
+	switch {
+	case aok && bok:
+		return cmp.Compare(av, bv)
+	case aok:
+		return -1
+	case bok:
+		return 1
+	default:
+		return strings.Compare(a.Label(), b.Label())
+	}
+}
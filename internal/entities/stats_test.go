@@ -0,0 +1,100 @@
+package entities
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSummarize(t *testing.T) {
+	points := func(labels ...string) []*Point {
+		var ps []*Point
+		for _, label := range labels {
+			p, err := NewPoint(label)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ps = append(ps, p)
+		}
+		return ps
+	}
+	for _, tt := range []struct {
+		name         string
+		points       []*Point
+		votes        int
+		distribution string
+		median       string
+	}{
+		{name: "empty", points: nil, distribution: "[]", median: "<nil>"},
+		{name: "not set is ignored", points: points("", "3"), votes: 1, distribution: "[{3 1}]", median: "3"},
+		{name: "odd", points: points("8", "1", "3", "5", "3"), votes: 5, distribution: "[{1 1} {3 2} {5 1} {8 1}]", median: "3"},
+		{name: "median of two", points: points("2", "5"), votes: 2, distribution: "[{2 1} {5 1}]", median: "3.5"},
+		{name: "uncountable", points: points("?", "∞", "?"), votes: 3, distribution: "[{? 2} {∞ 1}]", median: "<nil>"},
+		{name: "mixed", points: points("?", "13", "2"), votes: 3, distribution: "[{2 1} {13 1} {? 1}]", median: "7.5"},
+		{name: "same value with other labels", points: points("5", "05", "+5", "3"), votes: 4, distribution: "[{3 1} {5 3}]", median: "5"},
+		{name: "bounds", points: points("1000000", "-1000000", "1000000"), votes: 3, distribution: "[{-1000000 1} {1000000 2}]", median: "1e+06"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := Summarize(tt.points)
+			if stats.Votes != tt.votes {
+				t.Errorf("Votes = %d, want %d", stats.Votes, tt.votes)
+			}
+			if got := fmt.Sprint(stats.Distribution); got != tt.distribution {
+				t.Errorf("Distribution = %s, want %s", got, tt.distribution)
+			}
+			median := "<nil>"
+			if stats.Median != nil {
+				median = fmt.Sprint(*stats.Median)
+			}
+			if median != tt.median {
+				t.Errorf("Median = %s, want %s", median, tt.median)
+			}
+		})
+	}
+}
+
+func TestRoom_SetAnonymous(t *testing.T) {
+	room := NewRoom("room1")
+	if err := room.SetType(RoomTypeTeam); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.SetAnonymous(true); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if err := room.AddUser(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	point, _ := NewPoint("5")
+	if err := room.SetEstimate("bob", point, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.SetAnonymous(false); err != AnonymityLockedError {
+		t.Errorf("SetAnonymous while estimated = %v, want AnonymityLockedError", err)
+	}
+	if err := room.RevealEstimates(); err != nil {
+		t.Fatal(err)
+	}
+	var rounds []*Round
+	events, _ := room.PendingChanges()
+	for _, event := range events {
+		if event.Round != nil {
+			rounds = append(rounds, event.Round)
+		}
+	}
+	if len(rounds) != 1 || !rounds[0].Anonymous {
+		t.Fatalf("rounds = %+v, want 1 anonymous round", rounds)
+	}
+	for _, e := range rounds[0].Estimates {
+		if e.UserName != "" {
+			t.Errorf("round estimate %+v has a user name", e)
+		}
+	}
+	room.ResetEstimates()
+	if err := room.SetAnonymous(false); err != nil {
+		t.Errorf("SetAnonymous after reset = %v", err)
+	}
+	if room.Anonymous() {
+		t.Error("room is still anonymous")
+	}
+}
@@ -0,0 +1,43 @@
+package entities
+
+import "time"
+
+// StartDiscussion 公開した見積もりについて話し合っていることを全員に知らせる
+func (r *Room) StartDiscussion() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if err := r.startDiscussion(now); err != nil {
+		return err
+	}
+	r.record(RoomEvent{Type: EventDiscussionStarted, At: now})
+	return nil
+}
+
+func (r *Room) startDiscussion(now time.Time) error {
+	if err := r.transition(TransitionDiscuss); err != nil {
+		return err
+	}
+	r.lastModifiedAt = now
+	return nil
+}
+
+// Finalize 公開した見積もりでストーリーを確定する。確定した後は見積もり直せず、次の見積もりかリセットで新しいストーリーになる
+func (r *Room) Finalize() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if err := r.finalize(now); err != nil {
+		return err
+	}
+	r.record(RoomEvent{Type: EventStoryFinalized, At: now})
+	return nil
+}
+
+func (r *Room) finalize(now time.Time) error {
+	if err := r.transition(TransitionFinalize); err != nil {
+		return err
+	}
+	r.lastModifiedAt = now
+	return nil
+}
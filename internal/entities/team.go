@@ -0,0 +1,207 @@
+package entities
+
+import (
+	"fmt"
+	"time"
+)
+
+// RoomType ルームの使い方
+type RoomType string
+
+const (
+	// RoomTypeAdHoc 見積もりのたびに作る使い捨てのルーム。退出した参加者は消える
+	RoomTypeAdHoc RoomType = ""
+	// RoomTypeTeam 同じチームがスプリントをまたいで使い続けるルーム
+	// 期限切れで削除せず、退出したメンバーもオフラインとして残し、公開した結果を履歴に残す
+	RoomTypeTeam RoomType = "team"
+)
+
+var InvalidRoomTypeError = fmt.Errorf("invalid room type")
+
+// ParseRoomType 空文字は使い捨てのルーム
+func ParseRoomType(s string) (RoomType, error) {
+	switch RoomType(s) {
+	case RoomTypeAdHoc, RoomTypeTeam:
+		return RoomType(s), nil
+	default:
+		return "", fmt.Errorf("%w: %s", InvalidRoomTypeError, s)
+	}
+}
+
+// Member チームルームに参加したことのある人
+type Member struct {
+	Name       string    `json:"name"`
+	JoinedAt   time.Time `json:"joined_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+// Round 公開した時点の見積もり
+type Round struct {
+	RevealedAt time.Time        `json:"revealed_at"`
+	Estimates  []*RoundEstimate `json:"estimates"`
+	// 匿名のルームで公開した見積もりは名前を残さず、カードの順に並べる
+	Anonymous bool `json:"anonymous,omitempty"`
+	// 同じストーリーで何回目の見積もりか。1から
+	Number int `json:"number,omitempty"`
+}
+
+type RoundEstimate struct {
+	UserName  string `json:"user_name,omitempty"`
+	Point     string `json:"point"`
+	Rationale string `json:"rationale,omitempty"`
+	// そのラウンドで出したカードを変えた回数
+	Changes int `json:"changes,omitempty"`
+}
+
+func (r *Room) Type() RoomType {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.roomType
+}
+
+// SetType チームルームは期限切れで削除しない
+func (r *Room) SetType(roomType RoomType) error {
+	if _, err := ParseRoomType(string(roomType)); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.roomType = roomType
+	if roomType == RoomTypeTeam {
+		r.retention = RetentionPermanent
+	}
+	r.lastModifiedAt = time.Now()
+	r.record(RoomEvent{Type: EventSettingsChanged, At: r.lastModifiedAt, Setting: SettingType})
+	return nil
+}
+
+func (r *Room) IsTeam() bool {
+	return r.Type() == RoomTypeTeam
+}
+
+// Members チームルームに参加したことのある人。参加した順
+func (r *Room) Members() []Member {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	members := make([]Member, 0, len(r.members))
+	for _, m := range r.members {
+		members = append(members, *m)
+	}
+	return members
+}
+
+// OfflineMembers チームルームのメンバーのうち今は参加していない人
+func (r *Room) OfflineMembers() []Member {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var offline []Member
+	for _, m := range r.members {
+		if r.findEstimate(m.Name) == nil {
+			offline = append(offline, *m)
+		}
+	}
+	return offline
+}
+
+// RemoveMember チームルームのメンバーから外す。参加中であれば退出もさせる
+func (r *Room) RemoveMember(userName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if err := r.removeMember(userName, now); err != nil {
+		return err
+	}
+	r.record(RoomEvent{Type: EventMemberRemoved, At: now, UserName: userName})
+	return nil
+}
+
+func (r *Room) removeMember(userName string, now time.Time) error {
+	found := false
+	for i, m := range r.members {
+		if m.Name == userName {
+			r.members = append(r.members[:i], r.members[i+1:]...)
+			found = true
+			break
+		}
+	}
+	for i, est := range r.estimates {
+		if est.User.Name == userName {
+			r.estimates = append(r.estimates[:i], r.estimates[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return UserNotFoundError
+	}
+	// 外したメンバーの名前は別の人が使えるようにする
+	delete(r.tokens, userName)
+	r.lastModifiedAt = now
+	return nil
+}
+
+// LegacyRounds 以前のバージョンでルームに残していた履歴。古い順
+// それより後の履歴は estimates_revealed のイベントの Round にある
+func (r *Room) LegacyRounds() []*Round {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*Round(nil), r.legacyRounds...)
+}
+
+// touchMember チームルームのメンバーとして記録する。呼び出し元でロックを取ること
+func (r *Room) touchMember(userName string, now time.Time) {
+	if r.roomType != RoomTypeTeam {
+		return
+	}
+	for _, m := range r.members {
+		if m.Name == userName {
+			m.LastSeenAt = now
+			return
+		}
+	}
+	r.members = append(r.members, &Member{Name: userName, JoinedAt: now, LastSeenAt: now})
+}
+
+// historyRound 公開した見積もりを履歴に残すラウンドにする。呼び出し元でロックを取ること
+// 使い捨てのルームと、誰も見積もっていないラウンドは残さない
+func (r *Room) historyRound(revealedAt time.Time) *Round {
+	if r.roomType != RoomTypeTeam {
+		return nil
+	}
+	for _, est := range r.estimates {
+		if est.Point != &PointNotSet {
+			return r.currentRound(revealedAt)
+		}
+	}
+	return nil
+}
+
+// currentRound 今の見積もりを1ラウンドにまとめる。匿名のルームでは名前を残さない。呼び出し元でロックを取ること
+func (r *Room) currentRound(revealedAt time.Time) *Round {
+	round := &Round{RevealedAt: revealedAt, Estimates: []*RoundEstimate{}, Anonymous: r.anonymous, Number: r.roundNumber()}
+	if r.anonymous {
+		for _, est := range r.sortedEstimates() {
+			round.Estimates = append(round.Estimates, &RoundEstimate{Point: est.Point.Label(), Rationale: est.Rationale, Changes: est.Changes})
+		}
+		return round
+	}
+	for _, est := range r.estimates {
+		round.Estimates = append(round.Estimates, &RoundEstimate{
+			UserName:  est.User.Name,
+			Point:     est.Point.Label(),
+			Rationale: est.Rationale,
+			Changes:   est.Changes,
+		})
+	}
+	return round
+}
+
+// findEstimate 呼び出し元でロックを取ること
+func (r *Room) findEstimate(userName string) *Estimate {
+	for _, est := range r.estimates {
+		if est.User.Name == userName {
+			return est
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package entities
+
+import "testing"
+
+func TestRoom_HistoryRound(t *testing.T) {
+	revealedRounds := func(room *Room) []*Round {
+		var rounds []*Round
+		events, _ := room.PendingChanges()
+		for _, event := range events {
+			if event.Type == EventEstimatesRevealed && event.Round != nil {
+				rounds = append(rounds, event.Round)
+			}
+		}
+		return rounds
+	}
+	point, _ := NewPoint("3")
+
+	room := NewRoom("room1")
+	if err := room.SetType(RoomTypeTeam); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.AddUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	// 誰も見積もっていないラウンドは残さない
+	if err := room.RevealEstimates(); err != nil {
+		t.Fatal(err)
+	}
+	room.ResetEstimates()
+	if err := room.SetEstimate("alice", point, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.RevealEstimates(); err != nil {
+		t.Fatal(err)
+	}
+	// 公開し直しただけでは重ねない
+	if err := room.RevealEstimates(); err != nil {
+		t.Fatal(err)
+	}
+	rounds := revealedRounds(room)
+	if len(rounds) != 1 || len(rounds[0].Estimates) != 1 || rounds[0].Estimates[0].Point != "3" {
+		t.Fatalf("rounds = %+v, want the one round alice estimated", rounds)
+	}
+
+	// 使い捨てのルームでは残さない
+	adHoc := NewRoom("room2")
+	if err := adHoc.AddUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := adHoc.SetEstimate("alice", point, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := adHoc.RevealEstimates(); err != nil {
+		t.Fatal(err)
+	}
+	if rounds := revealedRounds(adHoc); len(rounds) != 0 {
+		t.Errorf("ad-hoc rounds = %+v, want none", rounds)
+	}
+}
+
+func TestNewFromSerializedRoom_LegacyRounds(t *testing.T) {
+	legacy := []*Round{{Number: 1, Estimates: []*RoundEstimate{{UserName: "alice", Point: "5"}}}}
+	room, err := NewFromSerializedRoom(SerializedRoom{ID: "room1", State: StateLobby, Type: RoomTypeTeam, Rounds: legacy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := room.LegacyRounds(); len(got) != 1 || got[0].Estimates[0].Point != "5" {
+		t.Errorf("legacy rounds = %+v", got)
+	}
+	// 保存し直しても消えない
+	if got := room.Serialize().Rounds; len(got) != 1 {
+		t.Errorf("serialized rounds = %+v, want the legacy round", got)
+	}
+}
@@ -0,0 +1,86 @@
+package entities
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var UserNameTakenError = fmt.Errorf("user name is taken")
+var InvalidTokenError = fmt.Errorf("invalid participant token")
+
+// GenerateParticipantToken join した参加者に渡すトークン。名前をこのトークンを持つクライアントに結びつける
+func GenerateParticipantToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("fail to generate participant token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken 平文は保持せずハッシュのみ保存する。推測できない長さなので bcrypt は使わない
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// AddParticipant token を持つ参加者として入る
+// 初めての名前は token に結びつけ、結びついている名前は同じ token でなければ使えない
+// すでに参加中の場合は UserAlreadyExistsError
+func (r *Room) AddParticipant(userName string, token string) error {
+	if token == "" {
+		return InvalidTokenError
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hash := hashToken(token)
+	// 名前を確かめるまではルームを変更しない
+	if bound, ok := r.tokens[userName]; ok && subtle.ConstantTimeCompare([]byte(bound), []byte(hash)) != 1 {
+		return UserNameTakenError
+	}
+	now := time.Now()
+	err := r.addUser(userName, now)
+	if err != nil && !errors.Is(err, UserAlreadyExistsError) {
+		return err
+	}
+	if r.tokens == nil {
+		r.tokens = map[string]string{}
+	}
+	r.tokens[userName] = hash
+	if err == nil {
+		r.record(RoomEvent{Type: EventUserAdded, At: now, UserName: userName})
+	}
+	return err
+}
+
+// Authenticate userName が token に結びついているか
+func (r *Room) Authenticate(userName string, token string) bool {
+	if userName == "" || token == "" {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	bound, ok := r.tokens[userName]
+	return ok && subtle.ConstantTimeCompare([]byte(bound), []byte(hashToken(token))) == 1
+}
+
+// Leave 本人の操作で退出する
+// 使い捨てのルームでは名前を手放し、別の人が使えるようにする。チームルームではメンバーとして残るので手放さない
+func (r *Room) Leave(userName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if err := r.removeUser(userName, now); err != nil {
+		return err
+	}
+	if r.roomType != RoomTypeTeam {
+		delete(r.tokens, userName)
+	}
+	r.record(RoomEvent{Type: EventUserRemoved, At: now, UserName: userName})
+	return nil
+}
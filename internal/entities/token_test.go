@@ -0,0 +1,97 @@
+package entities
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRoom_AddParticipant(t *testing.T) {
+	room := NewRoom("room1")
+	if err := room.SetType(RoomTypeTeam); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.AddParticipant("alice", "token-alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.AddParticipant("alice", "token-alice"); !errors.Is(err, UserAlreadyExistsError) {
+		t.Errorf("rejoin with the same token = %v, want UserAlreadyExistsError", err)
+	}
+	seq := room.Seq()
+	if err := room.AddParticipant("alice", "token-mallory"); !errors.Is(err, UserNameTakenError) {
+		t.Errorf("join with another token = %v, want UserNameTakenError", err)
+	}
+	if err := room.AddParticipant("bob", ""); !errors.Is(err, InvalidTokenError) {
+		t.Errorf("join without a token = %v, want InvalidTokenError", err)
+	}
+	if room.Seq() != seq || len(room.Estimates()) != 1 {
+		t.Errorf("rejected joins changed the room: seq %d -> %d, %d estimates", seq, room.Seq(), len(room.Estimates()))
+	}
+	if !room.Authenticate("alice", "token-alice") || room.Authenticate("alice", "token-mallory") || room.Authenticate("bob", "") {
+		t.Error("Authenticate does not match the bound token")
+	}
+
+	// 退出しても名前はトークンに結びついたまま
+	if err := room.RemoveUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.AddParticipant("alice", "token-mallory"); !errors.Is(err, UserNameTakenError) {
+		t.Errorf("join after leave with another token = %v, want UserNameTakenError", err)
+	}
+	// メンバーから外すと別の人が使える
+	if err := room.RemoveMember("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.AddParticipant("alice", "token-new"); err != nil {
+		t.Errorf("join after remove_member = %v", err)
+	}
+
+	restored, err := NewFromSerializedRoom(room.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored.Authenticate("alice", "token-new") {
+		t.Error("token is not restored from the serialized room")
+	}
+}
+
+func TestRoom_Leave(t *testing.T) {
+	room := NewRoom("room1")
+	if err := room.AddParticipant("alice", "token-alice"); err != nil {
+		t.Fatal(err)
+	}
+	// 切断による退出では名前を手放さない
+	if err := room.RemoveUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.AddParticipant("alice", "token-mallory"); !errors.Is(err, UserNameTakenError) {
+		t.Errorf("join after disconnect with another token = %v, want UserNameTakenError", err)
+	}
+	if err := room.AddParticipant("alice", "token-alice"); err != nil {
+		t.Fatal(err)
+	}
+	// 使い捨てのルームでは自分で退出すると別の人が使える
+	if err := room.Leave("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.Leave("alice"); !errors.Is(err, UserNotFoundError) {
+		t.Errorf("leave twice = %v, want UserNotFoundError", err)
+	}
+	if err := room.AddParticipant("alice", "token-new"); err != nil {
+		t.Errorf("join after leave = %v", err)
+	}
+
+	// チームルームではメンバーとして残るので手放さない
+	team := NewRoom("room2")
+	if err := team.SetType(RoomTypeTeam); err != nil {
+		t.Fatal(err)
+	}
+	if err := team.AddParticipant("alice", "token-alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := team.Leave("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := team.AddParticipant("alice", "token-mallory"); !errors.Is(err, UserNameTakenError) {
+		t.Errorf("join after leaving a team room with another token = %v, want UserNameTakenError", err)
+	}
+}
@@ -0,0 +1,133 @@
+package entities
+
+import (
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	FieldUserName  = "user_name"
+	FieldRoomID    = "room_id"
+	FieldRationale = "rationale"
+	FieldChatText  = "text"
+	FieldReaction  = "reaction"
+)
+
+const (
+	MaxUserNameLength  = 32
+	MaxRoomIDLength    = 64
+	MaxRationaleLength = 280
+	MaxChatTextLength  = 500
+)
+
+// ValidationError 入力値が不正
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+var UserNameConflictError = fmt.Errorf("user name is too similar to another participant")
+
+// 他の参加者やシステムと紛らわしい名前
+var reservedUserNames = map[string]struct{}{
+	"admin":       {},
+	"system":      {},
+	"server":      {},
+	"facilitator": {},
+	"moderator":   {},
+	"anonymous":   {},
+}
+
+// NormalizeUserName ユーザー名を正規化して検証する
+// 全角英数などは NFKC で揃え、前後の空白を除き、連続する空白は1つにまとめる
+func NormalizeUserName(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", &ValidationError{Field: FieldUserName, Reason: "not valid utf-8"}
+	}
+	name = norm.NFKC.String(name)
+	for _, r := range name {
+		// 制御文字やゼロ幅文字などの不可視文字で見た目を偽装できないようにする
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return "", &ValidationError{Field: FieldUserName, Reason: "contains invisible characters"}
+		}
+	}
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" {
+		return "", &ValidationError{Field: FieldUserName, Reason: "empty"}
+	}
+	if utf8.RuneCountInString(name) > MaxUserNameLength {
+		return "", &ValidationError{Field: FieldUserName, Reason: fmt.Sprintf("longer than %d characters", MaxUserNameLength)}
+	}
+	if _, ok := reservedUserNames[userNameKey(name)]; ok {
+		return "", &ValidationError{Field: FieldUserName, Reason: "reserved"}
+	}
+	return name, nil
+}
+
+// userNameKey 大文字小文字の違いだけの名前を同じ人とみなすためのキー
+func userNameKey(name string) string {
+	return strings.ToLower(norm.NFKC.String(name))
+}
+
+// NormalizeRoomID ルームIDを検証する
+// URLにそのまま載せられる英数字と - _ のみ許可する
+func NormalizeRoomID(roomID string) (string, error) {
+	roomID = strings.TrimSpace(roomID)
+	if roomID == "" {
+		return "", &ValidationError{Field: FieldRoomID, Reason: "empty"}
+	}
+	if len(roomID) > MaxRoomIDLength {
+		return "", &ValidationError{Field: FieldRoomID, Reason: fmt.Sprintf("longer than %d characters", MaxRoomIDLength)}
+	}
+	for _, r := range roomID {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return "", &ValidationError{Field: FieldRoomID, Reason: "only alphanumerics, '-' and '_' are allowed"}
+		}
+	}
+	return roomID, nil
+}
+
+// NormalizeRationale 見積もりに添える理由を検証する。空でもよい
+func NormalizeRationale(rationale string) (string, error) {
+	return normalizeText(FieldRationale, rationale, MaxRationaleLength)
+}
+
+// NormalizeChatText チャットの本文を検証する
+func NormalizeChatText(text string) (string, error) {
+	text, err := normalizeText(FieldChatText, text, MaxChatTextLength)
+	if err != nil {
+		return "", err
+	}
+	if text == "" {
+		return "", &ValidationError{Field: FieldChatText, Reason: "empty"}
+	}
+	return text, nil
+}
+
+// normalizeText 参加者が自由に入力する文章を検証する
+// 一覧に1行で表示するので改行などの空白は1つの空白にまとめる
+func normalizeText(field string, text string, maxLength int) (string, error) {
+	if !utf8.ValidString(text) {
+		return "", &ValidationError{Field: field, Reason: "not valid utf-8"}
+	}
+	text = strings.Join(strings.Fields(norm.NFC.String(text)), " ")
+	for _, r := range text {
+		// ゼロ幅接合子は絵文字の組み合わせに使われるので許可する
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) && r != zeroWidthJoiner {
+			return "", &ValidationError{Field: field, Reason: "contains invisible characters"}
+		}
+	}
+	if utf8.RuneCountInString(text) > maxLength {
+		return "", &ValidationError{Field: field, Reason: fmt.Sprintf("longer than %d characters", maxLength)}
+	}
+	return text, nil
+}
+
+const zeroWidthJoiner = '\u200d'
@@ -0,0 +1,85 @@
+package entities
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeUserName(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    string
+		invalid bool
+	}{
+		{in: "alice", want: "alice"},
+		{in: "  alice   bob  ", want: "alice bob"},
+		{in: "ａｌｉｃｅ", want: "alice"},
+		{in: "ｱﾘｽ", want: "アリス"},
+		{in: "ali\u200bce", invalid: true},
+		{in: "ali\u202ece", invalid: true},
+		{in: "alice\n", invalid: true},
+		{in: "\xff", invalid: true},
+		{in: "   ", invalid: true},
+		{in: "admin", invalid: true},
+		{in: "Ａｄｍｉｎ", invalid: true},
+		{in: "System", invalid: true},
+		{in: strings.Repeat("あ", MaxUserNameLength), want: strings.Repeat("あ", MaxUserNameLength)},
+		{in: strings.Repeat("あ", MaxUserNameLength+1), invalid: true},
+	} {
+		got, err := NormalizeUserName(tt.in)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("NormalizeUserName(%q) = %q, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("NormalizeUserName(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestNormalizeRoomID(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    string
+		invalid bool
+	}{
+		{in: "room-1_A", want: "room-1_A"},
+		{in: " room1 ", want: "room1"},
+		{in: "", invalid: true},
+		{in: "room 1", invalid: true},
+		{in: "room/1", invalid: true},
+		{in: "ｒｏｏｍ", invalid: true},
+		{in: "部屋", invalid: true},
+		{in: strings.Repeat("a", MaxRoomIDLength), want: strings.Repeat("a", MaxRoomIDLength)},
+		{in: strings.Repeat("a", MaxRoomIDLength+1), invalid: true},
+	} {
+		got, err := NormalizeRoomID(tt.in)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("NormalizeRoomID(%q) = %q, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("NormalizeRoomID(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestUserNameKey(t *testing.T) {
+	for _, tt := range []struct {
+		a, b     string
+		conflict bool
+	}{
+		{a: "Alice", b: "alice", conflict: true},
+		{a: "ALICE", b: "ａｌｉｃｅ", conflict: true},
+		{a: "alice", b: "alice2"},
+		{a: "アリス", b: "ｱﾘｽ", conflict: true},
+	} {
+		if got := userNameKey(tt.a) == userNameKey(tt.b); got != tt.conflict {
+			t.Errorf("userNameKey(%q) == userNameKey(%q) = %v, want %v", tt.a, tt.b, got, tt.conflict)
+		}
+	}
+}
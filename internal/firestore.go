@@ -3,8 +3,12 @@ package internal
 import (
 	"cloud.google.com/go/firestore"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/pistatium/planing_poker/internal/entities"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"log/slog"
 	"sync"
 	"time"
@@ -19,16 +23,37 @@ type FirestoreRoomRepository struct {
 	projectID      FirestoreProjectID
 	collectionName FirestoreCollectionName
 	databaseName   FirestoreDatabaseName
+	ttl            time.Duration
+
+	// 最初に使うときに作成し、Close まで使い回す
+	client   *firestore.Client
+	closed   bool
+	clientMu sync.Mutex
+
+	rooms map[string]*entities.Room
+	// savedAt 最後にFirestoreへ書き込んだときのルームの LastModifiedAt
+	savedAt map[string]time.Time
+	// saveLocks 同じルームの書き込みをシリアライズした順に反映させるためのロック
+	saveLocks map[string]*sync.Mutex
+	mu        sync.RWMutex
 }
 
-func NewFirestoreRoomRepository(projectID FirestoreProjectID, collectionName FirestoreCollectionName, databaseName FirestoreDatabaseName) *FirestoreRoomRepository {
-	return &FirestoreRoomRepository{projectID: projectID, collectionName: collectionName, databaseName: databaseName}
+// NewFirestoreRoomRepository ttl は Retention がデフォルトのルームの有効期限
+func NewFirestoreRoomRepository(projectID FirestoreProjectID, collectionName FirestoreCollectionName, databaseName FirestoreDatabaseName, ttl time.Duration) *FirestoreRoomRepository {
+	return &FirestoreRoomRepository{
+		projectID:      projectID,
+		collectionName: collectionName,
+		databaseName:   databaseName,
+		ttl:            ttl,
+		rooms:          map[string]*entities.Room{},
+		savedAt:        map[string]time.Time{},
+		saveLocks:      map[string]*sync.Mutex{},
+	}
 }
 
-var rooms = map[string]*entities.Room{}
 var _ RoomRepository = (*FirestoreRoomRepository)(nil)
 
-var mu = sync.RWMutex{}
+var RepositoryClosedError = fmt.Errorf("repository is closed")
 
 /*
 	とりあえず１インスタンスで動かす想定で実装
@@ -37,23 +62,35 @@ var mu = sync.RWMutex{}
 		なければFirestoreから取得してメモリにのせる(インスタンス生え替わっても引き継げる)
 	書き込み:
 		メモリとFirestore両方に書き込む
+	掃除:
+		しばらく保存されていないルームはメモリから外し、期限切れのルームはFirestoreからも削除する
+	イベント:
+		ルームのドキュメントの events と snapshots のサブコレクションに、ルームと同じトランザクションで書き込む
+		TTLポリシーではサブコレクションは消えないので、期限切れのルームを Sweep で削除するときに一緒に削除する
+	クライアント:
+		gRPCの接続と認証は重いので、1つのクライアントを使い回す
 */
 
+// RoomWithExpiresAt ExpiresAt にFirestoreのTTLポリシーを設定しておくと期限切れのドキュメントが削除される
 type RoomWithExpiresAt struct {
 	*entities.SerializedRoom
-	ExpiresAt time.Time `json:"expires_at"`
-}
-
-func (f2 FirestoreRoomRepository) Transaction(ctx context.Context, f func(ctx context.Context) (*entities.Room, error)) (*entities.Room, error) {
-	return f(ctx)
+	// 永続的なルームは nil (TTLポリシーの対象外)
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
-func (f2 FirestoreRoomRepository) Find(ctx context.Context, roomID string) (*entities.Room, error) {
-	mu.RLock()
-	defer mu.RUnlock()
-	if room, ok := rooms[roomID]; ok {
-		return room, nil
+// firestoreClient 初回呼び出し時にクライアントを作る
+// 作成に失敗した場合は次の呼び出しで再試行する
+func (f2 *FirestoreRoomRepository) firestoreClient(ctx context.Context) (*firestore.Client, error) {
+	f2.clientMu.Lock()
+	defer f2.clientMu.Unlock()
+	if f2.closed {
+		return nil, RepositoryClosedError
+	}
+	if f2.client != nil {
+		return f2.client, nil
 	}
+	// リクエストのコンテキストがキャンセルされてもクライアントは使い続けるので切り離す
+	ctx = context.WithoutCancel(ctx)
 	var client *firestore.Client
 	var err error
 	if f2.databaseName == "" {
@@ -64,14 +101,33 @@ func (f2 FirestoreRoomRepository) Find(ctx context.Context, roomID string) (*ent
 	if err != nil {
 		return nil, fmt.Errorf("fail to init firestore: %v", err)
 	}
-	defer client.Close()
+	f2.client = client
+	return client, nil
+}
+
+func (f2 *FirestoreRoomRepository) Transaction(ctx context.Context, f func(ctx context.Context) (*entities.Room, error)) (*entities.Room, error) {
+	return f(ctx)
+}
+
+func (f2 *FirestoreRoomRepository) Find(ctx context.Context, roomID string) (_ *entities.Room, err error) {
+	defer observeRepository("find", time.Now(), &err)
+	ctx, span := startChildSpan(ctx, "FirestoreRoomRepository.Find", attribute.String("room.id", roomID))
+	defer endSpan(span, &err)
+	f2.mu.RLock()
+	room, ok := f2.rooms[roomID]
+	f2.mu.RUnlock()
+	if ok {
+		return room, nil
+	}
+	client, err := f2.firestoreClient(ctx)
+	if err != nil {
+		return nil, err
+	}
 	doc, err := client.Collection(string(f2.collectionName)).Doc(roomID).Get(ctx)
 	if err != nil {
 		if doc != nil && !doc.Exists() {
-			// ローカルに新規作成
-			newRoom := entities.NewRoom(roomID)
-			rooms[roomID] = newRoom
-			return newRoom, nil
+			// 作成するかどうかは呼び出し側で判断する
+			return nil, nil
 		} else {
 			return nil, fmt.Errorf("fail to get room: %v", err)
 		}
@@ -80,41 +136,269 @@ func (f2 FirestoreRoomRepository) Find(ctx context.Context, roomID string) (*ent
 	if err := doc.DataTo(&serialized); err != nil {
 		return nil, fmt.Errorf("fail to deserialize room: %v", err)
 	}
-	room, err := entities.NewFromSerializedRoom(serialized)
+	room, err = entities.NewFromSerializedRoom(serialized)
 	if err != nil {
 		return nil, fmt.Errorf("fail to deserialize room: %v", err)
 	}
-	rooms[roomID] = room
+	f2.mu.Lock()
+	defer f2.mu.Unlock()
+	// 読み込んでいる間に他の接続がのせていればそちらを使う
+	if cached, ok := f2.rooms[roomID]; ok {
+		return cached, nil
+	}
+	f2.rooms[roomID] = room
+	f2.savedAt[roomID] = serialized.LastModifiedAt
 	return room, nil
 }
 
-func (f2 FirestoreRoomRepository) Save(ctx context.Context, room *entities.Room) error {
-	mu.Lock()
-	defer mu.Unlock()
-	var client *firestore.Client
-	var err error
-	if f2.databaseName == "" {
-		client, err = firestore.NewClient(ctx, string(f2.projectID))
-	} else {
-		client, err = firestore.NewClientWithDatabase(ctx, string(f2.projectID), string(f2.databaseName))
-	}
+func (f2 *FirestoreRoomRepository) Save(ctx context.Context, room *entities.Room) (err error) {
+	defer observeRepository("save", time.Now(), &err)
+	ctx, span := startChildSpan(ctx, "FirestoreRoomRepository.Save", attribute.String("room.id", room.ID()))
+	defer endSpan(span, &err)
+	client, err := f2.firestoreClient(ctx)
 	if err != nil {
-		return fmt.Errorf("fail to init firestore: %v", err)
+		return err
 	}
-	defer client.Close()
+	// 同時に Save されたとき、古い状態が後から書き込まれて新しい状態を上書きしないようにする
+	saveLock := f2.saveLock(room.ID())
+	saveLock.Lock()
+	defer saveLock.Unlock()
 	serialized := room.Serialize()
 	serializedWithExpiresAt := RoomWithExpiresAt{
 		SerializedRoom: &serialized,
-		ExpiresAt:      time.Now().Add(24 * time.Hour),
+		ExpiresAt:      room.ExpiresAt(time.Now(), f2.ttl),
 	}
-	_, err = client.Collection(string(f2.collectionName)).Doc(room.ID()).Set(ctx, serializedWithExpiresAt)
+	events, snapshots := room.PendingChanges()
+	doc := client.Collection(string(f2.collectionName)).Doc(room.ID())
+	// 書き込み中も他のルームの読み書きを止めないようにロックの外で書き込む
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if err := tx.Set(doc, serializedWithExpiresAt); err != nil {
+			return err
+		}
+		for _, event := range events {
+			if err := tx.Set(doc.Collection(firestoreEventsCollection).Doc(firestoreSeqID(event.Seq)), event); err != nil {
+				return err
+			}
+		}
+		for _, snapshot := range snapshots {
+			if err := tx.Set(doc.Collection(firestoreSnapshotsCollection).Doc(firestoreSeqID(snapshot.Seq)), snapshot); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return fmt.Errorf("fail to save room: %v", err)
 	}
-	rooms[room.ID()] = room
+	room.ChangesSaved(lastSeq(events, snapshots))
+	f2.mu.Lock()
+	defer f2.mu.Unlock()
+	f2.rooms[room.ID()] = room
+	f2.savedAt[room.ID()] = serialized.LastModifiedAt
 	slog.Info("room saved",
 		slog.String("room_id", room.ID()),
 		slog.Any("last_modified", room.LastModifiedAt()),
 	)
 	return nil
 }
+
+const (
+	firestoreEventsCollection    = "events"
+	firestoreSnapshotsCollection = "snapshots"
+)
+
+// firestoreSeqID ドキュメントIDの順が Seq の順になるようにゼロ埋めする
+func firestoreSeqID(seq int64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+func (f2 *FirestoreRoomRepository) Events(ctx context.Context, roomID string, afterSeq int64, limit int) (_ []entities.RoomEvent, err error) {
+	defer observeRepository("events", time.Now(), &err)
+	ctx, span := startChildSpan(ctx, "FirestoreRoomRepository.Events", attribute.String("room.id", roomID))
+	defer endSpan(span, &err)
+	client, err := f2.firestoreClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := client.Collection(string(f2.collectionName)).Doc(roomID).Collection(firestoreEventsCollection).
+		Where("Seq", ">", afterSeq).OrderBy("Seq", firestore.Asc).Limit(limit).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("fail to get events: %v", err)
+	}
+	events := make([]entities.RoomEvent, 0, len(docs))
+	for _, doc := range docs {
+		var event entities.RoomEvent
+		if err := doc.DataTo(&event); err != nil {
+			return nil, fmt.Errorf("fail to decode event: %v", err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (f2 *FirestoreRoomRepository) FindSnapshot(ctx context.Context, roomID string, seq int64) (_ *entities.RoomSnapshot, err error) {
+	defer observeRepository("find_snapshot", time.Now(), &err)
+	ctx, span := startChildSpan(ctx, "FirestoreRoomRepository.FindSnapshot", attribute.String("room.id", roomID))
+	defer endSpan(span, &err)
+	client, err := f2.firestoreClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := client.Collection(string(f2.collectionName)).Doc(roomID).Collection(firestoreSnapshotsCollection).
+		Where("Seq", "<=", seq).OrderBy("Seq", firestore.Desc).Limit(1).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("fail to get snapshot: %v", err)
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	var snapshot entities.RoomSnapshot
+	if err := docs[0].DataTo(&snapshot); err != nil {
+		return nil, fmt.Errorf("fail to decode snapshot: %v", err)
+	}
+	return &snapshot, nil
+}
+
+// deleteLogs ルームのイベントとスナップショットを削除する
+func (f2 *FirestoreRoomRepository) deleteLogs(ctx context.Context, doc *firestore.DocumentRef) error {
+	for _, name := range []string{firestoreEventsCollection, firestoreSnapshotsCollection} {
+		refs, err := doc.Collection(name).DocumentRefs(ctx).GetAll()
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			if _, err := ref.Delete(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f2 *FirestoreRoomRepository) saveLock(roomID string) *sync.Mutex {
+	f2.mu.Lock()
+	defer f2.mu.Unlock()
+	lock, ok := f2.saveLocks[roomID]
+	if !ok {
+		lock = &sync.Mutex{}
+		f2.saveLocks[roomID] = lock
+	}
+	return lock
+}
+
+func (f2 *FirestoreRoomRepository) Ping(ctx context.Context) (err error) {
+	defer observeRepository("ping", time.Now(), &err)
+	ctx, span := startChildSpan(ctx, "FirestoreRoomRepository.Ping")
+	defer endSpan(span, &err)
+	client, err := f2.firestoreClient(ctx)
+	if err != nil {
+		return err
+	}
+	// 存在しないドキュメントでも NotFound が返れば疎通はできている
+	doc, err := client.Collection(string(f2.collectionName)).Doc("_ping").Get(ctx)
+	if err != nil && !(doc != nil && !doc.Exists()) {
+		return fmt.Errorf("fail to ping firestore: %v", err)
+	}
+	return nil
+}
+
+// Flush メモリ上で変更されたままFirestoreに書き込めていないルームを保存する
+func (f2 *FirestoreRoomRepository) Flush(ctx context.Context) (err error) {
+	ctx, span := startChildSpan(ctx, "FirestoreRoomRepository.Flush")
+	defer endSpan(span, &err)
+	f2.mu.RLock()
+	var dirty []*entities.Room
+	for id, room := range f2.rooms {
+		if room.LastModifiedAt().After(f2.savedAt[id]) {
+			dirty = append(dirty, room)
+		}
+	}
+	f2.mu.RUnlock()
+	var errs []error
+	for _, room := range dirty {
+		if err := f2.Save(ctx, room); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	slog.Info("rooms flushed", slog.Int("count", len(dirty)), slog.Int("errors", len(errs)))
+	return errors.Join(errs...)
+}
+
+// Sweep 期限切れのルームを削除し、ttl の間保存されていないルームをメモリから外す
+// TTLポリシーによる削除は遅れることがあるので、期限切れのものはここでも削除する
+func (f2 *FirestoreRoomRepository) Sweep(ctx context.Context, now time.Time) (_ SweepResult, err error) {
+	defer observeRepository("sweep", time.Now(), &err)
+	ctx, span := startChildSpan(ctx, "FirestoreRoomRepository.Sweep")
+	defer endSpan(span, &err)
+	var result SweepResult
+	client, err := f2.firestoreClient(ctx)
+	if err != nil {
+		return result, err
+	}
+	docs, err := client.Collection(string(f2.collectionName)).Where("ExpiresAt", "<=", now).Documents(ctx).GetAll()
+	if err != nil {
+		return result, fmt.Errorf("fail to query expired rooms: %v", err)
+	}
+	var errs []error
+	for _, doc := range docs {
+		// 問い合わせた後に保存し直されたルームは消さない
+		_, err := doc.Ref.Delete(ctx, firestore.LastUpdateTime(doc.UpdateTime))
+		if status.Code(err) == codes.FailedPrecondition {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("fail to delete room %s: %v", doc.Ref.ID, err))
+			continue
+		}
+		if err := f2.deleteLogs(ctx, doc.Ref); err != nil {
+			errs = append(errs, fmt.Errorf("fail to delete events of room %s: %v", doc.Ref.ID, err))
+		}
+		f2.evict(doc.Ref.ID)
+		result.Deleted++
+	}
+
+	f2.mu.Lock()
+	for id, room := range f2.rooms {
+		savedAt := f2.savedAt[id]
+		// 書き込めていない変更があるものは Flush まで残す
+		if room.LastModifiedAt().After(savedAt) || now.Sub(savedAt) < f2.ttl {
+			continue
+		}
+		delete(f2.rooms, id)
+		delete(f2.savedAt, id)
+		delete(f2.saveLocks, id)
+		result.Evicted++
+	}
+	f2.mu.Unlock()
+	return result, errors.Join(errs...)
+}
+
+// evict メモリ上のルームを捨てる
+func (f2 *FirestoreRoomRepository) evict(roomID string) {
+	f2.mu.Lock()
+	defer f2.mu.Unlock()
+	delete(f2.rooms, roomID)
+	delete(f2.savedAt, roomID)
+	delete(f2.saveLocks, roomID)
+}
+
+// Close クライアントを閉じる。以降の呼び出しは RepositoryClosedError を返す
+func (f2 *FirestoreRoomRepository) Close() error {
+	f2.clientMu.Lock()
+	defer f2.clientMu.Unlock()
+	f2.closed = true
+	if f2.client == nil {
+		return nil
+	}
+	err := f2.client.Close()
+	f2.client = nil
+	return err
+}
+
+// clearCache メモリ上のルームを捨てる。インスタンスの入れ替わりを再現するためのテスト用
+func (f2 *FirestoreRoomRepository) clearCache() {
+	f2.mu.Lock()
+	defer f2.mu.Unlock()
+	f2.rooms = map[string]*entities.Room{}
+	f2.savedAt = map[string]time.Time{}
+}
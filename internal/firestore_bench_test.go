@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"github.com/pistatium/planing_poker/internal/entities"
+	"os"
+	"testing"
+)
+
+// FIRESTORE_EMULATOR_HOST が設定されているときだけエミュレータに対して実行する
+//
+//	gcloud emulators firestore start --host-port=localhost:8081
+//	FIRESTORE_EMULATOR_HOST=localhost:8081 go test -run '^$' -bench Firestore ./internal/
+func newEmulatorRepository(tb testing.TB) *FirestoreRoomRepository {
+	tb.Helper()
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		tb.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+	collection := FirestoreCollectionName(fmt.Sprintf("test_rooms_%s", tb.Name()))
+	repo := NewFirestoreRoomRepository("planning-poker-test", collection, "", DefaultRoomTTL)
+	tb.Cleanup(func() {
+		if err := repo.Close(); err != nil {
+			tb.Errorf("close: %v", err)
+		}
+	})
+	return repo
+}
+
+func newBenchmarkRoom(b *testing.B, roomID string) *entities.Room {
+	b.Helper()
+	room := entities.NewRoom(roomID)
+	for i := 0; i < 8; i++ {
+		if err := room.AddUser(fmt.Sprintf("user%d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return room
+}
+
+func BenchmarkFirestoreRoomRepository_Save(b *testing.B) {
+	repo := newEmulatorRepository(b)
+	ctx := context.Background()
+	room := newBenchmarkRoom(b, "bench-save")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := repo.Save(ctx, room); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFirestoreRoomRepository_FindUncached(b *testing.B) {
+	repo := newEmulatorRepository(b)
+	ctx := context.Background()
+	if err := repo.Save(ctx, newBenchmarkRoom(b, "bench-find")); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// 毎回Firestoreから読むようにキャッシュを捨てる
+		repo.clearCache()
+		if _, err := repo.Find(ctx, "bench-find"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFirestoreRoomRepository_SaveWithNewClient 以前の実装と同じく毎回クライアントを作る場合との比較用
+func BenchmarkFirestoreRoomRepository_SaveWithNewClient(b *testing.B) {
+	repo := newEmulatorRepository(b)
+	ctx := context.Background()
+	room := newBenchmarkRoom(b, "bench-save-new-client")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client, err := firestore.NewClient(ctx, string(repo.projectID))
+		if err != nil {
+			b.Fatal(err)
+		}
+		serialized := room.Serialize()
+		_, err = client.Collection(string(repo.collectionName)).Doc(room.ID()).Set(ctx, RoomWithExpiresAt{SerializedRoom: &serialized})
+		if err != nil {
+			b.Fatal(err)
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,329 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pistatium/planing_poker/internal/entities"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Firestoreエミュレータに対する結合テスト
+// FIRESTORE_EMULATOR_HOST が設定されていない場合はスキップする
+
+func uniqueRoomID(t *testing.T) string {
+	t.Helper()
+	return fmt.Sprintf("room-%d", time.Now().UnixNano())
+}
+
+// Firestoreはマイクロ秒精度で保存するので丸めて比較する
+func sameTime(a, b time.Time) bool {
+	return a.Truncate(time.Microsecond).Equal(b.Truncate(time.Microsecond))
+}
+
+func assertSameRoom(t *testing.T, want, got entities.SerializedRoom) {
+	t.Helper()
+	if got.ID != want.ID {
+		t.Errorf("ID = %q, want %q", got.ID, want.ID)
+	}
+	if got.State != want.State {
+		t.Errorf("State = %q, want %q", got.State, want.State)
+	}
+	if !sameTime(got.LastModifiedAt, want.LastModifiedAt) {
+		t.Errorf("LastModifiedAt = %v, want %v", got.LastModifiedAt, want.LastModifiedAt)
+	}
+	if (got.LastRevealedAt == nil) != (want.LastRevealedAt == nil) ||
+		got.LastRevealedAt != nil && !sameTime(*got.LastRevealedAt, *want.LastRevealedAt) {
+		t.Errorf("LastRevealedAt = %v, want %v", got.LastRevealedAt, want.LastRevealedAt)
+	}
+	if got.PasscodeHash != want.PasscodeHash {
+		t.Errorf("PasscodeHash = %q, want %q", got.PasscodeHash, want.PasscodeHash)
+	}
+	if fmt.Sprint(got.Deck) != fmt.Sprint(want.Deck) {
+		t.Errorf("Deck = %v, want %v", got.Deck, want.Deck)
+	}
+	if got.Anonymous != want.Anonymous {
+		t.Errorf("Anonymous = %v, want %v", got.Anonymous, want.Anonymous)
+	}
+	if fmt.Sprint(got.Roles) != fmt.Sprint(want.Roles) {
+		t.Errorf("Roles = %v, want %v", got.Roles, want.Roles)
+	}
+	if len(got.Estimates) != len(want.Estimates) {
+		t.Fatalf("len(Estimates) = %d, want %d", len(got.Estimates), len(want.Estimates))
+	}
+	for i := range want.Estimates {
+		if got.Estimates[i].User.Name != want.Estimates[i].User.Name || got.Estimates[i].Point != want.Estimates[i].Point || got.Estimates[i].Rationale != want.Estimates[i].Rationale || got.Estimates[i].Changes != want.Estimates[i].Changes {
+			t.Errorf("Estimates[%d] = %+v, want %+v", i, got.Estimates[i], want.Estimates[i])
+		}
+		if !sameTime(got.Estimates[i].User.LastUsedAt, want.Estimates[i].User.LastUsedAt) {
+			t.Errorf("Estimates[%d].User.LastUsedAt = %v, want %v", i, got.Estimates[i].User.LastUsedAt, want.Estimates[i].User.LastUsedAt)
+		}
+	}
+}
+
+func TestFirestoreRoomRepository_RoundTrip(t *testing.T) {
+	repo := newEmulatorRepository(t)
+	ctx := context.Background()
+
+	room := entities.NewRoom(uniqueRoomID(t))
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if err := room.AddUser(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := room.SetDeck([]string{"1", "2", "3", "5", "?", "∞"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.SetRole("alice", entities.RoleFacilitator); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.SetPasscode("secret"); err != nil {
+		t.Fatal(err)
+	}
+	for name, label := range map[string]string{"alice": "3", "bob": "?"} {
+		point, err := entities.NewPoint(label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := room.SetEstimate(name, point, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := room.RevealEstimates(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.Save(ctx, room); err != nil {
+		t.Fatal(err)
+	}
+	repo.clearCache()
+	got, err := repo.Find(ctx, room.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil {
+		t.Fatal("room not found after save")
+	}
+	assertSameRoom(t, room.Serialize(), got.Serialize())
+	if err := got.VerifyPasscode("secret"); err != nil {
+		t.Errorf("VerifyPasscode: %v", err)
+	}
+}
+
+func TestFirestoreRoomRepository_FindMissing(t *testing.T) {
+	repo := newEmulatorRepository(t)
+	room, err := repo.Find(context.Background(), uniqueRoomID(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room != nil {
+		t.Errorf("Find = %+v, want nil", room.Serialize())
+	}
+}
+
+func TestFirestoreRoomRepository_ExpiresAt(t *testing.T) {
+	repo := newEmulatorRepository(t)
+	ctx := context.Background()
+	room := entities.NewRoom(uniqueRoomID(t))
+
+	before := time.Now()
+	if err := repo.Save(ctx, room); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+
+	client, err := repo.firestoreClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := client.Collection(string(repo.collectionName)).Doc(room.ID()).Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := RoomWithExpiresAt{SerializedRoom: &entities.SerializedRoom{}}
+	if err := doc.DataTo(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.ID != room.ID() {
+		t.Errorf("ID = %q, want %q", stored.ID, room.ID())
+	}
+	min := before.Add(DefaultRoomTTL).Truncate(time.Microsecond)
+	max := after.Add(DefaultRoomTTL)
+	if stored.ExpiresAt == nil || stored.ExpiresAt.Before(min) || stored.ExpiresAt.After(max) {
+		t.Errorf("ExpiresAt = %v, want between %v and %v", stored.ExpiresAt, min, max)
+	}
+
+	// 永続的なルームには有効期限を付けない
+	if err := room.SetRetention(entities.RetentionPermanent); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Save(ctx, room); err != nil {
+		t.Fatal(err)
+	}
+	doc, err = client.Collection(string(repo.collectionName)).Doc(room.ID()).Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored = RoomWithExpiresAt{SerializedRoom: &entities.SerializedRoom{}}
+	if err := doc.DataTo(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.ExpiresAt != nil {
+		t.Errorf("ExpiresAt = %v, want nil for a permanent room", stored.ExpiresAt)
+	}
+	if stored.Retention != entities.RetentionPermanent {
+		t.Errorf("Retention = %v, want %v", stored.Retention, entities.RetentionPermanent)
+	}
+}
+
+func TestFirestoreRoomRepository_Sweep(t *testing.T) {
+	repo := newEmulatorRepository(t)
+	ctx := context.Background()
+	expiring := entities.NewRoom(uniqueRoomID(t))
+	permanent := entities.NewRoom(uniqueRoomID(t) + "-permanent")
+	if err := permanent.SetRetention(entities.RetentionPermanent); err != nil {
+		t.Fatal(err)
+	}
+	for _, room := range []*entities.Room{expiring, permanent} {
+		if err := repo.Save(ctx, room); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := repo.Sweep(ctx, time.Now().Add(DefaultRoomTTL+time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Deleted < 1 {
+		t.Errorf("Deleted = %d, want at least 1", result.Deleted)
+	}
+	// 永続的なルームもしばらく使われていなければメモリからは外す
+	if result.Evicted < 1 {
+		t.Errorf("Evicted = %d, want at least 1", result.Evicted)
+	}
+	for room, want := range map[*entities.Room]bool{expiring: false, permanent: true} {
+		got, err := repo.Find(ctx, room.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got != nil) != want {
+			t.Errorf("Find(%s) found = %v, want %v", room.ID(), got != nil, want)
+		}
+	}
+}
+
+func TestFirestoreRoomRepository_Close(t *testing.T) {
+	repo := newEmulatorRepository(t)
+	if err := repo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Find(context.Background(), uniqueRoomID(t)); !errors.Is(err, RepositoryClosedError) {
+		t.Errorf("Find after Close = %v, want %v", err, RepositoryClosedError)
+	}
+}
+
+func TestEventManager_ConcurrentSetEstimate(t *testing.T) {
+	repo := newEmulatorRepository(t)
+	manager := NewEventManager(repo, EventManagerConfig{AllowImplicitRoomCreation: true})
+	ctx := context.Background()
+	roomID := uniqueRoomID(t)
+
+	const users = 10
+	for i := 0; i < users; i++ {
+		if _, err := manager.Join(ctx, roomID, fmt.Sprintf("user%d", i), "", fmt.Sprintf("token%d", i), "127.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, users)
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			point, err := entities.NewPoint(fmt.Sprint(i + 1))
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := manager.SetEstimate(ctx, roomID, fmt.Sprintf("user%d", i), point, ""); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// 最後に書き込まれた状態に全員分の見積もりが入っていること
+	repo.clearCache()
+	room, err := manager.Get(ctx, roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := map[string]string{}
+	for _, est := range room.Estimates() {
+		points[est.User.Name] = est.Point.Label()
+	}
+	for i := 0; i < users; i++ {
+		name := fmt.Sprintf("user%d", i)
+		if points[name] != fmt.Sprint(i+1) {
+			t.Errorf("point of %s = %q, want %q", name, points[name], fmt.Sprint(i+1))
+		}
+	}
+}
+
+func TestEventManager_RecoverAfterCacheCleared(t *testing.T) {
+	repo := newEmulatorRepository(t)
+	manager := NewEventManager(repo, EventManagerConfig{AllowImplicitRoomCreation: true})
+	ctx := context.Background()
+	roomID := uniqueRoomID(t)
+
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := manager.Join(ctx, roomID, name, "", "token-"+name, "127.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	point, err := entities.NewPoint("8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.SetEstimate(ctx, roomID, "alice", point, ""); err != nil {
+		t.Fatal(err)
+	}
+	revealed, err := manager.RevealEstimates(ctx, roomID, Actor{UserName: "bob", Token: "token-bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := revealed.Serialize()
+
+	// インスタンスが入れ替わった想定
+	repo.clearCache()
+	room, err := manager.Get(ctx, roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameRoom(t, want, room.Serialize())
+
+	// 復元したルームでそのまま続けられること
+	if _, err := manager.Reset(ctx, roomID, Actor{UserName: "alice", Token: "token-alice"}); err != nil {
+		t.Fatal(err)
+	}
+	repo.clearCache()
+	room, err = manager.Get(ctx, roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, est := range room.Estimates() {
+		if est.Point.Label() != "" {
+			t.Errorf("point of %s = %q after reset, want empty", est.User.Name, est.Point.Label())
+		}
+	}
+}
+
+func TestFirestoreRoomRepository_Replay(t *testing.T) {
+	assertReplayMatchesRoom(t, newEmulatorRepository(t))
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"fmt"
+	"golang.org/x/time/rate"
+	"sync"
+	"time"
+)
+
+var TooManyAttemptsError = fmt.Errorf("too many attempts, try again later")
+
+// AttemptLimiter キーごとの失敗回数を数え、一定回数を超えたらしばらくロックする
+type AttemptLimiter struct {
+	maxFailures int
+	window      time.Duration
+	lockout     time.Duration
+	attempts    map[string]*attempt
+	mu          sync.Mutex
+}
+
+type attempt struct {
+	failures    int
+	firstFailed time.Time
+	lockedUntil time.Time
+}
+
+func NewAttemptLimiter(maxFailures int, window time.Duration, lockout time.Duration) *AttemptLimiter {
+	return &AttemptLimiter{
+		maxFailures: maxFailures,
+		window:      window,
+		lockout:     lockout,
+		attempts:    map[string]*attempt{},
+	}
+}
+
+// Allow ロック中であれば TooManyAttemptsError を返す
+func (l *AttemptLimiter) Allow(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a, ok := l.attempts[key]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if now.Before(a.lockedUntil) {
+		return TooManyAttemptsError
+	}
+	if now.Sub(a.firstFailed) > l.window {
+		delete(l.attempts, key)
+	}
+	return nil
+}
+
+// Fail 失敗を記録する
+func (l *AttemptLimiter) Fail(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.evict(now)
+	a, ok := l.attempts[key]
+	if !ok || now.Sub(a.firstFailed) > l.window {
+		a = &attempt{firstFailed: now}
+		l.attempts[key] = a
+	}
+	a.failures++
+	if a.failures >= l.maxFailures {
+		a.lockedUntil = now.Add(l.lockout)
+	}
+}
+
+// Succeed 成功したら失敗回数をリセット
+func (l *AttemptLimiter) Succeed(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.attempts, key)
+}
+
+// evict 期限切れのエントリを掃除してmapが増え続けないようにする
+func (l *AttemptLimiter) evict(now time.Time) {
+	for key, a := range l.attempts {
+		if now.Sub(a.firstFailed) > l.window && now.After(a.lockedUntil) {
+			delete(l.attempts, key)
+		}
+	}
+}
+
+var RateLimitedError = fmt.Errorf("rate limit exceeded")
+
+// KeyedRateLimiter キー(接続元IPなど)ごとのトークンバケット
+type KeyedRateLimiter struct {
+	limit    rate.Limit
+	burst    int
+	limiters map[string]*keyedLimiter
+	lastGC   time.Time
+	mu       sync.Mutex
+}
+
+type keyedLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewKeyedRateLimiter perSecond が0以下の場合は制限しない
+func NewKeyedRateLimiter(perSecond float64, burst int) *KeyedRateLimiter {
+	limit := rate.Limit(perSecond)
+	if perSecond <= 0 {
+		limit = rate.Inf
+	}
+	return &KeyedRateLimiter{
+		limit:    limit,
+		burst:    burst,
+		limiters: map[string]*keyedLimiter{},
+		lastGC:   time.Now(),
+	}
+}
+
+func (l *KeyedRateLimiter) Allow(key string) bool {
+	if l.limit == rate.Inf {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	// しばらく使われていないキーを捨ててmapが増え続けないようにする
+	if now.Sub(l.lastGC) > time.Minute {
+		for k, v := range l.limiters {
+			if now.Sub(v.lastSeen) > time.Minute {
+				delete(l.limiters, k)
+			}
+		}
+		l.lastGC = now
+	}
+	kl, ok := l.limiters[key]
+	if !ok {
+		kl = &keyedLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = kl
+	}
+	kl.lastSeen = now
+	return kl.limiter.AllowN(now, 1)
+}
+
+// NewRateLimiter 1接続分のトークンバケット。perSecond が0以下の場合は制限しない
+func NewRateLimiter(perSecond float64, burst int) *rate.Limiter {
+	if perSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, burst)
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), burst)
+}
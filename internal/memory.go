@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"context"
+	"github.com/pistatium/planing_poker/internal/entities"
+	"sync"
+	"time"
+)
+
+// MemoryRoomRepository プロセス内のメモリだけに保存するリポジトリ
+// 再起動すると消えるので、テストやローカルでの動作確認に使う
+type MemoryRoomRepository struct {
+	ttl   time.Duration
+	rooms map[string]*entities.Room
+	// 永続的なルームは nil
+	expiresAt map[string]*time.Time
+	// ルームごとのイベントとスナップショット。どちらも Seq の順
+	events    map[string][]entities.RoomEvent
+	snapshots map[string][]entities.RoomSnapshot
+	// Transaction 中の Find から Save までを他の更新と混ざらないようにする
+	txMu sync.Mutex
+	mu   sync.RWMutex
+}
+
+var _ RoomRepository = (*MemoryRoomRepository)(nil)
+
+func NewMemoryRoomRepository(ttl time.Duration) *MemoryRoomRepository {
+	return &MemoryRoomRepository{
+		ttl:       ttl,
+		rooms:     map[string]*entities.Room{},
+		expiresAt: map[string]*time.Time{},
+		events:    map[string][]entities.RoomEvent{},
+		snapshots: map[string][]entities.RoomSnapshot{},
+	}
+}
+
+func (m *MemoryRoomRepository) Transaction(ctx context.Context, f func(ctx context.Context) (*entities.Room, error)) (*entities.Room, error) {
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+	return f(ctx)
+}
+
+func (m *MemoryRoomRepository) Find(ctx context.Context, roomID string) (*entities.Room, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	room, ok := m.rooms[roomID]
+	if !ok {
+		return nil, nil
+	}
+	// 掃除される前でも期限切れのルームは存在しないものとして扱う
+	if expiresAt := m.expiresAt[roomID]; expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	return room, nil
+}
+
+func (m *MemoryRoomRepository) Save(ctx context.Context, room *entities.Room) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rooms[room.ID()] = room
+	m.expiresAt[room.ID()] = room.ExpiresAt(time.Now(), m.ttl)
+	events, snapshots := room.PendingChanges()
+	m.events[room.ID()] = append(m.events[room.ID()], events...)
+	for _, snapshot := range snapshots {
+		// イベントを記録する前のルームの起点は読み込むたびに作られる
+		if n := len(m.snapshots[room.ID()]); n > 0 && m.snapshots[room.ID()][n-1].Seq >= snapshot.Seq {
+			continue
+		}
+		m.snapshots[room.ID()] = append(m.snapshots[room.ID()], snapshot)
+	}
+	room.ChangesSaved(lastSeq(events, snapshots))
+	return nil
+}
+
+func (m *MemoryRoomRepository) Events(ctx context.Context, roomID string, afterSeq int64, limit int) ([]entities.RoomEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var events []entities.RoomEvent
+	for _, event := range m.events[roomID] {
+		if len(events) >= limit {
+			break
+		}
+		if event.Seq > afterSeq {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (m *MemoryRoomRepository) FindSnapshot(ctx context.Context, roomID string, seq int64) (*entities.RoomSnapshot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var found *entities.RoomSnapshot
+	for _, snapshot := range m.snapshots[roomID] {
+		if snapshot.Seq > seq {
+			break
+		}
+		snapshot := snapshot
+		found = &snapshot
+	}
+	return found, nil
+}
+
+func (m *MemoryRoomRepository) Sweep(ctx context.Context, now time.Time) (SweepResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var result SweepResult
+	for id, expiresAt := range m.expiresAt {
+		if expiresAt != nil && !expiresAt.After(now) {
+			delete(m.rooms, id)
+			delete(m.expiresAt, id)
+			delete(m.events, id)
+			delete(m.snapshots, id)
+			result.Deleted++
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryRoomRepository) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryRoomRepository) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryRoomRepository) Close() error {
+	return nil
+}
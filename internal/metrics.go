@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
+)
+
+// /metrics で公開するメトリクス
+var (
+	ActiveConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "planning_poker_ws_connections",
+		Help: "Number of open WebSocket connections.",
+	})
+	activeRooms = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "planning_poker_active_rooms",
+		Help: "Number of rooms watched by at least one WebSocket connection.",
+	})
+	MessagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "planning_poker_ws_messages_total",
+		Help: "Number of WebSocket messages received by type.",
+	}, []string{"type"})
+	Errors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "planning_poker_errors_total",
+		Help: "Number of errors sent to clients by code.",
+	}, []string{"code"})
+	// DroppedMessages 送信せずに捨てたメッセージ。coalesced は新しい participants に置き換えたもの
+	DroppedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "planning_poker_ws_dropped_messages_total",
+		Help: "Number of outbound WebSocket messages dropped by reason.",
+	}, []string{"reason"})
+	SlowConsumers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "planning_poker_ws_slow_consumers_total",
+		Help: "Number of WebSocket connections closed because their send queue was full.",
+	})
+	BroadcastFanout = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "planning_poker_broadcast_fanout_size",
+		Help:    "Number of connections each room change was sent to.",
+		Buckets: []float64{1, 2, 4, 8, 16, 32, 64},
+	}, []string{"type"})
+	roomsSwept = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "planning_poker_rooms_swept_total",
+		Help: "Number of rooms removed by the sweeper; evicted from the in-process cache or deleted from storage after expiry.",
+	}, []string{"action"})
+	repositoryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "planning_poker_repository_duration_seconds",
+		Help:    "Latency of room repository calls.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "result"})
+)
+
+// observeRepository リポジトリ呼び出しの時間を記録する。defer で使う
+func observeRepository(operation string, start time.Time, err *error) {
+	result := "ok"
+	if *err != nil {
+		result = "error"
+	}
+	repositoryDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,386 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pistatium/planing_poker/internal/entities"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedisKeyPrefix 同じRedisを他の用途と共有する場合にキーが衝突しないようにする
+type RedisKeyPrefix string
+
+// RedisRoomRepository Redis(互換)サーバーに保存するリポジトリ
+// 複数インスタンスで動かす場合に、ルームの状態と変更通知を共有する
+type RedisRoomRepository struct {
+	client    *redis.Client
+	keyPrefix RedisKeyPrefix
+	ttl       time.Duration
+
+	// 変更通知はインスタンスで1つの購読を共有し、ルームごとに振り分ける
+	pubsub      *redis.PubSub
+	subscribers map[string]map[chan struct{}]struct{}
+	subMu       sync.Mutex
+}
+
+var _ RoomRepository = (*RedisRoomRepository)(nil)
+var _ RoomChangeNotifier = (*RedisRoomRepository)(nil)
+
+/*
+	読み込み:
+		毎回Redisから読み込む
+	書き込み:
+		ルームの有効期限を SET EX で指定して保存し、同じ MULTI の中で変更を PUBLISH する
+		期限切れのルームはRedisが削除するので Sweep では何もしない
+	トランザクション:
+		Find したルームのキーを WATCH し、Save は EXEC まで溜めておく
+		他のインスタンスが先に書き込んでいた場合は最初からやり直す
+	イベント:
+		Seq をスコアにしたソート済みセットに、ルームと同じ MULTI で追加する。有効期限もルームに揃える
+*/
+
+// redisTxMaxRetries 楽観ロックが衝突したときにやり直す回数
+const redisTxMaxRetries = 10
+
+type redisTxKey struct{}
+
+// redisTx Transaction 中の状態
+type redisTx struct {
+	tx *redis.Tx
+	// EXEC で書き込むルーム
+	pending map[string]*entities.Room
+}
+
+// NewRedisRoomRepository ttl は Retention がデフォルトのルームの有効期限
+func NewRedisRoomRepository(options *redis.Options, keyPrefix RedisKeyPrefix, ttl time.Duration) *RedisRoomRepository {
+	return &RedisRoomRepository{
+		client:      redis.NewClient(options),
+		keyPrefix:   keyPrefix,
+		ttl:         ttl,
+		subscribers: map[string]map[chan struct{}]struct{}{},
+	}
+}
+
+func (r *RedisRoomRepository) roomKey(roomID string) string {
+	return string(r.keyPrefix) + "room:" + roomID
+}
+
+func (r *RedisRoomRepository) eventsKey(roomID string) string {
+	return string(r.keyPrefix) + "events:" + roomID
+}
+
+func (r *RedisRoomRepository) snapshotsKey(roomID string) string {
+	return string(r.keyPrefix) + "snapshots:" + roomID
+}
+
+func (r *RedisRoomRepository) changedChannel(roomID string) string {
+	return string(r.keyPrefix) + "changed:" + roomID
+}
+
+// redisError 閉じた後の呼び出しは他のリポジトリと同じく RepositoryClosedError にする
+func redisError(message string, err error) error {
+	if errors.Is(err, redis.ErrClosed) {
+		return RepositoryClosedError
+	}
+	return fmt.Errorf("%s: %v", message, err)
+}
+
+// Transaction f の中の Find から Save までを WATCH/MULTI で1つにまとめる
+// f はやり直しで複数回呼ばれることがある
+func (r *RedisRoomRepository) Transaction(ctx context.Context, f func(ctx context.Context) (*entities.Room, error)) (*entities.Room, error) {
+	if _, ok := ctx.Value(redisTxKey{}).(*redisTx); ok {
+		return f(ctx)
+	}
+	for i := 0; i < redisTxMaxRetries; i++ {
+		var room *entities.Room
+		// WATCH するキーは f の中の Find で決まる
+		err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+			state := &redisTx{tx: tx, pending: map[string]*entities.Room{}}
+			var err error
+			room, err = f(context.WithValue(ctx, redisTxKey{}, state))
+			if err != nil {
+				return err
+			}
+			return r.commit(ctx, state)
+		})
+		if errors.Is(err, redis.TxFailedErr) {
+			slog.Info("room transaction conflicted, retrying", slog.Int("attempt", i+1))
+			continue
+		}
+		if errors.Is(err, redis.ErrClosed) {
+			return nil, RepositoryClosedError
+		}
+		if err != nil {
+			return nil, err
+		}
+		return room, nil
+	}
+	return nil, fmt.Errorf("fail to commit room: %v", redis.TxFailedErr)
+}
+
+// commit 溜めておいたルームを書き込む。WATCH したキーが変わっていれば redis.TxFailedErr になる
+func (r *RedisRoomRepository) commit(ctx context.Context, state *redisTx) (err error) {
+	if len(state.pending) == 0 {
+		return nil
+	}
+	defer observeRepository("commit", time.Now(), &err)
+	saved := map[*entities.Room]int64{}
+	_, err = state.tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, room := range state.pending {
+			seq, err := r.queueSave(ctx, pipe, room)
+			if err != nil {
+				return err
+			}
+			saved[room] = seq
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for room, seq := range saved {
+		room.ChangesSaved(seq)
+	}
+	return nil
+}
+
+// queueSave ルームとまだ保存していないイベントを書き込むコマンドを積む。書き込むイベントの最後の番号を返す
+func (r *RedisRoomRepository) queueSave(ctx context.Context, pipe redis.Pipeliner, room *entities.Room) (int64, error) {
+	data, err := json.Marshal(room.Serialize())
+	if err != nil {
+		return 0, fmt.Errorf("fail to serialize room: %v", err)
+	}
+	// 0 は有効期限なし
+	var expiration time.Duration
+	now := time.Now()
+	if expiresAt := room.ExpiresAt(now, r.ttl); expiresAt != nil {
+		expiration = expiresAt.Sub(now)
+	}
+	pipe.Set(ctx, r.roomKey(room.ID()), data, expiration)
+	events, snapshots := room.PendingChanges()
+	for _, event := range events {
+		if err := queueLog(ctx, pipe, r.eventsKey(room.ID()), event.Seq, event); err != nil {
+			return 0, err
+		}
+	}
+	for _, snapshot := range snapshots {
+		if err := queueLog(ctx, pipe, r.snapshotsKey(room.ID()), snapshot.Seq, snapshot); err != nil {
+			return 0, err
+		}
+	}
+	for _, key := range []string{r.eventsKey(room.ID()), r.snapshotsKey(room.ID())} {
+		if expiration > 0 {
+			pipe.Expire(ctx, key, expiration)
+		} else {
+			pipe.Persist(ctx, key)
+		}
+	}
+	pipe.Publish(ctx, r.changedChannel(room.ID()), room.LastModifiedAt().UnixNano())
+	return lastSeq(events, snapshots), nil
+}
+
+// queueLog Seq をスコアにして追加する。同じ Seq のものは置き換える
+func queueLog(ctx context.Context, pipe redis.Pipeliner, key string, seq int64, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("fail to serialize %s: %v", key, err)
+	}
+	score := strconv.FormatInt(seq, 10)
+	pipe.ZRemRangeByScore(ctx, key, score, score)
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(seq), Member: data})
+	return nil
+}
+
+func (r *RedisRoomRepository) Find(ctx context.Context, roomID string) (_ *entities.Room, err error) {
+	defer observeRepository("find", time.Now(), &err)
+	ctx, span := startChildSpan(ctx, "RedisRoomRepository.Find", attribute.String("room.id", roomID))
+	defer endSpan(span, &err)
+	var data []byte
+	if state, ok := ctx.Value(redisTxKey{}).(*redisTx); ok {
+		// 同じトランザクションで保存したものはまだ書き込まれていない
+		if room, ok := state.pending[roomID]; ok {
+			return room, nil
+		}
+		if err := state.tx.Watch(ctx, r.roomKey(roomID)).Err(); err != nil {
+			return nil, redisError("fail to watch room", err)
+		}
+		data, err = state.tx.Get(ctx, r.roomKey(roomID)).Bytes()
+	} else {
+		data, err = r.client.Get(ctx, r.roomKey(roomID)).Bytes()
+	}
+	if errors.Is(err, redis.Nil) {
+		// 作成するかどうかは呼び出し側で判断する
+		return nil, nil
+	}
+	if err != nil {
+		return nil, redisError("fail to get room", err)
+	}
+	var serialized entities.SerializedRoom
+	if err := json.Unmarshal(data, &serialized); err != nil {
+		return nil, fmt.Errorf("fail to deserialize room: %v", err)
+	}
+	room, err := entities.NewFromSerializedRoom(serialized)
+	if err != nil {
+		return nil, fmt.Errorf("fail to deserialize room: %v", err)
+	}
+	return room, nil
+}
+
+func (r *RedisRoomRepository) Save(ctx context.Context, room *entities.Room) (err error) {
+	defer observeRepository("save", time.Now(), &err)
+	ctx, span := startChildSpan(ctx, "RedisRoomRepository.Save", attribute.String("room.id", room.ID()))
+	defer endSpan(span, &err)
+	if state, ok := ctx.Value(redisTxKey{}).(*redisTx); ok {
+		state.pending[room.ID()] = room
+		return nil
+	}
+	var seq int64
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		var err error
+		seq, err = r.queueSave(ctx, pipe, room)
+		return err
+	})
+	if err != nil {
+		return redisError("fail to save room", err)
+	}
+	room.ChangesSaved(seq)
+	slog.Info("room saved",
+		slog.String("room_id", room.ID()),
+		slog.Any("last_modified", room.LastModifiedAt()),
+	)
+	return nil
+}
+
+func (r *RedisRoomRepository) Events(ctx context.Context, roomID string, afterSeq int64, limit int) (_ []entities.RoomEvent, err error) {
+	defer observeRepository("events", time.Now(), &err)
+	ctx, span := startChildSpan(ctx, "RedisRoomRepository.Events", attribute.String("room.id", roomID))
+	defer endSpan(span, &err)
+	values, err := r.client.ZRangeByScore(ctx, r.eventsKey(roomID), &redis.ZRangeBy{
+		Min:   "(" + strconv.FormatInt(afterSeq, 10),
+		Max:   "+inf",
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, redisError("fail to get events", err)
+	}
+	events := make([]entities.RoomEvent, 0, len(values))
+	for _, value := range values {
+		var event entities.RoomEvent
+		if err := json.Unmarshal([]byte(value), &event); err != nil {
+			return nil, fmt.Errorf("fail to decode event: %v", err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (r *RedisRoomRepository) FindSnapshot(ctx context.Context, roomID string, seq int64) (_ *entities.RoomSnapshot, err error) {
+	defer observeRepository("find_snapshot", time.Now(), &err)
+	ctx, span := startChildSpan(ctx, "RedisRoomRepository.FindSnapshot", attribute.String("room.id", roomID))
+	defer endSpan(span, &err)
+	values, err := r.client.ZRevRangeByScore(ctx, r.snapshotsKey(roomID), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(seq, 10),
+		Count: 1,
+	}).Result()
+	if err != nil {
+		return nil, redisError("fail to get snapshot", err)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	var snapshot entities.RoomSnapshot
+	if err := json.Unmarshal([]byte(values[0]), &snapshot); err != nil {
+		return nil, fmt.Errorf("fail to decode snapshot: %v", err)
+	}
+	return &snapshot, nil
+}
+
+// SubscribeRoomChanges 他のインスタンスも含めてルームが保存されるたびに通知する
+// 通知が溜まっている間の変更は1つにまとめる
+func (r *RedisRoomRepository) SubscribeRoomChanges(ctx context.Context, roomID string) (<-chan struct{}, error) {
+	r.subMu.Lock()
+	defer r.subMu.Unlock()
+	if r.pubsub == nil {
+		// 接続が切れても go-redis が再接続して購読し直す
+		pubsub := r.client.PSubscribe(context.WithoutCancel(ctx), r.changedChannel("*"))
+		if _, err := pubsub.Receive(ctx); err != nil {
+			pubsub.Close()
+			return nil, redisError("fail to subscribe room changes", err)
+		}
+		r.pubsub = pubsub
+		go r.dispatch(pubsub.Channel())
+	}
+	ch := make(chan struct{}, 1)
+	if r.subscribers[roomID] == nil {
+		r.subscribers[roomID] = map[chan struct{}]struct{}{}
+	}
+	r.subscribers[roomID][ch] = struct{}{}
+	go func() {
+		<-ctx.Done()
+		r.subMu.Lock()
+		defer r.subMu.Unlock()
+		delete(r.subscribers[roomID], ch)
+		if len(r.subscribers[roomID]) == 0 {
+			delete(r.subscribers, roomID)
+		}
+	}()
+	return ch, nil
+}
+
+// dispatch 受け取った変更を購読しているルームの接続に振り分ける
+func (r *RedisRoomRepository) dispatch(messages <-chan *redis.Message) {
+	prefix := r.changedChannel("")
+	for message := range messages {
+		roomID := strings.TrimPrefix(message.Channel, prefix)
+		r.subMu.Lock()
+		for ch := range r.subscribers[roomID] {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+		r.subMu.Unlock()
+	}
+}
+
+// Sweep Redisが期限切れのキーを削除するので何もしない
+func (r *RedisRoomRepository) Sweep(ctx context.Context, now time.Time) (SweepResult, error) {
+	return SweepResult{}, nil
+}
+
+func (r *RedisRoomRepository) Ping(ctx context.Context) (err error) {
+	defer observeRepository("ping", time.Now(), &err)
+	ctx, span := startChildSpan(ctx, "RedisRoomRepository.Ping")
+	defer endSpan(span, &err)
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		return redisError("fail to ping redis", err)
+	}
+	return nil
+}
+
+// Flush Save の時点でRedisに書き込んでいるので何もしない
+func (r *RedisRoomRepository) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Close 購読と接続を閉じる。以降の呼び出しは RepositoryClosedError を返す
+func (r *RedisRoomRepository) Close() error {
+	r.subMu.Lock()
+	pubsub := r.pubsub
+	r.subMu.Unlock()
+	var errs []error
+	if pubsub != nil {
+		errs = append(errs, pubsub.Close())
+	}
+	errs = append(errs, r.client.Close())
+	return errors.Join(errs...)
+}
@@ -0,0 +1,296 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/pistatium/planing_poker/internal/entities"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// miniredis をプロセス内で立てて、外部のRedisなしでテストする
+
+func newTestRedisRepository(t *testing.T, server *miniredis.Miniredis) *RedisRoomRepository {
+	t.Helper()
+	repo := NewRedisRoomRepository(&redis.Options{Addr: server.Addr()}, "test:", DefaultRoomTTL)
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+func TestRedisRoomRepository_RoundTrip(t *testing.T) {
+	server := miniredis.RunT(t)
+	repo := newTestRedisRepository(t, server)
+	ctx := context.Background()
+
+	room := entities.NewRoom("room1")
+	for _, name := range []string{"alice", "bob"} {
+		if err := room.AddUser(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := room.SetDeck([]string{"1", "2", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	point, err := entities.NewPoint("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := room.SetEstimate("alice", point, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.RevealEstimates(); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Save(ctx, room); err != nil {
+		t.Fatal(err)
+	}
+
+	// 別のインスタンスからも読める
+	got, err := newTestRedisRepository(t, server).Find(ctx, "room1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil {
+		t.Fatal("room not found after save")
+	}
+	assertSameRoom(t, room.Serialize(), got.Serialize())
+
+	missing, err := repo.Find(ctx, "room2")
+	if err != nil || missing != nil {
+		t.Errorf("Find(room2) = %v, %v, want nil, nil", missing, err)
+	}
+}
+
+func TestRedisRoomRepository_TTL(t *testing.T) {
+	server := miniredis.RunT(t)
+	repo := newTestRedisRepository(t, server)
+	ctx := context.Background()
+	if err := repo.Save(ctx, entities.NewRoom("room1")); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("test:room:room1"); ttl != DefaultRoomTTL {
+		t.Errorf("TTL = %v, want %v", ttl, DefaultRoomTTL)
+	}
+	permanent := entities.NewRoom("permanent")
+	if err := permanent.SetRetention(entities.RetentionPermanent); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Save(ctx, permanent); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("test:room:permanent"); ttl != 0 {
+		t.Errorf("TTL of permanent room = %v, want none", ttl)
+	}
+
+	server.FastForward(DefaultRoomTTL + time.Second)
+	for id, want := range map[string]bool{"room1": false, "permanent": true} {
+		room, err := repo.Find(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (room != nil) != want {
+			t.Errorf("Find(%s) found = %v, want %v", id, room != nil, want)
+		}
+	}
+}
+
+func TestRedisRoomRepository_TransactionRetry(t *testing.T) {
+	server := miniredis.RunT(t)
+	repo := newTestRedisRepository(t, server)
+	other := newTestRedisRepository(t, server)
+	ctx := context.Background()
+	if err := repo.Save(ctx, entities.NewRoom("room1")); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	room, err := repo.Transaction(ctx, func(ctx context.Context) (*entities.Room, error) {
+		calls++
+		room, err := repo.Find(ctx, "room1")
+		if err != nil {
+			return nil, err
+		}
+		if calls == 1 {
+			// 読んでから書くまでの間に他のインスタンスが書き込む
+			theirs, err := other.Find(context.Background(), "room1")
+			if err != nil {
+				return nil, err
+			}
+			if err := theirs.AddUser("bob"); err != nil {
+				return nil, err
+			}
+			if err := other.Save(context.Background(), theirs); err != nil {
+				return nil, err
+			}
+		}
+		if err := room.AddUser("alice"); err != nil {
+			return nil, err
+		}
+		return room, repo.Save(ctx, room)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+	if len(room.Estimates()) != 2 {
+		t.Errorf("participants = %d, want 2 (the other write was lost)", len(room.Estimates()))
+	}
+}
+
+func TestRedisRoomRepository_TransactionRollback(t *testing.T) {
+	server := miniredis.RunT(t)
+	repo := newTestRedisRepository(t, server)
+	ctx := context.Background()
+	wantErr := fmt.Errorf("something went wrong")
+	_, err := repo.Transaction(ctx, func(ctx context.Context) (*entities.Room, error) {
+		if err := repo.Save(ctx, entities.NewRoom("room1")); err != nil {
+			return nil, err
+		}
+		return nil, wantErr
+	})
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("Transaction = %v, want %v", err, wantErr)
+	}
+	if server.Exists("test:room:room1") {
+		t.Error("room was saved although the transaction failed")
+	}
+}
+
+func TestRedisRoomRepository_Close(t *testing.T) {
+	server := miniredis.RunT(t)
+	repo := newTestRedisRepository(t, server)
+	if err := repo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Find(context.Background(), "room1"); !errors.Is(err, RepositoryClosedError) {
+		t.Errorf("Find after Close = %v, want %v", err, RepositoryClosedError)
+	}
+}
+
+func TestEventManager_RedisRoomChangedAcrossInstances(t *testing.T) {
+	server := miniredis.RunT(t)
+	// 2つのインスタンスが同じRedisを使っている
+	first := NewEventManager(newTestRedisRepository(t, server), EventManagerConfig{AllowImplicitRoomCreation: true})
+	second := NewEventManager(newTestRedisRepository(t, server), EventManagerConfig{AllowImplicitRoomCreation: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := second.RoomChangedStream(ctx, "room1")
+	// 購読が始まるのを待つ
+	deadline := time.Now().Add(time.Second)
+	for server.PubSubNumPat() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := first.Join(ctx, "room1", "alice", "", "token-alice", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	// ポーリングの間隔より十分早く届く
+	select {
+	case room := <-stream:
+		if len(room.Estimates()) != 1 || room.Estimates()[0].User.Name != "alice" {
+			t.Errorf("participants = %+v, want alice", room.Serialize().Estimates)
+		}
+	case <-time.After(roomChangedFallbackInterval / 2):
+		t.Fatal("room change was not notified")
+	}
+}
+
+func TestEventManager_RedisConcurrentSetEstimate(t *testing.T) {
+	server := miniredis.RunT(t)
+	managers := []*EventManager{
+		NewEventManager(newTestRedisRepository(t, server), EventManagerConfig{AllowImplicitRoomCreation: true}),
+		NewEventManager(newTestRedisRepository(t, server), EventManagerConfig{AllowImplicitRoomCreation: true}),
+	}
+	ctx := context.Background()
+
+	const users = 10
+	for i := 0; i < users; i++ {
+		if _, err := managers[i%2].Join(ctx, "room1", fmt.Sprintf("user%d", i), "", fmt.Sprintf("token%d", i), "127.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			point, _ := entities.NewPoint(fmt.Sprint(i + 1))
+			if _, err := managers[i%2].SetEstimate(ctx, "room1", fmt.Sprintf("user%d", i), point, ""); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	room, err := managers[0].Get(ctx, "room1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, est := range room.Estimates() {
+		if est.Point.Label() == "" {
+			t.Errorf("estimate of %s was lost", est.User.Name)
+		}
+	}
+}
+
+func TestRedisRoomRepository_Replay(t *testing.T) {
+	assertReplayMatchesRoom(t, newTestRedisRepository(t, miniredis.RunT(t)))
+}
+
+// auditCounter 構造化ログに出た監査ログを数える
+type auditCounter struct {
+	slog.Handler
+	count atomic.Int32
+}
+
+func (h *auditCounter) Handle(ctx context.Context, r slog.Record) error {
+	if r.Message == "audit" {
+		h.count.Add(1)
+	}
+	return nil
+}
+
+func TestEventManager_RedisAuditLoggedOnce(t *testing.T) {
+	server := miniredis.RunT(t)
+	first := NewEventManager(newTestRedisRepository(t, server), EventManagerConfig{AllowImplicitRoomCreation: true})
+	second := NewEventManager(newTestRedisRepository(t, server), EventManagerConfig{AllowImplicitRoomCreation: true})
+	ctx := context.Background()
+	if _, err := first.Join(ctx, "room1", "alice", "", "token-alice", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	counter := &auditCounter{Handler: slog.NewTextHandler(io.Discard, nil)}
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(counter))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	calls := 0
+	actor := Actor{UserName: "alice", Token: "token-alice"}
+	_, err := first.facilitate(ctx, "room1", actor, entities.AuditEntry{Action: entities.AuditReveal}, func(room *entities.Room) error {
+		calls++
+		if calls == 1 {
+			// 読んでから書くまでの間に他のインスタンスが書き込み、やり直しになる
+			if _, err := second.Join(context.Background(), "room1", "bob", "", "token-bob", "127.0.0.1"); err != nil {
+				return err
+			}
+		}
+		return room.RevealEstimates()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+	if got := counter.count.Load(); got != 1 {
+		t.Errorf("audit logged %d times, want once after the commit", got)
+	}
+}
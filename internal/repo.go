@@ -3,10 +3,66 @@ package internal
 import (
 	"context"
 	"github.com/pistatium/planing_poker/internal/entities"
+	"time"
 )
 
+// StorageBackend ルームの保存先
+type StorageBackend string
+
+const (
+	StorageFirestore StorageBackend = "firestore"
+	StorageBolt      StorageBackend = "bolt"
+	StorageMemory    StorageBackend = "memory"
+	StorageRedis     StorageBackend = "redis"
+)
+
+// DefaultRoomTTL 最後に保存されてからルームを残しておく期間のデフォルト
+// ルームごとに entities.Retention で変えられる
+const DefaultRoomTTL = 24 * time.Hour
+
+// SweepResult 1回の掃除で消したルームの数
+type SweepResult struct {
+	// Evicted メモリ上のキャッシュから外した数。保存先には残っている
+	Evicted int
+	// Deleted 期限切れで保存先から削除した数
+	Deleted int
+}
+
 type RoomRepository interface {
 	Transaction(ctx context.Context, f func(ctx context.Context) (*entities.Room, error)) (*entities.Room, error)
+	// Find 存在しない場合は nil, nil を返す
 	Find(ctx context.Context, roomID string) (*entities.Room, error)
+	// Save ルームと一緒に、まだ保存していないイベントとスナップショットを書き込む
 	Save(ctx context.Context, room *entities.Room) error
+	// Events afterSeq より後のイベントを古い順に最大 limit 件返す
+	Events(ctx context.Context, roomID string, afterSeq int64, limit int) ([]entities.RoomEvent, error)
+	// FindSnapshot seq 以前で最新のスナップショット。存在しない場合は nil, nil を返す
+	FindSnapshot(ctx context.Context, roomID string, seq int64) (*entities.RoomSnapshot, error)
+	// Ping ストレージに接続できるか確認する (readiness用)
+	Ping(ctx context.Context) error
+	// Flush まだ書き込めていない変更を保存する (シャットダウン時)
+	Flush(ctx context.Context) error
+	// Sweep now の時点で期限切れのルームを削除し、使われていないキャッシュを捨てる
+	Sweep(ctx context.Context, now time.Time) (SweepResult, error)
+	// Close 接続などを解放する。Flush の後に呼ぶ
+	Close() error
+}
+
+// RoomChangeNotifier ルームの変更を通知できるリポジトリ
+// 実装している場合、RoomChangedStream はポーリングの代わりに通知を受けてから読み込む
+type RoomChangeNotifier interface {
+	// SubscribeRoomChanges roomID のルームが保存されるたびに通知する。ctx が終わるまで購読する
+	SubscribeRoomChanges(ctx context.Context, roomID string) (<-chan struct{}, error)
+}
+
+// lastSeq Save で書き込んだイベントとスナップショットの最後の番号。ChangesSaved に渡す
+func lastSeq(events []entities.RoomEvent, snapshots []entities.RoomSnapshot) int64 {
+	var seq int64
+	for _, event := range events {
+		seq = max(seq, event.Seq)
+	}
+	for _, snapshot := range snapshots {
+		seq = max(seq, snapshot.Seq)
+	}
+	return seq
 }
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"os"
+)
+
+type TracingExporter string
+
+const (
+	TracingExporterNone   TracingExporter = ""
+	TracingExporterStdout TracingExporter = "stdout" // ローカル確認用
+	TracingExporterOTLP   TracingExporter = "otlp"   // 送信先は OTEL_EXPORTER_OTLP_ENDPOINT で指定
+)
+
+var tracer = otel.Tracer("github.com/pistatium/planing_poker")
+
+// Tracer main パッケージからもスパンを作れるように公開する
+func Tracer() trace.Tracer {
+	return tracer
+}
+
+// SetupTracing グローバルの TracerProvider と伝搬方式を設定する
+// 戻り値の関数で未送信のスパンを送ってから終了する
+func SetupTracing(ctx context.Context, exporter TracingExporter, serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case TracingExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case TracingExporterStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+	case TracingExporterOTLP:
+		spanExporter, err = otlptracegrpc.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter: %s", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to init tracing exporter: %v", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, fmt.Errorf("fail to init tracing resource: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	slog.Info("tracing enabled", slog.String("exporter", string(exporter)))
+	return provider.Shutdown, nil
+}
+
+// startChildSpan 親スパンがあるときだけスパンを作る
+// 100msごとのポーリングなど、操作に紐づかない呼び出しでスパンが溢れないようにする
+func startChildSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan エラーがあればスパンに記録して終了する。defer で使う
+func endSpan(span trace.Span, err *error) {
+	if *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"sync"
+	"testing"
+)
+
+var (
+	spanRecorder     *tracetest.SpanRecorder
+	spanRecorderOnce sync.Once
+)
+
+// recordSpans 終了したスパンを記録する
+// tracer はグローバルの TracerProvider に最初に設定したものへ委譲するので、テスト全体で1つを使い回す
+func recordSpans() *tracetest.SpanRecorder {
+	spanRecorderOnce.Do(func() {
+		spanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	})
+	return spanRecorder
+}
+
+// endedSpans roomID のルームに対する name のスパン
+func endedSpans(recorder *tracetest.SpanRecorder, name string, roomID string) []sdktrace.ReadOnlySpan {
+	var spans []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() != name {
+			continue
+		}
+		for _, attr := range span.Attributes() {
+			if attr.Key == "room.id" && attr.Value.AsString() == roomID {
+				spans = append(spans, span)
+			}
+		}
+	}
+	return spans
+}
+
+func TestEventManager_SetEstimateSpanInAnonymousRoom(t *testing.T) {
+	recorder := recordSpans()
+	e := NewEventManager(NewMemoryRoomRepository(DefaultRoomTTL), EventManagerConfig{})
+	ctx := context.Background()
+	for _, anonymous := range []bool{false, true} {
+		room, err := e.CreateRoom(ctx, RoomSettings{Anonymous: anonymous}, "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.Join(ctx, room.ID(), "alice", "", "token-alice", "127.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.SetEstimate(ctx, room.ID(), "alice", mustPoint(t, "3"), ""); err != nil {
+			t.Fatal(err)
+		}
+		spans := endedSpans(recorder, "EventManager.SetEstimate", room.ID())
+		if len(spans) != 1 {
+			t.Fatalf("anonymous=%v: %d SetEstimate spans, want 1", anonymous, len(spans))
+		}
+		hasPoint := false
+		for _, attr := range spans[0].Attributes() {
+			if attr.Key == "point" {
+				hasPoint = true
+			}
+		}
+		// 匿名のルームでは名前とカードを一緒にエクスポートしない
+		if hasPoint == anonymous {
+			t.Errorf("anonymous=%v: span has point = %v", anonymous, hasPoint)
+		}
+	}
+}
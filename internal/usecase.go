@@ -5,61 +5,410 @@ import (
 	"errors"
 	"fmt"
 	"github.com/pistatium/planing_poker/internal/entities"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+var RoomNotFoundError = fmt.Errorf("room not found")
+
+type EventManagerConfig struct {
+	// 存在しないルームIDで join したときに自動でルームを作るか
+	// false の場合は CreateRoom で作成したルームにのみ参加できる
+	AllowImplicitRoomCreation bool
+	// ルームごとに設定できる保存期間の上限。0 の場合は永続的なルームも作れる
+	MaxRoomRetention time.Duration
+	// チームルーム (期限切れで削除しないルーム) を作れるか。MaxRoomRetention には制限されない
+	AllowTeamRooms bool
+}
+
 type EventManager struct {
-	roomRepository RoomRepository
+	roomRepository  RoomRepository
+	config          EventManagerConfig
+	passcodeLimiter *AttemptLimiter
+	// ルームごとの監視中の接続数
+	watchers   map[string]int
+	watchersMu sync.Mutex
 }
 
-func NewEventManager(roomRepository RoomRepository) *EventManager {
-	return &EventManager{roomRepository: roomRepository}
+func NewEventManager(roomRepository RoomRepository, config EventManagerConfig) *EventManager {
+	return &EventManager{
+		roomRepository: roomRepository,
+		config:         config,
+		// 同じ接続元から5回間違えたら1分間ロック
+		passcodeLimiter: NewAttemptLimiter(5, time.Minute, time.Minute),
+		watchers:        map[string]int{},
+	}
+}
+
+// RoomSettings ルーム作成時の設定
+type RoomSettings struct {
+	// 使えるカード。空の場合は任意の値を受け付ける
+	Deck []string
+	// 空の場合は保護しない
+	Passcode string
+	// 公開・リセットができる参加者。空の場合は誰でもできる
+	Facilitators []string
+	// 最後に使われてから残しておく期間。デフォルトはデプロイの設定に従う
+	Retention entities.Retention
+	// チームルームは期限切れで削除されず、メンバーと履歴を残す
+	Type entities.RoomType
+	// 公開した見積もりや履歴に誰が出したかを含めない
+	Anonymous bool
+}
+
+// CreateRoom 新しいIDでルームを作成する
+// clientAddr は監査ログに残す
+func (e *EventManager) CreateRoom(ctx context.Context, settings RoomSettings, clientAddr string) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.CreateRoom")
+	defer endSpan(span, &err)
+	room, err := e.newRoomWithUniqueID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := room.SetDeck(settings.Deck); err != nil {
+		return nil, err
+	}
+	if err := room.SetPasscode(settings.Passcode); err != nil {
+		return nil, err
+	}
+	if err := e.checkRoomType(settings.Type, settings.Retention); err != nil {
+		return nil, err
+	}
+	if err := room.SetRetention(settings.Retention); err != nil {
+		return nil, err
+	}
+	if err := room.SetType(settings.Type); err != nil {
+		return nil, err
+	}
+	if err := room.SetAnonymous(settings.Anonymous); err != nil {
+		return nil, err
+	}
+	for _, name := range settings.Facilitators {
+		name, err := entities.NormalizeUserName(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := room.SetRole(name, entities.RoleFacilitator); err != nil {
+			return nil, err
+		}
+	}
+	entry := entities.AuditEntry{Action: entities.AuditRoomCreated, RemoteAddr: clientAddr, At: time.Now()}
+	room.RecordAudit(entry)
+	if err := e.roomRepository.Save(ctx, room); err != nil {
+		return nil, err
+	}
+	slog.Info("room created", slog.String("room_id", room.ID()))
+	logAudit(room.ID(), entry)
+	return room, nil
+}
+
+// checkRoomType チームルームは保存期間を指定できない代わりに MaxRoomRetention に制限されない
+func (e *EventManager) checkRoomType(roomType entities.RoomType, retention entities.Retention) error {
+	if roomType != entities.RoomTypeTeam {
+		return e.checkRetention(retention)
+	}
+	if !e.config.AllowTeamRooms {
+		return fmt.Errorf("%w: team rooms are disabled", entities.InvalidRoomTypeError)
+	}
+	if retention != entities.RetentionDefault && retention != entities.RetentionPermanent {
+		return fmt.Errorf("%w: team rooms are permanent", entities.InvalidRetentionError)
+	}
+	return nil
+}
+
+// checkRetention デプロイで許可された保存期間か確認する
+func (e *EventManager) checkRetention(retention entities.Retention) error {
+	max := e.config.MaxRoomRetention
+	if max <= 0 || retention == entities.RetentionDefault {
+		return nil
+	}
+	if retention == entities.RetentionPermanent {
+		return fmt.Errorf("%w: permanent rooms are not allowed", entities.InvalidRetentionError)
+	}
+	if time.Duration(retention) > max {
+		return fmt.Errorf("%w: must be at most %s", entities.InvalidRetentionError, max)
+	}
+	return nil
+}
+
+func (e *EventManager) newRoomWithUniqueID(ctx context.Context) (*entities.Room, error) {
+	// 60bitあるので衝突はまず起きないが念のため確認する
+	for i := 0; i < 3; i++ {
+		roomID, err := entities.GenerateRoomID()
+		if err != nil {
+			return nil, err
+		}
+		existing, err := e.roomRepository.Find(ctx, roomID)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			return entities.NewRoom(roomID), nil
+		}
+	}
+	return nil, fmt.Errorf("fail to generate unique room id")
 }
 
+// roomChangedFallbackInterval 変更通知を受けている場合でも読み込み直す間隔
+const roomChangedFallbackInterval = 5 * time.Second
+
 func (e *EventManager) RoomChangedStream(ctx context.Context, roomID string) <-chan *entities.Room {
 	ch := make(chan *entities.Room)
+	e.watchRoom(roomID)
 	go func() {
 		defer close(ch)
+		defer e.unwatchRoom(roomID)
+		// 変更を通知できるリポジトリでは、ポーリングせずに通知を受けてから読み込む
+		var changed <-chan struct{}
+		if notifier, ok := e.roomRepository.(RoomChangeNotifier); ok {
+			var err error
+			changed, err = notifier.SubscribeRoomChanges(ctx, roomID)
+			if err != nil {
+				slog.Error("subscribe error, falling back to polling:", slog.Any("error", err))
+			}
+		}
 		lastUpdatedAt := time.Now()
 		for {
-			time.Sleep(100 * time.Millisecond)
-			room, err := e.Get(ctx, roomID)
+			if changed == nil {
+				time.Sleep(100 * time.Millisecond)
+			} else {
+				select {
+				case <-changed:
+				// 通知を取りこぼしても追いつけるようにときどき読み込む
+				case <-time.After(roomChangedFallbackInterval):
+				case <-ctx.Done():
+				}
+			}
+			// 接続が切れたら監視をやめる
+			if ctx.Err() != nil {
+				return
+			}
+			room, err := e.roomRepository.Find(ctx, roomID)
 			if err != nil {
 				slog.Error("get error:", slog.Any("error", err))
 				return
 			}
 			if room == nil {
-				slog.Info("room not found")
-				time.Sleep(10 * time.Second)
+				// まだ誰も join していない
+				if changed == nil {
+					time.Sleep(time.Second)
+				}
 				continue
 			}
-			if room.LastModifiedAt().After(lastUpdatedAt) {
-				slog.Info("room changed", slog.Any("room", room.Serialize()))
-				ch <- room
-				lastUpdatedAt = room.LastModifiedAt()
+			// 送っている間に変更されても次の読み込みで拾えるように、送る前の時刻を覚えておく
+			modifiedAt := room.LastModifiedAt()
+			if modifiedAt.After(lastUpdatedAt) {
+				if room.Anonymous() {
+					// 誰がどのカードを出したかをログに残さない
+					slog.Info("room changed", slog.String("room_id", roomID), slog.Int64("seq", room.Seq()), slog.String("state", string(room.State())))
+				} else {
+					slog.Info("room changed", slog.Any("room", room.Serialize()))
+				}
+				// 変更されてからポーリングで検知して受け渡すまでをスパンにする
+				_, span := tracer.Start(ctx, "EventManager.RoomChanged",
+					trace.WithTimestamp(modifiedAt),
+					trace.WithAttributes(attribute.String("room.id", roomID)),
+				)
+				select {
+				case ch <- room:
+					span.End()
+				case <-ctx.Done():
+					span.End()
+					return
+				}
+				lastUpdatedAt = modifiedAt
 			}
 		}
 	}()
 	return ch
 }
 
-func (e *EventManager) Get(ctx context.Context, roomID string) (*entities.Room, error) {
+// RunSweeper interval ごとに期限切れのルームを掃除する。ctx が終わるまで戻らない
+func (e *EventManager) RunSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := e.Sweep(ctx); err != nil {
+				slog.Error("sweep error:", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// Sweep 期限切れのルームを保存先から削除し、使われていないルームをメモリから外す
+func (e *EventManager) Sweep(ctx context.Context) (_ SweepResult, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.Sweep")
+	defer endSpan(span, &err)
+	result, err := e.roomRepository.Sweep(ctx, time.Now())
+	// 途中で失敗しても消せた分は数える
+	roomsSwept.WithLabelValues("evicted").Add(float64(result.Evicted))
+	roomsSwept.WithLabelValues("deleted").Add(float64(result.Deleted))
+	slog.Info("rooms swept",
+		slog.Int("evicted", result.Evicted),
+		slog.Int("deleted", result.Deleted),
+	)
+	span.SetAttributes(
+		attribute.Int("rooms.evicted", result.Evicted),
+		attribute.Int("rooms.deleted", result.Deleted),
+	)
+	return result, err
+}
+
+// Ping リポジトリに接続できるか確認する
+func (e *EventManager) Ping(ctx context.Context) error {
+	return e.roomRepository.Ping(ctx)
+}
+
+// Flush 未保存のルームの状態を書き込む
+func (e *EventManager) Flush(ctx context.Context) error {
+	return e.roomRepository.Flush(ctx)
+}
+
+// Close リポジトリを閉じる
+func (e *EventManager) Close() error {
+	return e.roomRepository.Close()
+}
+
+// watchRoom 監視中の接続数を数えて、接続のあるルーム数をメトリクスに出す
+func (e *EventManager) watchRoom(roomID string) {
+	e.watchersMu.Lock()
+	defer e.watchersMu.Unlock()
+	e.watchers[roomID]++
+	activeRooms.Set(float64(len(e.watchers)))
+}
+
+func (e *EventManager) unwatchRoom(roomID string) {
+	e.watchersMu.Lock()
+	defer e.watchersMu.Unlock()
+	e.watchers[roomID]--
+	if e.watchers[roomID] <= 0 {
+		delete(e.watchers, roomID)
+	}
+	activeRooms.Set(float64(len(e.watchers)))
+}
+
+func (e *EventManager) Get(ctx context.Context, roomID string) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.Get", trace.WithAttributes(attribute.String("room.id", roomID)))
+	defer endSpan(span, &err)
+	roomID, err = entities.NormalizeRoomID(roomID)
+	if err != nil {
+		return nil, err
+	}
 	// Roomの現在の状態をを取得
-	return e.roomRepository.Find(ctx, roomID)
+	room, err := e.roomRepository.Find(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if room == nil {
+		if !e.config.AllowImplicitRoomCreation {
+			return nil, RoomNotFoundError
+		}
+		// 保存はせず空のルームとして返す
+		return entities.NewRoom(roomID), nil
+	}
+	return room, nil
 }
 
-func (e *EventManager) Join(ctx context.Context, roomID string, userName string) (*entities.Room, error) {
-	return e.roomRepository.Transaction(ctx, func(ctx context.Context) (*entities.Room, error) {
+// Authorize ルームのパスコードを検証する
+// clientAddr ごとに失敗回数を数え、総当たりを防ぐ
+func (e *EventManager) Authorize(ctx context.Context, roomID string, passcode string, clientAddr string) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.Authorize", trace.WithAttributes(attribute.String("room.id", roomID)))
+	defer endSpan(span, &err)
+	roomID, err = entities.NormalizeRoomID(roomID)
+	if err != nil {
+		return nil, err
+	}
+	room, err := e.roomRepository.Find(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if room == nil {
+		return nil, nil
+	}
+	if err := e.verifyPasscode(room, passcode, clientAddr); err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+func (e *EventManager) verifyPasscode(room *entities.Room, passcode string, clientAddr string) error {
+	if !room.IsProtected() {
+		return nil
+	}
+	key := room.ID() + "|" + clientAddr
+	if err := e.passcodeLimiter.Allow(key); err != nil {
+		return err
+	}
+	err := room.VerifyPasscode(passcode)
+	if errors.Is(err, entities.InvalidPasscodeError) {
+		e.passcodeLimiter.Fail(key)
+		slog.Warn("invalid passcode",
+			slog.String("room_id", room.ID()),
+			slog.String("remote_addr", clientAddr),
+		)
+	}
+	if err != nil {
+		return err
+	}
+	e.passcodeLimiter.Succeed(key)
+	return nil
+}
+
+// Join ルームに参加する
+// 保護されたルームはパスコードが一致しないと参加できない
+// ルームがなくこの参加で作る場合のみ、作成者としてパスコードを設定する
+// 既存のルームには誰もいなくてもパスコードを設定しない (チームのメンバーが締め出されないように)
+// token は名前を結びつけるトークン。同じ名前で入り直すには同じトークンが必要
+func (e *EventManager) Join(ctx context.Context, roomID string, userName string, passcode string, token string, clientAddr string) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.Join", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", userName)))
+	defer endSpan(span, &err)
+	roomID, userName, err = normalizeInput(roomID, userName)
+	if err != nil {
+		return nil, err
+	}
+	// やり直しで f が複数回呼ばれても、書き込めた分だけログに出す
+	var audit *entities.AuditEntry
+	room, err := e.roomRepository.Transaction(ctx, func(ctx context.Context) (*entities.Room, error) {
+		audit = nil
 		room, err := e.roomRepository.Find(ctx, roomID)
 		if err != nil {
 			return nil, err
 		}
 		// Roomが存在しない場合は新規作成
+		created := false
 		if room == nil {
+			if !e.config.AllowImplicitRoomCreation {
+				return nil, RoomNotFoundError
+			}
 			room = entities.NewRoom(roomID)
+			created = true
+		}
+		if created && passcode != "" {
+			if err := room.SetPasscode(passcode); err != nil {
+				return nil, err
+			}
+			audit = &entities.AuditEntry{
+				At:         time.Now(),
+				Action:     entities.AuditSettingsChanged,
+				Actor:      userName,
+				RemoteAddr: clientAddr,
+				Detail:     entities.SettingPasscode,
+			}
+			room.RecordAudit(*audit)
+		} else if err := e.verifyPasscode(room, passcode, clientAddr); err != nil {
+			return nil, err
 		}
-		err = room.AddUser(userName)
+		err = room.AddParticipant(userName, token)
 		if err != nil && !errors.Is(err, entities.UserAlreadyExistsError) {
 			return nil, err
 		}
@@ -70,16 +419,25 @@ func (e *EventManager) Join(ctx context.Context, roomID string, userName string)
 		// Roomに参加者登録
 		return room, nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	if audit != nil {
+		logAudit(roomID, *audit)
+	}
+	return room, nil
 }
 
-func (e *EventManager) Leave(ctx context.Context, roomID string, userName string) (*entities.Room, error) {
+func (e *EventManager) Leave(ctx context.Context, roomID string, userName string) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.Leave", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", userName)))
+	defer endSpan(span, &err)
 	return e.roomRepository.Transaction(ctx, func(ctx context.Context) (*entities.Room, error) {
 		room, err := e.roomRepository.Find(ctx, roomID)
 		if err != nil {
 			return nil, err
 		}
 		if room == nil {
-			return nil, fmt.Errorf("room %s not found", roomID)
+			return nil, fmt.Errorf("%w: %s", RoomNotFoundError, roomID)
 		}
 		err = room.RemoveUser(userName)
 		if err != nil {
@@ -92,7 +450,49 @@ func (e *EventManager) Leave(ctx context.Context, roomID string, userName string
 		return nil, nil
 	})
 }
-func (e *EventManager) SetEstimate(ctx context.Context, roomID string, userName string, point *entities.Point) (*entities.Room, error) {
+
+// Quit 本人の操作で退出する。切断による Leave と違い、使い捨てのルームでは名前を手放す
+func (e *EventManager) Quit(ctx context.Context, roomID string, actor Actor) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.Quit", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", actor.UserName)))
+	defer endSpan(span, &err)
+	roomID, err = entities.NormalizeRoomID(roomID)
+	if err != nil {
+		return nil, err
+	}
+	return e.roomRepository.Transaction(ctx, func(ctx context.Context) (*entities.Room, error) {
+		room, err := e.roomRepository.Find(ctx, roomID)
+		if err != nil {
+			return nil, err
+		}
+		if room == nil {
+			return nil, fmt.Errorf("%w: %s", RoomNotFoundError, roomID)
+		}
+		// 名前を手放せるのは結びついたトークンを持つ本人だけ
+		if !room.Authenticate(actor.UserName, actor.Token) {
+			return nil, entities.PermissionDeniedError
+		}
+		if err := room.Leave(actor.UserName); err != nil {
+			return nil, err
+		}
+		if err := e.roomRepository.Save(ctx, room); err != nil {
+			return nil, err
+		}
+		return room, nil
+	})
+}
+
+// SetEstimate rationale はカードを選んだ理由。空でもよい
+func (e *EventManager) SetEstimate(ctx context.Context, roomID string, userName string, point *entities.Point, rationale string) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.SetEstimate", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", userName)))
+	defer endSpan(span, &err)
+	roomID, userName, err = normalizeInput(roomID, userName)
+	if err != nil {
+		return nil, err
+	}
+	rationale, err = entities.NormalizeRationale(rationale)
+	if err != nil {
+		return nil, err
+	}
 	// 見積もりをセット
 	return e.roomRepository.Transaction(ctx, func(ctx context.Context) (*entities.Room, error) {
 		room, err := e.roomRepository.Find(ctx, roomID)
@@ -100,13 +500,17 @@ func (e *EventManager) SetEstimate(ctx context.Context, roomID string, userName
 			return nil, err
 		}
 		if room == nil {
-			return nil, fmt.Errorf("room %s not found", roomID)
+			return nil, fmt.Errorf("%w: %s", RoomNotFoundError, roomID)
+		}
+		// 匿名のルームでは名前とカードの組み合わせをエクスポートしない
+		if !room.Anonymous() {
+			span.SetAttributes(attribute.String("point", point.Label()))
 		}
 		//if room.LastRevealedAt() != nil && !room.LastRevealedAt().Before(room.LastModifiedAt()) {
 		//	slog.Info("reset estimates")
 		//	room.ResetEstimates()
 		//}
-		err = room.SetEstimate(userName, point)
+		err = room.SetEstimate(userName, point, rationale)
 
 		if err != nil {
 			return nil, err
@@ -120,40 +524,377 @@ func (e *EventManager) SetEstimate(ctx context.Context, roomID string, userName
 	})
 }
 
-func (e *EventManager) RevealEstimates(ctx context.Context, roomID string) (*entities.Room, error) {
-	// 見積もりを公開
+// PostChat ルームのチャットに発言する。参加中の人のみ
+func (e *EventManager) PostChat(ctx context.Context, roomID string, userName string, text string) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.PostChat", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", userName)))
+	defer endSpan(span, &err)
+	text, err = entities.NormalizeChatText(text)
+	if err != nil {
+		return nil, err
+	}
+	return e.chat(ctx, roomID, userName, func(room *entities.Room, userName string) error {
+		return room.PostChat(userName, text)
+	})
+}
+
+// React ルームのチャットにリアクションを送る。参加中の人のみ
+func (e *EventManager) React(ctx context.Context, roomID string, userName string, reaction string) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.React", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", userName)))
+	defer endSpan(span, &err)
+	reaction, err = entities.NormalizeReaction(reaction)
+	if err != nil {
+		return nil, err
+	}
+	return e.chat(ctx, roomID, userName, func(room *entities.Room, userName string) error {
+		return room.React(userName, reaction)
+	})
+}
+
+// chat 発言とリアクションを1つのトランザクションで保存する
+func (e *EventManager) chat(ctx context.Context, roomID string, userName string, f func(room *entities.Room, userName string) error) (*entities.Room, error) {
+	roomID, userName, err := normalizeInput(roomID, userName)
+	if err != nil {
+		return nil, err
+	}
 	return e.roomRepository.Transaction(ctx, func(ctx context.Context) (*entities.Room, error) {
 		room, err := e.roomRepository.Find(ctx, roomID)
 		if err != nil {
 			return nil, err
 		}
 		if room == nil {
-			return nil, fmt.Errorf("room %s not found", roomID)
+			return nil, fmt.Errorf("%w: %s", RoomNotFoundError, roomID)
 		}
-		room.RevealEstimates()
-		err = e.roomRepository.Save(ctx, room)
-		if err != nil {
+		if err := f(room, userName); err != nil {
+			return nil, err
+		}
+		if err := e.roomRepository.Save(ctx, room); err != nil {
 			return nil, err
 		}
 		return room, nil
 	})
 }
 
-func (e *EventManager) Reset(ctx context.Context, roomID string) (*entities.Room, error) {
-	// 見積もりをリセット
-	return e.roomRepository.Transaction(ctx, func(ctx context.Context) (*entities.Room, error) {
+// Actor 操作した参加者と接続元。監査ログに残す
+type Actor struct {
+	UserName string
+	// join で名前を結びつけたトークン
+	Token      string
+	ClientAddr string
+}
+
+// facilitate 進行役のみ実行できる操作を1つのトランザクションで行い、監査ログに残す
+func (e *EventManager) facilitate(ctx context.Context, roomID string, actor Actor, entry entities.AuditEntry, f func(room *entities.Room) error) (*entities.Room, error) {
+	roomID, err := entities.NormalizeRoomID(roomID)
+	if err != nil {
+		return nil, err
+	}
+	// redis ではやり直しで f が複数回呼ばれるので、書き込めてからログに出す
+	room, err := e.roomRepository.Transaction(ctx, func(ctx context.Context) (*entities.Room, error) {
 		room, err := e.roomRepository.Find(ctx, roomID)
 		if err != nil {
 			return nil, err
 		}
 		if room == nil {
-			return nil, fmt.Errorf("room %s not found", roomID)
+			return nil, fmt.Errorf("%w: %s", RoomNotFoundError, roomID)
 		}
-		room.ResetEstimates()
-		err = e.roomRepository.Save(ctx, room)
-		if err != nil {
+		if !canFacilitate(room, actor) {
+			return nil, entities.PermissionDeniedError
+		}
+		if err := f(room); err != nil {
+			return nil, err
+		}
+		entry.Actor = actor.UserName
+		entry.RemoteAddr = actor.ClientAddr
+		entry.At = time.Now()
+		room.RecordAudit(entry)
+		if err := e.roomRepository.Save(ctx, room); err != nil {
 			return nil, err
 		}
 		return room, nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	logAudit(roomID, entry)
+	return room, nil
+}
+
+// canFacilitate 名前はクライアントが自由に名乗れるので、join で結びつけたトークンで本人か確かめる
+func canFacilitate(room *entities.Room, actor Actor) bool {
+	return room.Authenticate(actor.UserName, actor.Token) && room.CanFacilitate(actor.UserName)
+}
+
+// logAudit 監査ログを構造化ログにも出す。ルームに残るのは直近の MaxAuditEntries 件のみ
+func logAudit(roomID string, entry entities.AuditEntry) {
+	slog.Info("audit",
+		slog.String("room_id", roomID),
+		slog.String("action", string(entry.Action)),
+		slog.String("actor", entry.Actor),
+		slog.String("remote_addr", entry.RemoteAddr),
+		slog.String("target", entry.Target),
+		slog.String("detail", entry.Detail),
+	)
+}
+
+func (e *EventManager) RevealEstimates(ctx context.Context, roomID string, actor Actor) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.RevealEstimates", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", actor.UserName)))
+	defer endSpan(span, &err)
+	// 見積もりを公開
+	return e.facilitate(ctx, roomID, actor, entities.AuditEntry{Action: entities.AuditReveal}, func(room *entities.Room) error {
+		return room.RevealEstimates()
+	})
+}
+
+func (e *EventManager) Reset(ctx context.Context, roomID string, actor Actor) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.Reset", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", actor.UserName)))
+	defer endSpan(span, &err)
+	// 見積もりをリセット
+	return e.facilitate(ctx, roomID, actor, entities.AuditEntry{Action: entities.AuditReset}, func(room *entities.Room) error {
+		room.ResetEstimates()
+		return nil
+	})
+}
+
+// LockVotes 公開する前に見積もりを締め切る
+func (e *EventManager) LockVotes(ctx context.Context, roomID string, actor Actor) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.LockVotes", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", actor.UserName)))
+	defer endSpan(span, &err)
+	return e.facilitate(ctx, roomID, actor, entities.AuditEntry{Action: entities.AuditLock}, func(room *entities.Room) error {
+		return room.LockVotes()
+	})
+}
+
+// UnlockVotes 締め切りを取り消す
+func (e *EventManager) UnlockVotes(ctx context.Context, roomID string, actor Actor) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.UnlockVotes", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", actor.UserName)))
+	defer endSpan(span, &err)
+	return e.facilitate(ctx, roomID, actor, entities.AuditEntry{Action: entities.AuditUnlock}, func(room *entities.Room) error {
+		return room.UnlockVotes()
+	})
+}
+
+// Revote 公開した見積もりを今のストーリーのラウンドとして残し、見積もり直す
+func (e *EventManager) Revote(ctx context.Context, roomID string, actor Actor) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.Revote", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", actor.UserName)))
+	defer endSpan(span, &err)
+	return e.facilitate(ctx, roomID, actor, entities.AuditEntry{Action: entities.AuditRevote}, func(room *entities.Room) error {
+		return room.Revote()
+	})
+}
+
+// StartDiscussion 公開した見積もりについて話し合いを始める
+func (e *EventManager) StartDiscussion(ctx context.Context, roomID string, actor Actor) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.StartDiscussion", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", actor.UserName)))
+	defer endSpan(span, &err)
+	return e.facilitate(ctx, roomID, actor, entities.AuditEntry{Action: entities.AuditDiscuss}, func(room *entities.Room) error {
+		return room.StartDiscussion()
+	})
+}
+
+// Finalize 公開した見積もりでストーリーを確定する
+func (e *EventManager) Finalize(ctx context.Context, roomID string, actor Actor) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.Finalize", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", actor.UserName)))
+	defer endSpan(span, &err)
+	return e.facilitate(ctx, roomID, actor, entities.AuditEntry{Action: entities.AuditFinalize}, func(room *entities.Room) error {
+		return room.Finalize()
+	})
+}
+
+// Kick 参加者を退出させる。もう一度 join すれば戻れる
+func (e *EventManager) Kick(ctx context.Context, roomID string, actor Actor, target string) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.Kick", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", actor.UserName)))
+	defer endSpan(span, &err)
+	target, err = entities.NormalizeUserName(target)
+	if err != nil {
+		return nil, err
+	}
+	return e.facilitate(ctx, roomID, actor, entities.AuditEntry{Action: entities.AuditKick, Target: target}, func(room *entities.Room) error {
+		return room.RemoveUser(target)
+	})
+}
+
+// RemoveMember チームルームのメンバーから外す
+func (e *EventManager) RemoveMember(ctx context.Context, roomID string, actor Actor, target string) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.RemoveMember", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", actor.UserName)))
+	defer endSpan(span, &err)
+	target, err = entities.NormalizeUserName(target)
+	if err != nil {
+		return nil, err
+	}
+	return e.facilitate(ctx, roomID, actor, entities.AuditEntry{Action: entities.AuditRemoveMember, Target: target}, func(room *entities.Room) error {
+		if !room.IsTeam() {
+			return fmt.Errorf("%w: only team rooms have members", entities.InvalidRoomTypeError)
+		}
+		return room.RemoveMember(target)
+	})
+}
+
+// SetRole 参加者の役割を変える
+func (e *EventManager) SetRole(ctx context.Context, roomID string, actor Actor, target string, role entities.Role) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.SetRole", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", actor.UserName)))
+	defer endSpan(span, &err)
+	target, err = entities.NormalizeUserName(target)
+	if err != nil {
+		return nil, err
+	}
+	return e.facilitate(ctx, roomID, actor, entities.AuditEntry{Action: entities.AuditRoleChanged, Target: target, Detail: string(role)}, func(room *entities.Room) error {
+		return room.SetRole(target, role)
+	})
+}
+
+// SetDeck 使えるカードを変える。空の場合は任意の値を受け付ける
+func (e *EventManager) SetDeck(ctx context.Context, roomID string, actor Actor, deck []string) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.SetDeck", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", actor.UserName)))
+	defer endSpan(span, &err)
+	entry := entities.AuditEntry{Action: entities.AuditSettingsChanged, Detail: entities.SettingDeck + "=" + strings.Join(deck, ",")}
+	return e.facilitate(ctx, roomID, actor, entry, func(room *entities.Room) error {
+		return room.SetDeck(deck)
+	})
+}
+
+// SetAnonymous 匿名で見積もるかを変える。誰も見積もりを出していないときのみ変えられる
+func (e *EventManager) SetAnonymous(ctx context.Context, roomID string, actor Actor, anonymous bool) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.SetAnonymous", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", actor.UserName)))
+	defer endSpan(span, &err)
+	entry := entities.AuditEntry{Action: entities.AuditSettingsChanged, Detail: entities.SettingAnonymous + "=" + strconv.FormatBool(anonymous)}
+	return e.facilitate(ctx, roomID, actor, entry, func(room *entities.Room) error {
+		return room.SetAnonymous(anonymous)
+	})
+}
+
+// AuditLog 監査ログ。進行役のみ参照できる
+func (e *EventManager) AuditLog(ctx context.Context, roomID string, actor Actor) (_ []entities.AuditEntry, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.AuditLog", trace.WithAttributes(attribute.String("room.id", roomID), attribute.String("user.name", actor.UserName)))
+	defer endSpan(span, &err)
+	roomID, err = entities.NormalizeRoomID(roomID)
+	if err != nil {
+		return nil, err
+	}
+	room, err := e.roomRepository.Find(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if room == nil {
+		return nil, fmt.Errorf("%w: %s", RoomNotFoundError, roomID)
+	}
+	if !canFacilitate(room, actor) {
+		return nil, entities.PermissionDeniedError
+	}
+	return room.AuditLog(), nil
+}
+
+// replayPageSize Replay で一度に読み込むイベントの数
+const replayPageSize = 500
+
+// Events afterSeq より後のイベントを古い順に最大 limit 件返す
+func (e *EventManager) Events(ctx context.Context, roomID string, afterSeq int64, limit int) (_ []entities.RoomEvent, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.Events", trace.WithAttributes(attribute.String("room.id", roomID)))
+	defer endSpan(span, &err)
+	roomID, err = entities.NormalizeRoomID(roomID)
+	if err != nil {
+		return nil, err
+	}
+	return e.roomRepository.Events(ctx, roomID, afterSeq, limit)
+}
+
+// historyScanSize 履歴を探すときに一度に読むイベントの数
+const historyScanSize = 500
+
+// History チームルームで公開したラウンドを、afterSeq より後に公開したものから古い順に最大 limit 件返す
+// 履歴はイベントに残っているので、ルームの大きさに制限されずスプリントをまたいですべてたどれる
+// 続きがあれば nextAfter を次の afterSeq に渡す。最後まで読んだ場合は 0
+func (e *EventManager) History(ctx context.Context, roomID string, afterSeq int64, limit int) (_ []*entities.Round, nextAfter int64, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.History", trace.WithAttributes(attribute.String("room.id", roomID), attribute.Int64("after", afterSeq)))
+	defer endSpan(span, &err)
+	room, err := e.Get(ctx, roomID)
+	if err != nil {
+		return nil, 0, err
+	}
+	rounds := []*entities.Round{}
+	if !room.IsTeam() {
+		return rounds, 0, nil
+	}
+	// イベントに残す前の履歴は最初のページに含める
+	if afterSeq <= 0 {
+		afterSeq = 0
+		rounds = append(rounds, room.LegacyRounds()...)
+	}
+	found := 0
+	for {
+		events, err := e.roomRepository.Events(ctx, room.ID(), afterSeq, historyScanSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, event := range events {
+			afterSeq = event.Seq
+			if event.Round == nil {
+				continue
+			}
+			rounds = append(rounds, event.Round)
+			found++
+			if found >= limit {
+				return rounds, afterSeq, nil
+			}
+		}
+		if len(events) < historyScanSize {
+			return rounds, 0, nil
+		}
+	}
+}
+
+// Replay seq 以前で最新のスナップショットにその後のイベントを適用して、seq の時点のルームを組み立て直す
+// seq が 0 以下の場合は記録されている最後のイベントまで適用する
+func (e *EventManager) Replay(ctx context.Context, roomID string, seq int64) (_ *entities.Room, err error) {
+	ctx, span := tracer.Start(ctx, "EventManager.Replay", trace.WithAttributes(attribute.String("room.id", roomID), attribute.Int64("seq", seq)))
+	defer endSpan(span, &err)
+	roomID, err = entities.NormalizeRoomID(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if seq <= 0 {
+		seq = math.MaxInt64
+	}
+	snapshot, err := e.roomRepository.FindSnapshot(ctx, roomID, seq)
+	if err != nil {
+		return nil, err
+	}
+	var afterSeq int64
+	if snapshot != nil {
+		afterSeq = snapshot.Seq
+	}
+	var events []entities.RoomEvent
+	for {
+		page, err := e.roomRepository.Events(ctx, roomID, afterSeq, replayPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range page {
+			if event.Seq > seq {
+				break
+			}
+			events = append(events, event)
+		}
+		if len(page) < replayPageSize || page[len(page)-1].Seq >= seq {
+			break
+		}
+		afterSeq = page[len(page)-1].Seq
+	}
+	if snapshot == nil && len(events) == 0 {
+		return nil, fmt.Errorf("%w: %s", RoomNotFoundError, roomID)
+	}
+	span.SetAttributes(attribute.Int("events.replayed", len(events)))
+	return entities.Replay(roomID, snapshot, events)
+}
+
+// normalizeInput クライアントから受け取った値をルームやリポジトリに渡す前に検証する
+func normalizeInput(roomID string, userName string) (string, string, error) {
+	roomID, err := entities.NormalizeRoomID(roomID)
+	if err != nil {
+		return "", "", err
+	}
+	userName, err = entities.NormalizeUserName(userName)
+	if err != nil {
+		return "", "", err
+	}
+	return roomID, userName, nil
 }
@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pistatium/planing_poker/internal/entities"
+	"testing"
+)
+
+// assertReplayMatchesRoom ルームを一通り操作したあと、イベントから組み立て直したルームが保存されたルームと一致すること
+// スナップショットを挟むようにイベントを SnapshotInterval より多く記録する
+func assertReplayMatchesRoom(t *testing.T, repo RoomRepository) {
+	t.Helper()
+	ctx := context.Background()
+	em := NewEventManager(repo, EventManagerConfig{AllowImplicitRoomCreation: true, AllowTeamRooms: true})
+	room, err := em.CreateRoom(ctx, RoomSettings{
+		Deck:         []string{"1", "2", "3", "5", "8"},
+		Facilitators: []string{"alice"},
+		Type:         entities.RoomTypeTeam,
+	}, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roomID := room.ID()
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := em.Join(ctx, roomID, name, "", "token-"+name, "127.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := em.PostChat(ctx, roomID, "bob", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := em.React(ctx, roomID, "alice", "👍"); err != nil {
+		t.Fatal(err)
+	}
+	deck := room.Deck()
+	for i := 0; i < entities.SnapshotInterval/2+5; i++ {
+		if _, err := em.SetEstimate(ctx, roomID, "alice", mustPoint(t, deck[i%len(deck)]), fmt.Sprintf("reason %d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := em.SetEstimate(ctx, roomID, "bob", mustPoint(t, deck[(i+1)%len(deck)]), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := em.LockVotes(ctx, roomID, Actor{UserName: "alice", Token: "token-alice"}); err != nil {
+		t.Fatal(err)
+	}
+	revealed, err := em.RevealEstimates(ctx, roomID, Actor{UserName: "alice", Token: "token-alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revealedState := revealed.Serialize()
+	if _, err := em.StartDiscussion(ctx, roomID, Actor{UserName: "alice", Token: "token-alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := em.Revote(ctx, roomID, Actor{UserName: "alice", Token: "token-alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := em.SetEstimate(ctx, roomID, "alice", mustPoint(t, "5"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := em.Leave(ctx, roomID, "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := repo.Find(ctx, roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Seq() <= entities.SnapshotInterval {
+		t.Fatalf("Seq = %d, want more than %d events", current.Seq(), entities.SnapshotInterval)
+	}
+	replayed, err := em.Replay(ctx, roomID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, got := current.Serialize(), replayed.Serialize()
+	assertSameRoom(t, want, got)
+	if got.Seq != want.Seq || got.RevealedSeq != want.RevealedSeq {
+		t.Errorf("Seq = %d/%d, want %d/%d", got.Seq, got.RevealedSeq, want.Seq, want.RevealedSeq)
+	}
+	if fmt.Sprint(replayed.Members()) != fmt.Sprint(current.Members()) {
+		t.Errorf("Members = %v, want %v", replayed.Members(), current.Members())
+	}
+	if fmt.Sprint(replayed.ChatMessages(0)) != fmt.Sprint(current.ChatMessages(0)) {
+		t.Errorf("ChatMessages = %v, want %v", replayed.ChatMessages(0), current.ChatMessages(0))
+	}
+	gotRounds, _ := json.Marshal(got.StoryRounds)
+	wantRounds, _ := json.Marshal(want.StoryRounds)
+	if len(got.StoryRounds) != 1 || string(gotRounds) != string(wantRounds) {
+		t.Errorf("StoryRounds = %s, want %s", gotRounds, wantRounds)
+	}
+	// チームルームの履歴はルームではなくイベントから読む
+	rounds, nextAfter, err := em.History(ctx, roomID, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rounds) != 1 || nextAfter != 0 {
+		t.Errorf("History = %d rounds, next %d, want 1 rounds, next 0", len(rounds), nextAfter)
+	}
+
+	// 公開した時点まで戻せる
+	replayed, err = em.Replay(ctx, roomID, revealedState.Seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameRoom(t, revealedState, replayed.Serialize())
+
+	events, err := em.Events(ctx, roomID, 3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 10 || events[0].Seq != 4 || events[9].Seq != 13 {
+		t.Errorf("Events(after 3, limit 10) = %+v, want seq 4..13", events)
+	}
+}
+
+func mustPoint(t *testing.T, label string) *entities.Point {
+	t.Helper()
+	point, err := entities.NewPoint(label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return point
+}
+
+func TestEventManager_ReplayMemory(t *testing.T) {
+	assertReplayMatchesRoom(t, NewMemoryRoomRepository(DefaultRoomTTL))
+}
+
+func TestEventManager_History(t *testing.T) {
+	ctx := context.Background()
+	em := NewEventManager(NewMemoryRoomRepository(DefaultRoomTTL), EventManagerConfig{AllowTeamRooms: true})
+	room, err := em.CreateRoom(ctx, RoomSettings{Facilitators: []string{"alice"}, Type: entities.RoomTypeTeam}, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roomID := room.ID()
+	alice := Actor{UserName: "alice", Token: "token-alice"}
+	if _, err := em.Join(ctx, roomID, "alice", "", alice.Token, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	// 誰も見積もっていないラウンドは残さない
+	if _, err := em.RevealEstimates(ctx, roomID, alice); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := em.Reset(ctx, roomID, alice); err != nil {
+		t.Fatal(err)
+	}
+	labels := []string{"1", "2", "3"}
+	for _, label := range labels {
+		if _, err := em.SetEstimate(ctx, roomID, "alice", mustPoint(t, label), ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := em.RevealEstimates(ctx, roomID, alice); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := em.Reset(ctx, roomID, alice); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	first, nextAfter, err := em.History(ctx, roomID, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 2 || nextAfter == 0 {
+		t.Fatalf("first page = %d rounds, next %d, want 2 rounds and a cursor", len(first), nextAfter)
+	}
+	second, nextAfter, err := em.History(ctx, roomID, nextAfter, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second) != 1 || nextAfter != 0 {
+		t.Fatalf("second page = %d rounds, next %d, want 1 round and no cursor", len(second), nextAfter)
+	}
+	for _, round := range append(first, second...) {
+		for _, estimate := range round.Estimates {
+			got = append(got, estimate.Point)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(labels) {
+		t.Errorf("history points = %v, want %v", got, labels)
+	}
+}
@@ -59,7 +59,7 @@ document.addEventListener("visibilitychange", () => {
             socket.open()
             // FIXME: openし終わる前に送るとエラーになるので少し待つ
             setTimeout(() => {
-                socket.send(JSON.stringify({type: "join", user_name: nameInput.value.trim()}));
+                sendJoin(nameInput.value.trim());
             }, 100)
         }
     }
@@ -79,7 +79,7 @@ socket.addEventListener('open', (event) => {
     joinButton.addEventListener('click', () => {
         const name = nameInput.value.trim();
         if (name) {
-            socket.send(JSON.stringify({type: 'join', user_name: name}));
+            sendJoin(name);
             renderCards([...fibonacciNumbers, ...specialCards]);
             joinContainer.classList.add("hidden")
             controllerContainer.classList.remove("hidden")
@@ -105,6 +105,7 @@ socket.addEventListener('message', (event) => {
 
     if (data.type === 'joined') {
         // joinedイベントを受け取ったときの処理
+        saveToken(joiningName, data.token);
     } else if (data.type === 'error') {
         // errorイベントを受け取ったときの処理
         showError(data.message);
@@ -116,7 +117,8 @@ socket.addEventListener('message', (event) => {
             historyDateSet.add(data.estimated_at);
         }
     } else if (data.type === 'participants') {
-        if (data.state ==="estimated") {
+        // 公開した後は見積もり結果を表示したままにする
+        if (["revealed", "discussion", "finalized"].includes(data.state)) {
             return;
         }
         participantsContainer.innerHTML = "";
@@ -270,6 +272,26 @@ function showError(message) {
     }, 3000);
 }
 
+// 最後に join した名前。joined で受け取ったトークンをこの名前で保存する
+let joiningName = null;
+
+// 前回受け取ったトークンを付けて join する。トークンがないと同じ名前で入り直せない
+function sendJoin(name) {
+    joiningName = name;
+    socket.send(JSON.stringify({type: 'join', user_name: name, token: getToken(name) || undefined}));
+}
+
+// トークンはルームと名前ごとにlocalStorageに保存する
+function saveToken(name, token) {
+    if (name && token) {
+        localStorage.setItem(`token:${room}:${name}`, token);
+    }
+}
+
+function getToken(name) {
+    return localStorage.getItem(`token:${room}:${name}`);
+}
+
 // 名前をlocalStorageに保存する
 function saveName(name) {
     localStorage.setItem('savedName', name);
@@ -3,10 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/pistatium/planing_poker/internal"
 	"github.com/pistatium/planing_poker/internal/entities"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"log"
 	"log/slog"
 	"net"
@@ -14,7 +22,12 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -22,16 +35,79 @@ type Env struct {
 	Port int `envconfig:"PORT" default:"8080"`
 	// frontの開発サーバーに接続する場合
 	DevelopMode bool `envconfig:"DEVELOP_MODE" default:"false"`
-	Firestore   struct {
-		ProjectID      internal.FirestoreProjectID      `envconfig:"FIRESTORE_PROJECT_ID" required:"true"`
+	// false にすると /api/rooms で作成したルームにしか入れなくなる
+	AllowImplicitRoomCreation bool `envconfig:"ALLOW_IMPLICIT_ROOM_CREATION" default:"true"`
+	// 許可するOrigin。空の場合は同一Originのみ、"*" の場合はすべて許可
+	AllowedOrigins []string `envconfig:"ALLOWED_ORIGINS" default:""`
+	// 手前にあるプロキシの数。X-Forwarded-For の右からこの番目を接続元とみなす。0 の場合はヘッダーを使わない
+	// 直接公開している場合にクライアントが付けたヘッダーを信用しないよう、デフォルトは0。CloudRunなどプロキシが1段の場合は1
+	TrustedProxyHops int `envconfig:"TRUSTED_PROXY_HOPS" default:"0"`
+	// 1メッセージの最大バイト数
+	MaxMessageBytes int64 `envconfig:"MAX_MESSAGE_BYTES" default:"4096"`
+	// 1接続あたりのメッセージ数の上限 (毎秒/バースト)。0以下で無制限
+	ConnMessageRate  float64 `envconfig:"CONN_MESSAGE_RATE" default:"5"`
+	ConnMessageBurst int     `envconfig:"CONN_MESSAGE_BURST" default:"20"`
+	// 接続元IPあたりの接続・メッセージ数の上限 (毎秒/バースト)。0以下で無制限
+	IPMessageRate  float64 `envconfig:"IP_MESSAGE_RATE" default:"20"`
+	IPMessageBurst int     `envconfig:"IP_MESSAGE_BURST" default:"100"`
+	// 参加者ごとのチャットとリアクションの上限 (毎秒/バースト)。0以下で無制限
+	ChatMessageRate  float64 `envconfig:"CHAT_MESSAGE_RATE" default:"1"`
+	ChatMessageBurst int     `envconfig:"CHAT_MESSAGE_BURST" default:"5"`
+	// 1接続あたりの送信待ちメッセージ数の上限。超えたクライアントは切断する。0以下で無制限
+	SendQueueSize int `envconfig:"WS_SEND_QUEUE_SIZE" default:"64"`
+	// 1メッセージの書き込みにかけられる時間。超えたクライアントは切断する
+	WriteTimeout time.Duration `envconfig:"WS_WRITE_TIMEOUT" default:"10s"`
+	// トレースの出力先。"stdout" か "otlp" (OTEL_EXPORTER_OTLP_ENDPOINT に送信)。空の場合は無効
+	TracingExporter internal.TracingExporter `envconfig:"TRACING_EXPORTER" default:""`
+	// SIGTERMを受けてから接続を閉じきるまでの猶予。CloudRunは10秒
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"8s"`
+	// ルームを最後に保存してから残しておく期間。ルームごとに retention で変えられる
+	RoomTTL time.Duration `envconfig:"ROOM_TTL" default:"24h"`
+	// ルームごとに設定できる保存期間の上限。0 にすると永続的なルームも作れる
+	MaxRoomRetention time.Duration `envconfig:"MAX_ROOM_RETENTION" default:"720h"`
+	// 期限切れのルームを掃除する間隔
+	RoomSweepInterval time.Duration `envconfig:"ROOM_SWEEP_INTERVAL" default:"10m"`
+	// false にするとチームルーム (期限切れで削除しないルーム) を作れなくなる
+	AllowTeamRooms bool `envconfig:"ALLOW_TEAM_ROOMS" default:"true"`
+	// ルームの保存先。"firestore"、"bolt" (ローカルのファイル)、"redis"、"memory" (再起動で消える)
+	Storage   internal.StorageBackend `envconfig:"STORAGE" default:"firestore"`
+	Firestore struct {
+		// STORAGE=firestore の場合は必須
+		ProjectID      internal.FirestoreProjectID      `envconfig:"FIRESTORE_PROJECT_ID"`
 		DatabaseName   internal.FirestoreDatabaseName   `envconfig:"FIRESTORE_DATABASE_NAME" default:""`
 		CollectionName internal.FirestoreCollectionName `envconfig:"FIRESTORE_ROOM_COLLECTION_NAME" default:"planing_poker_rooms"`
 	}
+	Bolt struct {
+		Path internal.BoltPath `envconfig:"BOLT_PATH" default:"planning_poker.db"`
+	}
+	Redis struct {
+		Addr      string                  `envconfig:"REDIS_ADDR" default:"localhost:6379"`
+		Password  string                  `envconfig:"REDIS_PASSWORD" default:""`
+		DB        int                     `envconfig:"REDIS_DB" default:"0"`
+		KeyPrefix internal.RedisKeyPrefix `envconfig:"REDIS_KEY_PREFIX" default:"planning_poker:"`
+	}
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+func newUpgrader(allowedOrigins []string) websocket.Upgrader {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+	}
+	if len(allowedOrigins) == 0 {
+		// CheckOrigin が nil の場合は同一Originのみ許可される
+		return upgrader
+	}
+	upgrader.CheckOrigin = func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		for _, allowed := range allowedOrigins {
+			if allowed == "*" || strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+		slog.Warn("origin not allowed", slog.String("origin", origin))
+		return false
+	}
+	return upgrader
 }
 
 func main() {
@@ -43,11 +119,21 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to parse environment variables: %v", err)
 	}
-	roomRepository := internal.NewFirestoreRoomRepository(env.Firestore.ProjectID, env.Firestore.CollectionName, env.Firestore.DatabaseName)
-	server := &Server{
-		eventManager: internal.NewEventManager(roomRepository),
+	shutdownTracing, err := internal.SetupTracing(context.Background(), env.TracingExporter, "planning_poker")
+	if err != nil {
+		log.Fatalf("Failed to setup tracing: %v", err)
+	}
+	roomRepository, err := newRoomRepository(env)
+	if err != nil {
+		log.Fatalf("Failed to setup storage: %v", err)
 	}
-	http.HandleFunc("/ws", server.wsHandler)
+	eventManager := internal.NewEventManager(roomRepository, internal.EventManagerConfig{
+		AllowImplicitRoomCreation: env.AllowImplicitRoomCreation,
+		MaxRoomRetention:          env.MaxRoomRetention,
+		AllowTeamRooms:            env.AllowTeamRooms,
+	})
+	server := NewServer(eventManager, env)
+	server.Routes(http.DefaultServeMux)
 
 	if env.DevelopMode {
 		// localhost:9000 にすべてのパスをreverse proxyする
@@ -61,90 +147,326 @@ func main() {
 		http.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir("public"))))
 
 	}
-	slog.Info("server started", slog.Any("port", env.Port))
-	log.Fatal(http.ListenAndServe(net.JoinHostPort("", strconv.Itoa(env.Port)), nil))
+	httpServer := &http.Server{Addr: net.JoinHostPort("", strconv.Itoa(env.Port))}
+	go func() {
+		slog.Info("server started", slog.Any("port", env.Port))
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// CloudRunはインスタンス停止前にSIGTERMを送ってくる
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go eventManager.RunSweeper(ctx, env.RoomSweepInterval)
+	<-ctx.Done()
+	slog.Info("shutting down", slog.Duration("timeout", env.ShutdownTimeout))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), env.ShutdownTimeout)
+	defer cancel()
+	server.Shutdown(shutdownCtx, httpServer)
+	if err := shutdownTracing(context.WithoutCancel(shutdownCtx)); err != nil {
+		slog.Error("tracing shutdown error:", slog.Any("error", err))
+	}
+}
+
+// newRoomRepository STORAGE で指定された保存先のリポジトリを作る
+func newRoomRepository(env Env) (internal.RoomRepository, error) {
+	switch env.Storage {
+	case internal.StorageFirestore:
+		if env.Firestore.ProjectID == "" {
+			return nil, fmt.Errorf("FIRESTORE_PROJECT_ID is required for STORAGE=%s", env.Storage)
+		}
+		return internal.NewFirestoreRoomRepository(env.Firestore.ProjectID, env.Firestore.CollectionName, env.Firestore.DatabaseName, env.RoomTTL), nil
+	case internal.StorageBolt:
+		return internal.NewBoltRoomRepository(env.Bolt.Path, env.RoomTTL)
+	case internal.StorageRedis:
+		return internal.NewRedisRoomRepository(&redis.Options{
+			Addr:     env.Redis.Addr,
+			Password: env.Redis.Password,
+			DB:       env.Redis.DB,
+		}, env.Redis.KeyPrefix, env.RoomTTL), nil
+	case internal.StorageMemory:
+		return internal.NewMemoryRoomRepository(env.RoomTTL), nil
+	default:
+		return nil, fmt.Errorf("unknown storage: %q", env.Storage)
+	}
 }
 
 type Message struct {
 	Type       string `json:"type"`
 	UserName   string `json:"user_name"`
 	PointLabel string `json:"point"`
+	Passcode   string `json:"passcode,omitempty"`
+	// 前回の join で受け取ったトークン。同じ名前で入り直すときに必要
+	Token string `json:"token,omitempty"`
+	// kick / remove_member / set_role の対象の参加者
+	Target string `json:"target,omitempty"`
+	// set_role で設定する役割
+	Role string `json:"role,omitempty"`
+	// set_deck で設定するカード
+	Deck []string `json:"deck,omitempty"`
+	// estimate に添える理由
+	Rationale string `json:"rationale,omitempty"`
+	// chat の本文
+	Text string `json:"text,omitempty"`
+	// react で送る絵文字
+	Reaction string `json:"reaction,omitempty"`
+	// set_anonymous で設定する値
+	Anonymous bool `json:"anonymous,omitempty"`
+	// history で、この番号より後に公開したラウンドから返す。前の history の next_after
+	After int64 `json:"after,omitempty"`
+	// W3C Trace Context。メッセージ単位でトレースを繋げたい場合に指定
+	TraceParent string `json:"traceparent,omitempty"`
 }
 
 type Server struct {
 	eventManager *internal.EventManager
+	// シャットダウン中は新しい接続を受け付けない
+	draining   atomic.Bool
+	shutdownCh chan struct{}
+	// 接続中のWebSocket
+	connections      sync.WaitGroup
+	upgrader         websocket.Upgrader
+	trustedProxyHops int
+	maxMessageBytes  int64
+	connMessageRate  float64
+	connMessageBurst int
+	ipLimiter        *internal.KeyedRateLimiter
+	// ルームと参加者ごと。再接続しても引き継ぐ
+	chatLimiter   *internal.KeyedRateLimiter
+	sendQueueSize int
+	writeTimeout  time.Duration
+	// 配信ごとに送れた接続の数
+	fanout *fanoutCounter
 }
 
 type RepsEstimate struct {
-	UserName   string `json:"user_name"`
+	// 匿名のルームでは空
+	UserName   string `json:"user_name,omitempty"`
 	PointLabel string `json:"point"`
+	Rationale  string `json:"rationale,omitempty"`
+	// このラウンドでカードを変えた回数
+	Changes int `json:"changes"`
 }
 
 type Response struct {
 	Type    string `json:"type"`
 	Message string `json:"message"`
+	// エラー時にクライアントが種別を判別するためのコード
+	Code string `json:"code,omitempty"`
 }
 
 type EstimatesResponse struct {
 	Response
-	Estimates   []RepsEstimate `json:"estimates"`
-	EstimatedAt time.Time      `json:"estimated_at"`
+	// 匿名のルームでは名前を含めず、カードの順に並べる
+	Estimates   []RepsEstimate         `json:"estimates"`
+	Stats       entities.EstimateStats `json:"stats"`
+	Anonymous   bool                   `json:"anonymous,omitempty"`
+	EstimatedAt time.Time              `json:"estimated_at"`
+	// 今のストーリーで何回目の見積もりか。1から
+	Round int `json:"round"`
+	// revote する前に公開したラウンド。古い順
+	PreviousRounds []*entities.Round `json:"previous_rounds"`
 }
 
 type RespParticipant struct {
 	UserName    string `json:"user_name"`
 	IsEstimated bool   `json:"is_estimated"`
+	// チームルームで退出中のメンバー
+	Offline    bool       `json:"offline,omitempty"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
 }
 type ParticipantResponse struct {
 	Response
 	Participants []RespParticipant `json:"participants"`
 	State        entities.State    `json:"state"`
+	RoomType     entities.RoomType `json:"room_type,omitempty"`
+	Anonymous    bool              `json:"anonymous,omitempty"`
+	// 今のストーリーで何回目の見積もりか。1から
+	Round int `json:"round,omitempty"`
+}
+
+// JoinedResponse token は名前を結びつけたトークン。再接続したときの join に付ける
+type JoinedResponse struct {
+	Response
+	Token string `json:"token"`
+}
+
+type AuditResponse struct {
+	Response
+	Entries []entities.AuditEntry `json:"entries"`
+}
+
+// ChatResponse chat は新しい発言とリアクション、chat_history はルームに残っているすべて
+type ChatResponse struct {
+	Response
+	Messages []entities.ChatMessage `json:"messages"`
+}
+
+type HistoryResponse struct {
+	Response
+	Rounds []*entities.Round `json:"rounds"`
+	// 続きがある場合に次の history の after に渡す
+	NextAfter int64 `json:"next_after,omitempty"`
+}
+
+// historyPageSize history で一度に返すラウンドの数
+const historyPageSize = 50
+
+func NewServer(eventManager *internal.EventManager, env Env) *Server {
+	return &Server{
+		eventManager:     eventManager,
+		upgrader:         newUpgrader(env.AllowedOrigins),
+		trustedProxyHops: env.TrustedProxyHops,
+		maxMessageBytes:  env.MaxMessageBytes,
+		connMessageRate:  env.ConnMessageRate,
+		connMessageBurst: env.ConnMessageBurst,
+		ipLimiter:        internal.NewKeyedRateLimiter(env.IPMessageRate, env.IPMessageBurst),
+		chatLimiter:      internal.NewKeyedRateLimiter(env.ChatMessageRate, env.ChatMessageBurst),
+		sendQueueSize:    env.SendQueueSize,
+		writeTimeout:     env.WriteTimeout,
+		shutdownCh:       make(chan struct{}),
+		fanout:           newFanoutCounter(defaultFanoutWindow),
+	}
+}
+
+// Routes 静的ファイル以外のハンドラを登録する
+func (s *Server) Routes(mux *http.ServeMux) {
+	mux.HandleFunc("/ws", s.wsHandler)
+	mux.HandleFunc("/healthz", s.healthzHandler)
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	mux.HandleFunc("/api/rooms", s.createRoomHandler)
+	mux.HandleFunc("/api/rooms/", s.roomResourceHandler)
+	mux.Handle("/metrics", promhttp.Handler())
+}
+
+// wsConn メッセージの送信に使う *websocket.Conn のメソッド
+type wsConn interface {
+	WriteJSON(v interface{}) error
+	RemoteAddr() net.Addr
+}
+
+// session 1つのWebSocket接続の状態
+type session struct {
+	roomID string
+	// join に成功した名前とトークン。名前はこの接続にだけ結びつく
+	userName   string
+	token      string
+	clientAddr string
+	// join したときのルームのイベント番号。これより古いルームの変更では参加状態を判断しない
+	joinedSeq int64
+	// パスコードの検証が済んでいるか。済むまではルームの状態を送らない
+	authorized bool
+	// 保護されたルームとしてパスコードを検証したか
+	// 未保護のときに認証した接続は、ルームが保護されたら認証し直す
+	passcodeVerified bool
+	// 招待URLで渡されたパスコード。join で省略された場合に使う
+	invitePasscode string
+	// 送信済みのチャットの番号。これより後の発言をルームの変更と一緒に送る
+	chatSeq int64
+}
+
+// actor 監査ログに残す操作者
+func (sess *session) actor() internal.Actor {
+	return internal.Actor{UserName: sess.userName, Token: sess.token, ClientAddr: sess.clientAddr}
 }
 
 func (s *Server) wsHandler(w http.ResponseWriter, r *http.Request) {
 
 	// parameterからroomIDを取得
-	roomID := r.URL.Query().Get("room")
-	if roomID == "" {
-		slog.Error("roomID is empty")
+	roomID, err := entities.NormalizeRoomID(r.URL.Query().Get("room"))
+	if err != nil {
+		slog.Warn("invalid roomID", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	slog.Info("roomID", slog.String("roomID", roomID))
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// Shutdown が Wait を始めた後に数えることがないよう、数えてから draining を確かめる
+	s.connections.Add(1)
+	defer s.connections.Done()
+	if s.draining.Load() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	addr := s.clientAddr(r)
+	if !s.ipLimiter.Allow(addr) {
+		slog.Warn("connection rate limited", slog.String("remote_addr", addr))
+		http.Error(w, internal.RateLimitedError.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		slog.Error("upgrade error:", slog.Any("error", err))
 		return
 	}
 	defer conn.Close()
+	internal.ActiveConnections.Inc()
+	defer internal.ActiveConnections.Dec()
+	if s.maxMessageBytes > 0 {
+		// 超えた場合は ReadMessage がエラーを返し、1009 で切断される
+		conn.SetReadLimit(s.maxMessageBytes)
+	}
+	// 書き込みは writer の goroutine だけが行う
+	writer := newConnWriter(conn, s.sendQueueSize, s.writeTimeout)
+	go writer.run()
+	defer writer.Stop()
+
+	sess := &session{
+		roomID:         roomID,
+		clientAddr:     addr,
+		invitePasscode: r.URL.Query().Get("passcode"),
+	}
+	// ハンドシェイクのヘッダーにトレースコンテキストがあれば、この接続のメッセージをすべてそのトレースに繋げる
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	connLimiter := internal.NewRateLimiter(s.connMessageRate, s.connMessageBurst)
+	// 招待URLにパスコードが含まれていればその場で検証する
+	// 含まれていなければ join のパスコードで検証する
+	if room, authErr := s.eventManager.Authorize(ctx, roomID, sess.invitePasscode, sess.clientAddr); authErr == nil {
+		sess.authorized = true
+		sess.passcodeVerified = room != nil && room.IsProtected()
+		if room != nil {
+			// 接続前の発言は chat_history で取得する
+			sess.chatSeq = room.LastChatSeq()
+		}
+	} else {
+		sendError(writer, authErr)
+	}
 
 	// ソケットメッセージのストリームを生成
 	messageStream := make(chan []byte)
-	var userName string
+	handlerDone := make(chan struct{})
+	defer close(handlerDone)
 	go func() {
 		defer close(messageStream)
 		for {
 			_, message, err := conn.ReadMessage()
 			slog.Info("connected", slog.String("remote_addr", conn.RemoteAddr().String()))
 			// コネクション切断など
+			if errors.Is(err, websocket.ErrReadLimit) {
+				// 1009 (message too big) で切断済み
+				slog.Warn("message too large",
+					slog.Int64("limit", s.maxMessageBytes),
+					slog.String("remote_addr", conn.RemoteAddr().String()),
+				)
+			}
 			if err != nil {
-				if userName != "" {
-					_, leaveErr := s.eventManager.Leave(r.Context(), roomID, userName)
-					if leaveErr != nil {
-						slog.Error("leave error:", slog.Any("error", err))
-					}
-				}
 				slog.Error("read error:",
 					slog.Any("error", err),
 					slog.String("remote_addr", conn.RemoteAddr().String()),
 				)
 				break
 			}
-			messageStream <- message
+			select {
+			case messageStream <- message:
+			case <-handlerDone:
+				return
+			}
 		}
 	}()
 	// ルームの変更を監視するストリームを生成
-	roomEventStream := s.eventManager.RoomChangedStream(r.Context(), roomID)
+	roomEventStream := s.eventManager.RoomChangedStream(ctx, roomID)
 	now := time.Now()
 	lastRevealed := &now
 	if err != nil {
@@ -153,28 +475,68 @@ func (s *Server) wsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	for {
 		select {
-		case <-r.Context().Done():
+		case <-ctx.Done():
+			return
+		case <-s.shutdownCh:
+			sendRestarting(writer)
 			return
 		case message, ok := <-messageStream:
+			// コネクション切断など
 			if !ok {
+				// シャットダウンによる切断では退出させず、再接続後もそのまま続けられるようにする
+				if sess.userName != "" && !s.draining.Load() {
+					if _, err := s.eventManager.Leave(ctx, roomID, sess.userName); err != nil {
+						slog.Error("leave error:", slog.Any("error", err))
+					}
+				}
+				return
+			}
+			if !connLimiter.Allow() || !s.ipLimiter.Allow(sess.clientAddr) {
+				closeWithError(writer, websocket.ClosePolicyViolation, internal.RateLimitedError)
 				return
 			}
-			userName = s.handleWsMessage(r.Context(), conn, roomID, message)
+			s.handleWsMessage(ctx, writer, sess, message)
 		case room, ok := <-roomEventStream:
 			if !ok {
 				return
 			}
-			sendParticipants(conn, room)
-			if lastRevealed != room.LastRevealedAt() && room.State() == entities.StateEstimated {
-				sendEstimates(conn, room)
-				lastRevealed = room.LastRevealedAt()
+			if !sess.authorized {
+				continue
+			}
+			if room.IsProtected() && !sess.passcodeVerified {
+				if _, err := s.eventManager.Authorize(ctx, roomID, sess.invitePasscode, sess.clientAddr); err != nil {
+					sess.authorized = false
+					sendError(writer, err)
+					continue
+				}
+				sess.passcodeVerified = true
+			}
+			// kick や remove_member で外された接続は、join し直すまでその名前で操作できない
+			if sess.userName != "" && room.Seq() > sess.joinedSeq && !room.HasParticipant(sess.userName) {
+				slog.Info("session user removed", slog.String("user_name", sess.userName), slog.String("remote_addr", sess.clientAddr))
+				sess.userName = ""
+				sess.token = ""
+			}
+			if sendParticipants(ctx, writer, room) == nil {
+				s.fanout.written(room.ID(), room.Seq(), "participants")
+			}
+			if messages := room.ChatMessages(sess.chatSeq); len(messages) > 0 {
+				sendChat(writer, "chat", messages)
+				sess.chatSeq = messages[len(messages)-1].Seq
+			}
+			// リポジトリによっては毎回新しい Room を返すので、ポインタではなく時刻で比較する
+			if revealedAt := room.LastRevealedAt(); revealedAt != nil && !revealedAt.Equal(*lastRevealed) && room.State().Revealed() {
+				if sendEstimates(ctx, writer, room) == nil {
+					s.fanout.written(room.ID(), room.Seq(), "estimates")
+				}
+				lastRevealed = revealedAt
 			}
 		}
 
 	}
 }
 
-func (s *Server) handleWsMessage(ctx context.Context, conn *websocket.Conn, roomID string, message []byte) (userName string) {
+func (s *Server) handleWsMessage(ctx context.Context, conn wsConn, sess *session, message []byte) {
 	var m Message
 	err := json.Unmarshal(message, &m)
 	if err != nil {
@@ -186,9 +548,40 @@ func (s *Server) handleWsMessage(ctx context.Context, conn *websocket.Conn, room
 		sendError(conn, err)
 		return
 	}
+	// クライアントが traceparent を付けていればそのトレースに繋げる
+	if m.TraceParent != "" {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier{"traceparent": m.TraceParent})
+	}
+	ctx, span := internal.Tracer().Start(ctx, "ws.message "+messageTypeLabel(m.Type), trace.WithAttributes(
+		attribute.String("message.type", m.Type),
+		attribute.String("room.id", sess.roomID),
+	), trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
 	var logBody map[string]interface{}
 	json.Unmarshal(message, &logBody)
+	internal.MessagesReceived.WithLabelValues(messageTypeLabel(m.Type)).Inc()
+	// パスコードとトークンはログに残さない
+	delete(logBody, "passcode")
+	delete(logBody, "token")
+	// 匿名のルームかはまだ分からないので、接続元とカードの組み合わせは常に残さない。値はイベントに記録される
+	if m.Type == "estimate" {
+		delete(logBody, "point")
+		delete(logBody, "rationale")
+	}
 	slog.Info("-> received", slog.Any("message", logBody), slog.String("remote_addr", conn.RemoteAddr().String()))
+	roomID := sess.roomID
+	if m.UserName != "" {
+		m.UserName, err = entities.NormalizeUserName(m.UserName)
+		if err != nil {
+			sendError(conn, err)
+			return
+		}
+	}
+	// join 以外は認証済みの接続のみ受け付ける
+	if !sess.authorized && m.Type != "join" {
+		sendError(conn, entities.PasscodeRequiredError)
+		return
+	}
 	switch m.Type {
 	case "get":
 		{
@@ -197,76 +590,408 @@ func (s *Server) handleWsMessage(ctx context.Context, conn *websocket.Conn, room
 				sendError(conn, err)
 				return
 			}
-			sendParticipants(conn, room)
+			sendParticipants(ctx, conn, room)
 		}
 
 	case "join":
 		{
-			room, err := s.eventManager.Join(ctx, roomID, m.UserName)
+			passcode := m.Passcode
+			if passcode == "" {
+				passcode = sess.invitePasscode
+			}
+			token := m.Token
+			if token == "" {
+				token, err = entities.GenerateParticipantToken()
+				if err != nil {
+					sendError(conn, err)
+					return
+				}
+			}
+			room, err := s.eventManager.Join(ctx, roomID, m.UserName, passcode, token, sess.clientAddr)
+			if err != nil {
+				sendError(conn, err)
+				return
+			}
+			if !sess.authorized {
+				sess.chatSeq = room.LastChatSeq()
+			}
+			sess.authorized = true
+			sess.passcodeVerified = room.IsProtected()
+			sess.userName = m.UserName
+			sess.token = token
+			sess.joinedSeq = room.Seq()
+			sendJoinStatus(conn, token)
+			sendParticipants(ctx, conn, room)
+		}
+	case "leave":
+		{
+			if sess.userName == "" {
+				sendError(conn, entities.UserNotFoundError)
+				return
+			}
+			room, err := s.eventManager.Quit(ctx, roomID, sess.actor())
 			if err != nil {
 				sendError(conn, err)
+				return
 			}
-			sendJoinStatus(conn)
-			sendParticipants(conn, room)
+			// 退出した接続は切断しても Leave し直さない
+			sess.userName = ""
+			sess.token = ""
+			sendParticipants(ctx, conn, room)
 		}
 	case "estimate":
 		{
+			// 名前は join した接続のものを使う
+			if sess.userName == "" {
+				sendError(conn, entities.UserNotFoundError)
+				return
+			}
 			point, err := entities.NewPoint(m.PointLabel)
 			if err != nil {
 				sendError(conn, err)
 				return
 			}
-			room, err := s.eventManager.SetEstimate(ctx, roomID, m.UserName, point)
+			room, err := s.eventManager.SetEstimate(ctx, roomID, sess.userName, point, m.Rationale)
 			if err != nil {
 				sendError(conn, err)
 				return
 			}
-			sendParticipants(conn, room)
+			sendParticipants(ctx, conn, room)
 		}
 	case "reset":
 		{
-			room, err := s.eventManager.Reset(ctx, roomID)
+			room, err := s.eventManager.Reset(ctx, roomID, sess.actor())
 			if err != nil {
 				sendError(conn, err)
 				return
 			}
-			sendParticipants(conn, room)
+			sendParticipants(ctx, conn, room)
 
 		}
+	case "lock", "unlock":
+		{
+			lock := s.eventManager.LockVotes
+			if m.Type == "unlock" {
+				lock = s.eventManager.UnlockVotes
+			}
+			room, err := lock(ctx, roomID, sess.actor())
+			if err != nil {
+				sendError(conn, err)
+				return
+			}
+			sendParticipants(ctx, conn, room)
+		}
+	case "discuss", "finalize":
+		{
+			next := s.eventManager.StartDiscussion
+			if m.Type == "finalize" {
+				next = s.eventManager.Finalize
+			}
+			room, err := next(ctx, roomID, sess.actor())
+			if err != nil {
+				sendError(conn, err)
+				return
+			}
+			sendParticipants(ctx, conn, room)
+		}
+	case "revote":
+		{
+			room, err := s.eventManager.Revote(ctx, roomID, sess.actor())
+			if err != nil {
+				sendError(conn, err)
+				return
+			}
+			sendParticipants(ctx, conn, room)
+		}
 	case "reveal":
 		{
-			room, err := s.eventManager.RevealEstimates(ctx, roomID)
+			room, err := s.eventManager.RevealEstimates(ctx, roomID, sess.actor())
+			if err != nil {
+				sendError(conn, err)
+				return
+			}
+			sendEstimates(ctx, conn, room)
+		}
+	case "history":
+		{
+			rounds, nextAfter, err := s.eventManager.History(ctx, roomID, m.After, historyPageSize)
 			if err != nil {
 				sendError(conn, err)
 				return
 			}
-			sendEstimates(conn, room)
+			sendHistory(conn, rounds, nextAfter)
 		}
+	case "remove_member":
+		{
+			room, err := s.eventManager.RemoveMember(ctx, roomID, sess.actor(), m.Target)
+			if err != nil {
+				sendError(conn, err)
+				return
+			}
+			sendParticipants(ctx, conn, room)
+		}
+	case "kick":
+		{
+			room, err := s.eventManager.Kick(ctx, roomID, sess.actor(), m.Target)
+			if err != nil {
+				sendError(conn, err)
+				return
+			}
+			sendParticipants(ctx, conn, room)
+		}
+	case "set_role":
+		{
+			room, err := s.eventManager.SetRole(ctx, roomID, sess.actor(), m.Target, entities.Role(m.Role))
+			if err != nil {
+				sendError(conn, err)
+				return
+			}
+			sendParticipants(ctx, conn, room)
+		}
+	case "set_deck":
+		{
+			room, err := s.eventManager.SetDeck(ctx, roomID, sess.actor(), m.Deck)
+			if err != nil {
+				sendError(conn, err)
+				return
+			}
+			sendParticipants(ctx, conn, room)
+		}
+	case "set_anonymous":
+		{
+			room, err := s.eventManager.SetAnonymous(ctx, roomID, sess.actor(), m.Anonymous)
+			if err != nil {
+				sendError(conn, err)
+				return
+			}
+			sendParticipants(ctx, conn, room)
+		}
+	case "chat", "react":
+		{
+			if sess.userName == "" {
+				sendError(conn, entities.UserNotFoundError)
+				return
+			}
+			// 発言は全員に流れるので、参加者ごとにメッセージ数とは別に制限する
+			if !s.chatLimiter.Allow(roomID + "|" + sess.userName) {
+				sendError(conn, internal.RateLimitedError)
+				return
+			}
+			var err error
+			if m.Type == "chat" {
+				_, err = s.eventManager.PostChat(ctx, roomID, sess.userName, m.Text)
+			} else {
+				_, err = s.eventManager.React(ctx, roomID, sess.userName, m.Reaction)
+			}
+			// 送った本人にもルームの変更として届く
+			if err != nil {
+				sendError(conn, err)
+				return
+			}
+		}
+	case "chat_history":
+		{
+			room, err := s.eventManager.Get(ctx, roomID)
+			if err != nil {
+				sendError(conn, err)
+				return
+			}
+			sendChat(conn, "chat_history", room.ChatMessages(0))
+		}
+	case "audit":
+		{
+			entries, err := s.eventManager.AuditLog(ctx, roomID, sess.actor())
+			if err != nil {
+				sendError(conn, err)
+				return
+			}
+			sendAudit(conn, entries)
+		}
+	}
+}
+
+// messageTypeLabel 任意の文字列でラベルが増えないように既知の種別に丸める
+func messageTypeLabel(messageType string) string {
+	switch messageType {
+	case "get", "join", "leave", "estimate", "reset", "reveal", "revote", "lock", "unlock", "discuss", "finalize", "history", "remove_member", "kick", "set_role", "set_deck", "set_anonymous", "audit", "chat", "react", "chat_history":
+		return messageType
+	default:
+		return "unknown"
 	}
-	return m.UserName
 }
 
-func sendError(conn *websocket.Conn, err error) {
+// errorCode クライアントに返すエラー種別
+func errorCode(err error) string {
+	var validationErr *entities.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		return "invalid_" + validationErr.Field
+	case errors.Is(err, entities.UserNameConflictError):
+		return "user_name_conflict"
+	case errors.Is(err, entities.UserNameTakenError):
+		return "user_name_taken"
+	case errors.Is(err, entities.InvalidTokenError):
+		return "invalid_token"
+	case errors.Is(err, entities.PasscodeRequiredError):
+		return "passcode_required"
+	case errors.Is(err, entities.InvalidPasscodeError):
+		return "invalid_passcode"
+	case errors.Is(err, internal.TooManyAttemptsError):
+		return "too_many_attempts"
+	case errors.Is(err, internal.RateLimitedError):
+		return "rate_limited"
+	case errors.Is(err, internal.RoomNotFoundError):
+		return "room_not_found"
+	case errors.Is(err, entities.PermissionDeniedError):
+		return "permission_denied"
+	case errors.Is(err, entities.InvalidPointError):
+		return "invalid_point"
+	case errors.Is(err, entities.PointNotInDeckError):
+		return "point_not_in_deck"
+	case errors.Is(err, entities.InvalidRoleError):
+		return "invalid_role"
+	case errors.Is(err, entities.InvalidRetentionError):
+		return "invalid_retention"
+	case errors.Is(err, entities.InvalidRoomTypeError):
+		return "invalid_room_type"
+	case errors.Is(err, entities.UserNotFoundError):
+		return "user_not_found"
+	case errors.Is(err, entities.AnonymityLockedError):
+		return "anonymity_locked"
+	case errors.Is(err, entities.VotesLockedError):
+		return "votes_locked"
+	case errors.Is(err, entities.InvalidStateError):
+		return "invalid_state"
+	case errors.Is(err, entities.NotRevealedError):
+		return "not_revealed"
+	case errors.Is(err, entities.TooManyRoundsError):
+		return "too_many_rounds"
+	default:
+		return ""
+	}
+}
+
+// clientAddr 接続元のIPアドレス。CloudRunではプロキシ経由になるので X-Forwarded-For を優先する
+// 左側はクライアントが自由に書けるので、信頼できるプロキシが追加した右側の値を使う
+func (s *Server) clientAddr(r *http.Request) string {
+	if s.trustedProxyHops > 0 {
+		var forwarded []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			forwarded = append(forwarded, strings.Split(header, ",")...)
+		}
+		if i := len(forwarded) - s.trustedProxyHops; i >= 0 {
+			if addr := strings.TrimSpace(forwarded[i]); addr != "" {
+				return addr
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func sendError(conn wsConn, err error) {
 	slog.Error("<- error:",
 		slog.Any("error", err),
 		slog.String("remote_addr", conn.RemoteAddr().String()),
 	)
+	code := errorCode(err)
+	if code == "" {
+		internal.Errors.WithLabelValues("internal").Inc()
+	} else {
+		internal.Errors.WithLabelValues(code).Inc()
+	}
 	err = conn.WriteJSON(&Response{
 		Type:    "error",
 		Message: err.Error(),
+		Code:    code,
 	})
 	if err != nil {
 		slog.Error("write error:", slog.Any("error", err))
 	}
 }
 
-func sendEstimates(conn *websocket.Conn, room *entities.Room) {
-	var estimates = make([]RepsEstimate, 0, len(room.Estimates()))
-	for _, e := range room.Estimates() {
-		estimates = append(estimates, RepsEstimate{
-			UserName:   e.User.Name,
+// Shutdown 新しい接続を止め、接続中のクライアントに再接続を促してから、未保存のルームを書き込む
+func (s *Server) Shutdown(ctx context.Context, httpServer *http.Server) {
+	s.draining.Store(true)
+	close(s.shutdownCh)
+	// Hijack済みのWebSocketは http.Server.Shutdown では待たれないので別に待つ
+	if err := httpServer.Shutdown(ctx); err != nil {
+		slog.Error("http shutdown error:", slog.Any("error", err))
+	}
+	drained := make(chan struct{})
+	go func() {
+		s.connections.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		slog.Info("all connections drained")
+	case <-ctx.Done():
+		slog.Warn("shutdown deadline exceeded before all connections drained")
+	}
+	// 接続待ちでデッドラインを使い切っても書き込みはする
+	flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 2*time.Second)
+	defer cancel()
+	if err := s.eventManager.Flush(flushCtx); err != nil {
+		slog.Error("flush error:", slog.Any("error", err))
+	}
+	if err := s.eventManager.Close(); err != nil {
+		slog.Error("repository close error:", slog.Any("error", err))
+	}
+}
+
+// sendRestarting 再接続を促して切断する
+func sendRestarting(conn *connWriter) {
+	slog.Info("<- restarting", slog.String("remote_addr", conn.RemoteAddr().String()))
+	err := conn.WriteJSON(&Response{
+		Type:    "restarting",
+		Message: "server restarting, reconnect",
+	})
+	if err != nil {
+		slog.Error("write error:", slog.Any("error", err))
+	}
+	conn.Close(websocket.CloseServiceRestart, "server restarting")
+}
+
+// closeWithError エラーを通知してから切断する
+func closeWithError(conn *connWriter, closeCode int, err error) {
+	sendError(conn, err)
+	conn.Close(closeCode, err.Error())
+}
+
+// revealedEstimates 公開する見積もり。匿名のルームでは名前を伏せてカードの順に並べる
+func revealedEstimates(room *entities.Room) ([]RepsEstimate, entities.EstimateStats) {
+	anonymous := room.Anonymous()
+	source := room.Estimates()
+	if anonymous {
+		source = room.SortedEstimates()
+	}
+	estimates := make([]RepsEstimate, 0, len(source))
+	points := make([]*entities.Point, 0, len(source))
+	for _, e := range source {
+		estimate := RepsEstimate{
 			PointLabel: e.Point.Label(),
-		})
+			Rationale:  e.Rationale,
+			Changes:    e.Changes,
+		}
+		if !anonymous {
+			estimate.UserName = e.User.Name
+		}
+		estimates = append(estimates, estimate)
+		points = append(points, e.Point)
+	}
+	return estimates, entities.Summarize(points)
+}
+
+// sendEstimates 送れなかった場合はエラーを返す
+func sendEstimates(ctx context.Context, conn wsConn, room *entities.Room) error {
+	estimates, stats := revealedEstimates(room)
+	previousRounds := room.StoryRounds()
+	if previousRounds == nil {
+		previousRounds = []*entities.Round{}
 	}
 	slog.Info("<- estimates",
 		slog.Any("estimates", estimates),
@@ -274,19 +999,30 @@ func sendEstimates(conn *websocket.Conn, room *entities.Room) {
 		slog.String("remote_addr", conn.RemoteAddr().String()),
 	)
 
+	_, span := internal.Tracer().Start(ctx, "ws.send estimates", trace.WithAttributes(
+		attribute.String("room.id", room.ID()),
+		attribute.Int("estimates", len(estimates)),
+	))
+	defer span.End()
 	err := conn.WriteJSON(&EstimatesResponse{
 		Response: Response{
 			Type: "estimates",
 		},
-		Estimates:   estimates,
-		EstimatedAt: *room.LastRevealedAt(),
+		Estimates:      estimates,
+		Stats:          stats,
+		Anonymous:      room.Anonymous(),
+		EstimatedAt:    *room.LastRevealedAt(),
+		Round:          room.Round(),
+		PreviousRounds: previousRounds,
 	})
 	if err != nil {
 		sendError(conn, err)
 	}
+	return err
 }
 
-func sendParticipants(conn *websocket.Conn, room *entities.Room) {
+// sendParticipants 送れなかった場合はエラーを返す
+func sendParticipants(ctx context.Context, conn wsConn, room *entities.Room) error {
 	var participants []RespParticipant
 	for _, e := range room.Estimates() {
 		participants = append(participants, RespParticipant{
@@ -294,29 +1030,100 @@ func sendParticipants(conn *websocket.Conn, room *entities.Room) {
 			IsEstimated: e.Point != &entities.PointNotSet,
 		})
 	}
+	for _, m := range room.OfflineMembers() {
+		lastSeenAt := m.LastSeenAt
+		participants = append(participants, RespParticipant{
+			UserName:   m.Name,
+			Offline:    true,
+			LastSeenAt: &lastSeenAt,
+		})
+	}
 	slog.Info("<- participants",
 		slog.Any("participants", participants),
 		slog.String("state", string(room.State())),
 		slog.String("remote_addr", conn.RemoteAddr().String()),
 	)
+	_, span := internal.Tracer().Start(ctx, "ws.send participants", trace.WithAttributes(
+		attribute.String("room.id", room.ID()),
+		attribute.Int("participants", len(participants)),
+	))
+	defer span.End()
 	err := conn.WriteJSON(&ParticipantResponse{
 		Response: Response{
 			Type: "participants",
 		},
 		Participants: participants,
 		State:        room.State(),
+		RoomType:     room.Type(),
+		Anonymous:    room.Anonymous(),
+		Round:        room.Round(),
 	})
 	if err != nil {
 		sendError(conn, err)
 	}
+	return err
 }
 
-func sendJoinStatus(conn *websocket.Conn) {
+// sendAudit 進行役に監査ログを送る
+func sendAudit(conn wsConn, entries []entities.AuditEntry) {
+	slog.Info("<- audit",
+		slog.Int("entries", len(entries)),
+		slog.String("remote_addr", conn.RemoteAddr().String()),
+	)
+	err := conn.WriteJSON(&AuditResponse{
+		Response: Response{
+			Type: "audit",
+		},
+		Entries: entries,
+	})
+	if err != nil {
+		sendError(conn, err)
+	}
+}
+
+// sendChat チャットの発言とリアクションを送る。messageType は chat か chat_history
+func sendChat(conn wsConn, messageType string, messages []entities.ChatMessage) {
+	slog.Info("<- "+messageType,
+		slog.Int("messages", len(messages)),
+		slog.String("remote_addr", conn.RemoteAddr().String()),
+	)
+	err := conn.WriteJSON(&ChatResponse{
+		Response: Response{
+			Type: messageType,
+		},
+		Messages: messages,
+	})
+	if err != nil {
+		sendError(conn, err)
+	}
+}
+
+// sendHistory チームルームで公開した見積もりの履歴を送る。使い捨てのルームでは空
+func sendHistory(conn wsConn, rounds []*entities.Round, nextAfter int64) {
+	slog.Info("<- history",
+		slog.Int("rounds", len(rounds)),
+		slog.Int64("next_after", nextAfter),
+		slog.String("remote_addr", conn.RemoteAddr().String()),
+	)
+	err := conn.WriteJSON(&HistoryResponse{
+		Response: Response{
+			Type: "history",
+		},
+		Rounds:    rounds,
+		NextAfter: nextAfter,
+	})
+	if err != nil {
+		sendError(conn, err)
+	}
+}
+
+func sendJoinStatus(conn wsConn, token string) {
 	slog.Info("<- joined", slog.String("remote_addr", conn.RemoteAddr().String()))
-	err := conn.WriteJSON(&ParticipantResponse{
+	err := conn.WriteJSON(&JoinedResponse{
 		Response: Response{
 			Type: "joined",
 		},
+		Token: token,
 	})
 	if err != nil {
 		sendError(conn, err)
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pistatium/planing_poker/internal"
+	"github.com/pistatium/planing_poker/internal/entities"
+	"io"
+	"log/slog"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// fakeConn 送信したメッセージを記録するだけの wsConn
+type fakeConn struct {
+	written [][]byte
+}
+
+func (c *fakeConn) WriteJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.written = append(c.written, b)
+	return nil
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345}
+}
+
+var knownResponseTypes = map[string]bool{
+	"error":        true,
+	"joined":       true,
+	"participants": true,
+	"estimates":    true,
+	"history":      true,
+	"audit":        true,
+	"chat":         true,
+	"chat_history": true,
+}
+
+func FuzzHandleWsMessage(f *testing.F) {
+	for _, seed := range []string{
+		`{"type":"join","user_name":"alice"}`,
+		`{"type":"join","user_name":"alice","passcode":"secret"}`,
+		`{"type":"get"}`,
+		`{"type":"leave"}`,
+		`{"type":"estimate","user_name":"alice","point":"3"}`,
+		`{"type":"estimate","user_name":"alice","point":"abc"}`,
+		`{"type":"reveal","user_name":"alice"}`,
+		`{"type":"reset","user_name":"alice"}`,
+		`{"type":"history"}`,
+		`{"type":"remove_member","target":"alice"}`,
+		`{"type":"audit"}`,
+		`{"type":"kick","target":"alice"}`,
+		`{"type":"set_role","target":"alice","role":"voter"}`,
+		`{"type":"chat","text":"hello"}`,
+		`{"type":"react","text":"👍"}`,
+		`{"type":"chat_history"}`,
+		`{"type":"unknown"}`,
+		`{"type":"join","user_name":"\u0000"}`,
+		`{"type":1}`,
+		`[]`,
+		`null`,
+		``,
+	} {
+		f.Add([]byte(seed))
+	}
+	// 大量の受信ログで遅くならないようにする
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	f.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	f.Fuzz(func(t *testing.T, message []byte) {
+		repo := internal.NewMemoryRoomRepository(internal.DefaultRoomTTL)
+		eventManager := internal.NewEventManager(repo, internal.EventManagerConfig{AllowImplicitRoomCreation: true})
+		s := NewServer(eventManager, Env{AllowImplicitRoomCreation: true})
+		ctx := context.Background()
+
+		// 参加済みの接続と未参加の接続の両方に同じメッセージを送る
+		joined := &session{roomID: "room1", clientAddr: "127.0.0.1", authorized: true}
+		s.handleWsMessage(ctx, &fakeConn{}, joined, []byte(`{"type":"join","user_name":"alice"}`))
+		if joined.userName != "alice" {
+			t.Fatalf("userName = %q after join, want alice", joined.userName)
+		}
+		for _, sess := range []*session{joined, {roomID: "room1", clientAddr: "127.0.0.1"}} {
+			conn := &fakeConn{}
+			s.handleWsMessage(ctx, conn, sess, message)
+			for _, raw := range conn.written {
+				var resp Response
+				if err := json.Unmarshal(raw, &resp); err != nil {
+					t.Fatalf("response is not valid JSON: %s", raw)
+				}
+				if !knownResponseTypes[resp.Type] {
+					t.Fatalf("unknown response type %q: %s", resp.Type, raw)
+				}
+			}
+			// セッションのユーザー名は正規化済みのものだけ
+			if sess.userName != "" {
+				if normalized, err := entities.NormalizeUserName(sess.userName); err != nil || normalized != sess.userName {
+					t.Fatalf("session userName %q is not normalized", sess.userName)
+				}
+			}
+		}
+
+		// 何を受け取っても保存されたルームは読み込み直せる
+		room, err := repo.Find(ctx, "room1")
+		if err != nil || room == nil {
+			t.Fatalf("Find = %v, %v", room, err)
+		}
+		serialized := room.Serialize()
+		restored, err := entities.NewFromSerializedRoom(serialized)
+		if err != nil {
+			t.Fatalf("NewFromSerializedRoom: %v", err)
+		}
+		if !reflect.DeepEqual(serialized, restored.Serialize()) {
+			t.Fatalf("room changed after round trip:\n%+v\n%+v", serialized, restored.Serialize())
+		}
+	})
+}
@@ -0,0 +1,1412 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/pistatium/planing_poker/internal"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// WebSocketのプロトコルをブラウザなしで確認するためのハーネス
+// インメモリのリポジトリでサーバーを立て、複数のクライアントを動かして受信したメッセージを検証する
+
+const receiveTimeout = 3 * time.Second
+
+type testServer struct {
+	*httptest.Server
+	server *Server
+	repo   *internal.MemoryRoomRepository
+}
+
+func newTestServer(t *testing.T, env Env) *testServer {
+	t.Helper()
+	repo := internal.NewMemoryRoomRepository(internal.DefaultRoomTTL)
+	eventManager := internal.NewEventManager(repo, internal.EventManagerConfig{
+		AllowImplicitRoomCreation: env.AllowImplicitRoomCreation,
+		MaxRoomRetention:          env.MaxRoomRetention,
+		AllowTeamRooms:            env.AllowTeamRooms,
+	})
+	server := NewServer(eventManager, env)
+	mux := http.NewServeMux()
+	server.Routes(mux)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return &testServer{Server: ts, server: server, repo: repo}
+}
+
+func defaultTestEnv() Env {
+	return Env{AllowImplicitRoomCreation: true, AllowTeamRooms: true}
+}
+
+// received クライアントが受信した1メッセージ
+type received struct {
+	Type string
+	Raw  []byte
+}
+
+func (r received) decode(t *testing.T, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(r.Raw, v); err != nil {
+		t.Fatalf("decode %s: %v", r.Raw, err)
+	}
+}
+
+type testClient struct {
+	t        *testing.T
+	name     string
+	conn     *websocket.Conn
+	incoming chan received
+	// join で受け取ったトークン
+	token string
+	// 切断されたときの読み込みエラー。incoming が閉じた後に設定されている
+	closeErr error
+	// 受信した順のメッセージ種別
+	history []string
+	mu      sync.Mutex
+}
+
+// connect room と追加のクエリでWebSocketに接続する
+func (ts *testServer) connect(t *testing.T, name string, roomID string, query ...string) *testClient {
+	t.Helper()
+	conn, _, err := ts.dial(roomID, nil, query...)
+	if err != nil {
+		t.Fatalf("%s: dial: %v", name, err)
+	}
+	c := &testClient{t: t, name: name, conn: conn, incoming: make(chan received, 256)}
+	go c.readLoop()
+	t.Cleanup(func() { conn.Close() })
+	return c
+}
+
+// dial ハンドシェイクのヘッダーを指定して接続する。失敗した場合はレスポンスも返す
+func (ts *testServer) dial(roomID string, header http.Header, query ...string) (*websocket.Conn, *http.Response, error) {
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	u.Scheme = "ws"
+	u.Path = "/ws"
+	q := url.Values{"room": {roomID}}
+	for i := 0; i+1 < len(query); i += 2 {
+		q.Set(query[i], query[i+1])
+	}
+	u.RawQuery = q.Encode()
+	return websocket.DefaultDialer.Dial(u.String(), header)
+}
+
+func (c *testClient) readLoop() {
+	defer close(c.incoming)
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			c.closeErr = err
+			return
+		}
+		var head Response
+		if err := json.Unmarshal(message, &head); err != nil {
+			continue
+		}
+		c.incoming <- received{Type: head.Type, Raw: message}
+	}
+}
+
+func (c *testClient) send(m Message) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(m); err != nil {
+		c.t.Fatalf("%s: send: %v", c.name, err)
+	}
+}
+
+func (c *testClient) join() {
+	c.t.Helper()
+	c.send(Message{Type: "join", UserName: c.name, Token: c.token})
+	var joined JoinedResponse
+	c.expectNext("joined", "participants")[0].decode(c.t, &joined)
+	if joined.Token == "" {
+		c.t.Fatalf("%s: joined without a token", c.name)
+	}
+	c.token = joined.Token
+}
+
+// expectClosed 残りのメッセージを読み飛ばし、サーバーから closeCode で切断されること
+func (c *testClient) expectClosed(closeCode int) {
+	c.t.Helper()
+	timeout := time.After(receiveTimeout)
+	for {
+		select {
+		case r, ok := <-c.incoming:
+			if ok {
+				c.mu.Lock()
+				c.history = append(c.history, r.Type)
+				c.mu.Unlock()
+				continue
+			}
+			if !websocket.IsCloseError(c.closeErr, closeCode) {
+				c.t.Fatalf("%s: closed with %v, want close code %d", c.name, c.closeErr, closeCode)
+			}
+			return
+		case <-timeout:
+			c.t.Fatalf("%s: not closed (received so far: %v)", c.name, c.history)
+		}
+	}
+}
+
+// disconnect ブラウザを閉じたのと同じように切断する
+func (c *testClient) disconnect() {
+	c.conn.Close()
+}
+
+// next 次のメッセージを受信する
+func (c *testClient) next() received {
+	c.t.Helper()
+	select {
+	case r, ok := <-c.incoming:
+		if !ok {
+			c.t.Fatalf("%s: connection closed", c.name)
+		}
+		c.mu.Lock()
+		c.history = append(c.history, r.Type)
+		c.mu.Unlock()
+		return r
+	case <-time.After(receiveTimeout):
+		c.t.Fatalf("%s: timed out waiting for a message (received so far: %v)", c.name, c.history)
+	}
+	return received{}
+}
+
+// expectNext 次に受信するメッセージがこの順で届くこと
+func (c *testClient) expectNext(types ...string) []received {
+	c.t.Helper()
+	var got []received
+	for _, typ := range types {
+		r := c.next()
+		if r.Type != typ {
+			c.t.Fatalf("%s: got %q (%s), want %q", c.name, r.Type, r.Raw, typ)
+		}
+		got = append(got, r)
+	}
+	return got
+}
+
+// waitFor 条件を満たす typ のメッセージが届くまで読み進める
+// ポーリングによる participants の重複など、間のメッセージは読み飛ばす
+func (c *testClient) waitFor(typ string, match func(received) bool) received {
+	c.t.Helper()
+	deadline := time.Now().Add(receiveTimeout)
+	for time.Now().Before(deadline) {
+		r := c.next()
+		if r.Type == typ && (match == nil || match(r)) {
+			return r
+		}
+	}
+	c.t.Fatalf("%s: no matching %q message (received: %v)", c.name, typ, c.history)
+	return received{}
+}
+
+// waitForParticipants 参加者とその見積もり済みかどうかが一致する participants を待つ
+func (c *testClient) waitForParticipants(want map[string]bool) ParticipantResponse {
+	c.t.Helper()
+	var resp ParticipantResponse
+	c.waitFor("participants", func(r received) bool {
+		resp = ParticipantResponse{}
+		r.decode(c.t, &resp)
+		got := map[string]bool{}
+		for _, p := range resp.Participants {
+			got[p.UserName] = p.IsEstimated
+		}
+		return fmt.Sprint(got) == fmt.Sprint(want)
+	})
+	return resp
+}
+
+// waitForEstimates 公開された見積もりが一致する estimates を待つ
+func (c *testClient) waitForEstimates(want map[string]string) EstimatesResponse {
+	c.t.Helper()
+	var resp EstimatesResponse
+	c.waitFor("estimates", func(r received) bool {
+		resp = EstimatesResponse{}
+		r.decode(c.t, &resp)
+		got := map[string]string{}
+		for _, e := range resp.Estimates {
+			got[e.UserName] = e.PointLabel
+		}
+		return fmt.Sprint(got) == fmt.Sprint(want)
+	})
+	return resp
+}
+
+// expectError 次に届くメッセージが code のエラーであること
+func (c *testClient) expectError(code string) Response {
+	c.t.Helper()
+	r := c.expectNext("error")[0]
+	var resp Response
+	r.decode(c.t, &resp)
+	if resp.Code != code {
+		c.t.Fatalf("%s: error code = %q (%s), want %q", c.name, resp.Code, resp.Message, code)
+	}
+	return resp
+}
+
+// assertOrder 受信したメッセージの中に types がこの順で含まれていること
+func (c *testClient) assertOrder(types ...string) {
+	c.t.Helper()
+	c.mu.Lock()
+	history := append([]string(nil), c.history...)
+	c.mu.Unlock()
+	i := 0
+	for _, typ := range history {
+		if i < len(types) && typ == types[i] {
+			i++
+		}
+	}
+	if i != len(types) {
+		c.t.Errorf("%s: received %v, want %v in this order", c.name, history, types)
+	}
+}
+
+// waitForError 他のメッセージを読み飛ばして code のエラーを待つ
+func (c *testClient) waitForError(code string) Response {
+	c.t.Helper()
+	var resp Response
+	c.waitFor("error", func(r received) bool {
+		r.decode(c.t, &resp)
+		return resp.Code == code
+	})
+	return resp
+}
+
+func TestWebSocket_JoinEstimateReveal(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	alice := ts.connect(t, "alice", "room1")
+	bob := ts.connect(t, "bob", "room1")
+
+	alice.join()
+	bob.join()
+	alice.waitForParticipants(map[string]bool{"alice": false, "bob": false})
+
+	alice.send(Message{Type: "estimate", UserName: "alice", PointLabel: "3"})
+	bob.waitForParticipants(map[string]bool{"alice": true, "bob": false})
+	bob.send(Message{Type: "estimate", UserName: "bob", PointLabel: "5"})
+	alice.waitForParticipants(map[string]bool{"alice": true, "bob": true})
+
+	bob.send(Message{Type: "reveal", UserName: "bob"})
+	want := map[string]string{"alice": "3", "bob": "5"}
+	bob.waitForEstimates(want)
+	alice.waitForEstimates(want)
+
+	alice.assertOrder("joined", "participants", "estimates")
+	bob.assertOrder("joined", "participants", "estimates")
+}
+
+func TestWebSocket_LeaveOnDisconnect(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	alice := ts.connect(t, "alice", "room1")
+	bob := ts.connect(t, "bob", "room1")
+	alice.join()
+	bob.join()
+	alice.waitForParticipants(map[string]bool{"alice": false, "bob": false})
+
+	bob.disconnect()
+	alice.waitForParticipants(map[string]bool{"alice": false})
+}
+
+func TestWebSocket_InvalidPoint(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	alice := ts.connect(t, "alice", "room1")
+	alice.join()
+
+	alice.send(Message{Type: "estimate", UserName: "alice", PointLabel: "abc"})
+	alice.expectError("invalid_point")
+}
+
+func TestWebSocket_Passcode(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	alice := ts.connect(t, "alice", "room1")
+	alice.send(Message{Type: "join", UserName: "alice", Passcode: "secret"})
+	alice.expectNext("joined", "participants")
+
+	// パスコードなしでは状態を受け取れず、参加もできない
+	mallory := ts.connect(t, "mallory", "room1")
+	mallory.expectError("passcode_required")
+	mallory.send(Message{Type: "get"})
+	mallory.expectError("passcode_required")
+	mallory.send(Message{Type: "join", UserName: "mallory", Passcode: "wrong"})
+	mallory.expectError("invalid_passcode")
+
+	// 招待URLのパスコードで入れる
+	bob := ts.connect(t, "bob", "room1", "passcode", "secret")
+	bob.join()
+	alice.waitForParticipants(map[string]bool{"alice": false, "bob": false})
+}
+
+func TestWebSocket_PasscodeOnlyForNewRoom(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	resp, err := http.Post(ts.URL+"/api/rooms", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created CreateRoomResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// 誰もいなくても既存のルームにはパスコードを設定できない
+	mallory := ts.connect(t, "mallory", created.RoomID)
+	mallory.send(Message{Type: "join", UserName: "mallory", Passcode: "secret"})
+	mallory.expectNext("joined", "participants")
+	alice := ts.connect(t, "alice", created.RoomID)
+	alice.join()
+
+	// 作る前から接続していたクライアントは、ルームが保護されたら状態を受け取れなくなる
+	watcher := ts.connect(t, "watcher", "room2")
+	bob := ts.connect(t, "bob", "room2")
+	bob.send(Message{Type: "join", UserName: "bob", Passcode: "secret"})
+	bob.expectNext("joined", "participants")
+	watcher.expectError("passcode_required")
+	bob.send(Message{Type: "estimate", UserName: "bob", PointLabel: "3"})
+	bob.waitForParticipants(map[string]bool{"bob": true})
+	select {
+	case r := <-watcher.incoming:
+		t.Errorf("watcher received %s after the room was protected", r.Raw)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	for _, tt := range []struct {
+		hops      int
+		forwarded []string
+		want      string
+	}{
+		{hops: 0, forwarded: []string{"203.0.113.1"}, want: "192.0.2.1"},
+		{hops: 1, forwarded: nil, want: "192.0.2.1"},
+		{hops: 1, forwarded: []string{"203.0.113.1"}, want: "203.0.113.1"},
+		// クライアントが書いた左側の値は使わない
+		{hops: 1, forwarded: []string{"198.51.100.9, 203.0.113.1"}, want: "203.0.113.1"},
+		{hops: 1, forwarded: []string{"198.51.100.9", "203.0.113.1"}, want: "203.0.113.1"},
+		{hops: 2, forwarded: []string{"198.51.100.9, 203.0.113.1, 10.0.0.1"}, want: "203.0.113.1"},
+		{hops: 2, forwarded: []string{"203.0.113.1"}, want: "192.0.2.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		r.RemoteAddr = "192.0.2.1:54321"
+		for _, v := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		s := &Server{trustedProxyHops: tt.hops}
+		if got := s.clientAddr(r); got != tt.want {
+			t.Errorf("hops %d, X-Forwarded-For %q: got %s, want %s", tt.hops, tt.forwarded, got, tt.want)
+		}
+	}
+}
+
+func TestWebSocket_InvalidRoomID(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	u := strings.Replace(ts.URL, "http", "ws", 1) + "/ws?room=" + url.QueryEscape("no spaces")
+	_, resp, err := websocket.DefaultDialer.Dial(u, nil)
+	if err == nil {
+		t.Fatal("dial succeeded, want error")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("response = %v, want 400", resp)
+	}
+}
+
+func TestWebSocket_Origin(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		allowed []string
+		origin  string
+		ok      bool
+	}{
+		{name: "same origin", origin: "", ok: true},
+		{name: "cross origin", origin: "https://evil.example", ok: false},
+		{name: "allowed", allowed: []string{"https://app.example"}, origin: "https://APP.example", ok: true},
+		{name: "not allowed", allowed: []string{"https://app.example"}, origin: "https://evil.example", ok: false},
+		{name: "wildcard", allowed: []string{"*"}, origin: "https://evil.example", ok: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			env := defaultTestEnv()
+			env.AllowedOrigins = tt.allowed
+			ts := newTestServer(t, env)
+			origin := tt.origin
+			if origin == "" {
+				origin = ts.URL
+			}
+			conn, resp, err := ts.dial("room1", http.Header{"Origin": {origin}})
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("dial from %s: %v", origin, err)
+				}
+				conn.Close()
+				return
+			}
+			if err == nil {
+				conn.Close()
+				t.Fatalf("dial from %s succeeded, want rejected", origin)
+			}
+			if resp == nil || resp.StatusCode != http.StatusForbidden {
+				t.Errorf("dial from %s: response %v, want 403", origin, resp)
+			}
+		})
+	}
+}
+
+func TestWebSocket_MessageTooLarge(t *testing.T) {
+	env := defaultTestEnv()
+	env.MaxMessageBytes = 256
+	ts := newTestServer(t, env)
+	alice := ts.connect(t, "alice", "room1")
+	alice.join()
+
+	alice.send(Message{Type: "chat", Text: strings.Repeat("a", 300)})
+	alice.expectClosed(websocket.CloseMessageTooBig)
+}
+
+func TestWebSocket_ConnRateLimit(t *testing.T) {
+	env := defaultTestEnv()
+	env.ConnMessageRate = 0.01
+	env.ConnMessageBurst = 3
+	ts := newTestServer(t, env)
+	alice := ts.connect(t, "alice", "room1")
+	bob := ts.connect(t, "bob", "room1")
+	alice.join()
+	bob.join()
+
+	for i := 0; i < 3; i++ {
+		alice.send(Message{Type: "get"})
+	}
+	// 通知してから切断する
+	alice.waitForError("rate_limited")
+	alice.expectClosed(websocket.ClosePolicyViolation)
+	// 他の接続には影響しない
+	bob.send(Message{Type: "get"})
+	bob.waitFor("participants", nil)
+}
+
+func TestWebSocket_IPRateLimit(t *testing.T) {
+	env := defaultTestEnv()
+	env.IPMessageRate = 0.01
+	env.IPMessageBurst = 5
+	ts := newTestServer(t, env)
+	// 接続も数える
+	alice := ts.connect(t, "alice", "room1")
+	bob := ts.connect(t, "bob", "room1")
+	alice.send(Message{Type: "get"})
+	alice.waitFor("participants", nil)
+	bob.send(Message{Type: "get"})
+	bob.waitFor("participants", nil)
+	alice.send(Message{Type: "get"})
+	alice.waitFor("participants", nil)
+
+	// 同じ接続元の合計で超えると、1接続あたりの上限に届いていなくても切断する
+	bob.send(Message{Type: "get"})
+	bob.waitForError("rate_limited")
+	bob.expectClosed(websocket.ClosePolicyViolation)
+
+	// 新しい接続はハンドシェイクの前に断る
+	conn, resp, err := ts.dial("room1", nil)
+	if err == nil {
+		conn.Close()
+		t.Fatal("dial succeeded after the per-IP limit was exceeded")
+	}
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("dial response %v, want 429", resp)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	alice := ts.connect(t, "alice", "room1")
+	alice.join()
+	resp, err := http.Get(ts.URL + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("readyz before shutdown = %d, want 200", resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), receiveTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		ts.server.Shutdown(ctx, ts.Config)
+		close(done)
+	}()
+	// 切断する前に再接続を促す
+	alice.waitFor("restarting", nil)
+	alice.expectClosed(websocket.CloseServiceRestart)
+	<-done
+
+	// リスナーは閉じているのでハンドラーを直接呼ぶ
+	rec := httptest.NewRecorder()
+	ts.server.readyzHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz while draining = %d, want 503", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	ts.server.wsHandler(rec, httptest.NewRequest(http.MethodGet, "/ws?room=room1", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("connect while draining = %d, want 503", rec.Code)
+	}
+}
+
+func TestCreateRoom_Retention(t *testing.T) {
+	env := defaultTestEnv()
+	env.MaxRoomRetention = 30 * 24 * time.Hour
+	ts := newTestServer(t, env)
+
+	for _, tt := range []struct {
+		retention  string
+		wantStatus int
+		want       string
+	}{
+		{retention: "", wantStatus: http.StatusCreated, want: ""},
+		{retention: "72h", wantStatus: http.StatusCreated, want: "72h0m0s"},
+		{retention: "permanent", wantStatus: http.StatusBadRequest},
+		{retention: "8760h", wantStatus: http.StatusBadRequest},
+		{retention: "-1h", wantStatus: http.StatusBadRequest},
+	} {
+		body := fmt.Sprintf(`{"retention":%q}`, tt.retention)
+		resp, err := http.Post(ts.URL+"/api/rooms", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("retention %q: status = %d, want %d", tt.retention, resp.StatusCode, tt.wantStatus)
+		}
+		if tt.wantStatus == http.StatusCreated {
+			var created CreateRoomResponse
+			if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+				t.Fatal(err)
+			}
+			if created.Retention != tt.want {
+				t.Errorf("retention %q: got %q, want %q", tt.retention, created.Retention, tt.want)
+			}
+		} else {
+			var errResp Response
+			if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+				t.Fatal(err)
+			}
+			if errResp.Code != "invalid_retention" {
+				t.Errorf("retention %q: code = %q, want invalid_retention", tt.retention, errResp.Code)
+			}
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestWebSocket_TeamRoom(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	resp, err := http.Post(ts.URL+"/api/rooms", "application/json", strings.NewReader(`{"type":"team"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created CreateRoomResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if created.Type != "team" || created.Retention != "permanent" {
+		t.Fatalf("created = %+v, want a permanent team room", created)
+	}
+
+	alice := ts.connect(t, "alice", created.RoomID)
+	bob := ts.connect(t, "bob", created.RoomID)
+	alice.join()
+	bob.join()
+	alice.send(Message{Type: "estimate", UserName: "alice", PointLabel: "3"})
+	bob.send(Message{Type: "estimate", UserName: "bob", PointLabel: "5"})
+	alice.waitForParticipants(map[string]bool{"alice": true, "bob": true})
+	alice.send(Message{Type: "reveal", UserName: "alice"})
+	alice.waitForEstimates(map[string]string{"alice": "3", "bob": "5"})
+
+	// 切断してもメンバーとして残る
+	bob.disconnect()
+	alice.waitFor("participants", func(r received) bool {
+		var participants ParticipantResponse
+		r.decode(t, &participants)
+		for _, p := range participants.Participants {
+			if p.UserName == "bob" {
+				return p.Offline && p.LastSeenAt != nil
+			}
+		}
+		return false
+	})
+
+	alice.send(Message{Type: "history"})
+	var history HistoryResponse
+	alice.waitFor("history", nil).decode(t, &history)
+	if len(history.Rounds) != 1 || len(history.Rounds[0].Estimates) != 2 || history.NextAfter != 0 {
+		t.Fatalf("history = %+v, want 1 round with 2 estimates", history)
+	}
+
+	alice.send(Message{Type: "remove_member", Target: "bob"})
+	alice.waitForParticipants(map[string]bool{"alice": true})
+	alice.send(Message{Type: "remove_member", Target: "bob"})
+	var removeErr Response
+	alice.waitFor("error", nil).decode(t, &removeErr)
+	if removeErr.Code != "user_not_found" {
+		t.Errorf("code = %q, want user_not_found", removeErr.Code)
+	}
+}
+
+func TestCreateRoom_TeamRoomsDisabled(t *testing.T) {
+	env := defaultTestEnv()
+	env.AllowTeamRooms = false
+	ts := newTestServer(t, env)
+	resp, err := http.Post(ts.URL+"/api/rooms", "application/json", strings.NewReader(`{"type":"team"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestRoomEventsAPI(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	alice := ts.connect(t, "alice", "room1")
+	alice.send(Message{Type: "join", UserName: "alice", Passcode: "secret"})
+	alice.expectNext("joined", "participants")
+	alice.send(Message{Type: "estimate", UserName: "alice", PointLabel: "3"})
+	alice.waitForParticipants(map[string]bool{"alice": true})
+
+	get := func(path string, wantStatus int, v interface{}) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			t.Fatalf("GET %s: status = %d, want %d", path, resp.StatusCode, wantStatus)
+		}
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	estimatePoint := func(events EventsResponse) string {
+		for _, e := range events.Events {
+			if e.Type == "estimate_set" {
+				return e.Point
+			}
+		}
+		t.Fatalf("no estimate_set in %+v", events.Events)
+		return ""
+	}
+
+	get("/api/rooms/room1/events", http.StatusUnauthorized, nil)
+	get("/api/rooms/unknown/events", http.StatusNotFound, nil)
+	get("/api/rooms/room1/events?passcode=secret&limit=x", http.StatusBadRequest, nil)
+
+	// 公開前の見積もりは伏せる
+	var events EventsResponse
+	get("/api/rooms/room1/events?passcode=secret", http.StatusOK, &events)
+	if point := estimatePoint(events); point != "" {
+		t.Errorf("unrevealed point = %q, want hidden", point)
+	}
+
+	alice.send(Message{Type: "reveal", UserName: "alice"})
+	alice.waitForEstimates(map[string]string{"alice": "3"})
+	get("/api/rooms/room1/events?passcode=secret", http.StatusOK, &events)
+	if point := estimatePoint(events); point != "3" {
+		t.Errorf("revealed point = %q, want 3", point)
+	}
+
+	var page EventsResponse
+	get("/api/rooms/room1/events?passcode=secret&after=1&limit=1", http.StatusOK, &page)
+	if len(page.Events) != 1 || page.Events[0].Seq != 2 || page.NextAfter != 2 {
+		t.Errorf("page = %+v, want only seq 2", page)
+	}
+
+	var replay ReplayResponse
+	get(fmt.Sprintf("/api/rooms/room1/replay?passcode=secret&seq=%d", events.NextAfter-1), http.StatusOK, &replay)
+	if replay.State != "voting" || len(replay.Estimates) != 0 || len(replay.Participants) != 1 || !replay.Participants[0].IsEstimated {
+		t.Errorf("replay before reveal = %+v", replay)
+	}
+	get("/api/rooms/room1/replay?passcode=secret", http.StatusOK, &replay)
+	if replay.State != "revealed" || len(replay.Estimates) != 1 || replay.Estimates[0].PointLabel != "3" {
+		t.Errorf("replay = %+v, want revealed estimate", replay)
+	}
+
+	// リセットで捨てたラウンドの見積もりは、後のラウンドを公開しても伏せたまま
+	alice.send(Message{Type: "reset", UserName: "alice"})
+	alice.waitForParticipants(map[string]bool{"alice": false})
+	alice.send(Message{Type: "estimate", UserName: "alice", PointLabel: "5"})
+	alice.waitForParticipants(map[string]bool{"alice": true})
+	alice.send(Message{Type: "reset", UserName: "alice"})
+	alice.waitForParticipants(map[string]bool{"alice": false})
+	alice.send(Message{Type: "estimate", UserName: "alice", PointLabel: "8"})
+	alice.waitForParticipants(map[string]bool{"alice": true})
+	alice.send(Message{Type: "reveal", UserName: "alice"})
+	alice.waitForEstimates(map[string]string{"alice": "8"})
+	get("/api/rooms/room1/events?passcode=secret", http.StatusOK, &events)
+	var points []string
+	var seqs []int64
+	for _, e := range events.Events {
+		if e.Type == "estimate_set" {
+			points = append(points, e.Point)
+			seqs = append(seqs, e.Seq)
+		}
+	}
+	if fmt.Sprint(points) != fmt.Sprint([]string{"3", "", "8"}) {
+		t.Errorf("estimate points = %q, want 3, hidden, 8", points)
+	}
+	// 公開がページの外にあっても同じ
+	for i, want := range []string{"", "8"} {
+		get(fmt.Sprintf("/api/rooms/room1/events?passcode=secret&after=%d&limit=1", seqs[i+1]-1), http.StatusOK, &page)
+		if point := estimatePoint(page); point != want {
+			t.Errorf("paged estimate %d = %q, want %q", seqs[i+1], point, want)
+		}
+	}
+}
+
+func TestWebSocket_AuditLog(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	resp, err := http.Post(ts.URL+"/api/rooms", "application/json", strings.NewReader(`{"facilitators":["alice"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created CreateRoomResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	alice := ts.connect(t, "alice", created.RoomID)
+	bob := ts.connect(t, "bob", created.RoomID)
+	alice.join()
+	bob.join()
+	alice.waitForParticipants(map[string]bool{"alice": false, "bob": false})
+
+	bob.send(Message{Type: "audit"})
+	bob.waitFor("error", nil)
+	alice.send(Message{Type: "reveal"})
+	alice.waitFor("estimates", nil)
+	alice.send(Message{Type: "kick", Target: "bob"})
+	alice.waitForParticipants(map[string]bool{"alice": false})
+	alice.send(Message{Type: "set_role", Target: "bob", Role: "facilitator"})
+	alice.send(Message{Type: "set_deck", Deck: []string{"1", "2", "3"}})
+	alice.send(Message{Type: "audit"})
+	var audit AuditResponse
+	alice.waitFor("audit", nil).decode(t, &audit)
+	var actions []string
+	for _, entry := range audit.Entries {
+		actions = append(actions, string(entry.Action))
+		if entry.RemoteAddr == "" || entry.At.IsZero() {
+			t.Errorf("entry %+v has no remote address or time", entry)
+		}
+		if entry.Action != "room_created" && entry.Actor != "alice" {
+			t.Errorf("entry %+v actor = %q, want alice", entry, entry.Actor)
+		}
+	}
+	if want := "[room_created reveal kick role_changed settings_changed]"; fmt.Sprint(actions) != want {
+		t.Errorf("actions = %v, want %s", actions, want)
+	}
+
+	// 名前だけでは読めず、進行役のトークンが必要
+	carol := ts.connect(t, "carol", created.RoomID)
+	carol.join()
+	for _, tt := range []struct {
+		userName      string
+		authorization string
+		wantStatus    int
+	}{
+		{userName: "alice", authorization: "Bearer " + alice.token, wantStatus: http.StatusOK},
+		{userName: "mallory", authorization: "Bearer " + alice.token, wantStatus: http.StatusForbidden},
+		{userName: "alice", wantStatus: http.StatusUnauthorized},
+		{userName: "alice", authorization: alice.token, wantStatus: http.StatusUnauthorized},
+		{userName: "alice", authorization: "Bearer " + carol.token, wantStatus: http.StatusForbidden},
+		{userName: "carol", authorization: "Bearer " + carol.token, wantStatus: http.StatusForbidden},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/rooms/"+created.RoomID+"/audit?user_name="+tt.userName, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("GET audit as %s with %q: status = %d, want %d", tt.userName, tt.authorization, resp.StatusCode, tt.wantStatus)
+		}
+	}
+}
+
+func TestWebSocket_LeaveReleasesName(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	alice := ts.connect(t, "alice", "room1")
+	bob := ts.connect(t, "bob", "room1")
+	alice.send(Message{Type: "leave"})
+	alice.waitForError("user_not_found")
+	alice.join()
+	bob.join()
+
+	alice.send(Message{Type: "leave"})
+	bob.waitForParticipants(map[string]bool{"bob": false})
+	alice.send(Message{Type: "estimate", PointLabel: "3"})
+	alice.waitForError("user_not_found")
+
+	// 使い捨てのルームでは、自分で退出した名前を別の人が使える
+	other := ts.connect(t, "alice", "room1")
+	other.join()
+	if other.token == alice.token {
+		t.Errorf("token was reused after leave")
+	}
+	bob.waitForParticipants(map[string]bool{"alice": false, "bob": false})
+}
+
+func TestWebSocket_KickedCannotRejoinByEstimate(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	resp, err := http.Post(ts.URL+"/api/rooms", "application/json", strings.NewReader(`{"facilitators":["alice","bob"],"type":"team"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created CreateRoomResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	alice := ts.connect(t, "alice", created.RoomID)
+	bob := ts.connect(t, "bob", created.RoomID)
+	carol := ts.connect(t, "carol", created.RoomID)
+	alice.join()
+	bob.join()
+	carol.join()
+	alice.waitForParticipants(map[string]bool{"alice": false, "bob": false, "carol": false})
+
+	// チームルームでは外されてもオフラインのメンバーとして残る
+	gone := func(name string) func(received) bool {
+		return func(r received) bool {
+			var resp ParticipantResponse
+			r.decode(t, &resp)
+			for _, p := range resp.Participants {
+				if p.UserName == name && !p.Offline {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	// 見積もりで参加者に戻ることも、進行役として操作することもできない
+	alice.send(Message{Type: "kick", Target: "bob"})
+	bob.waitFor("participants", gone("bob"))
+	bob.send(Message{Type: "estimate", PointLabel: "3"})
+	bob.waitForError("user_not_found")
+	bob.send(Message{Type: "reveal"})
+	bob.waitForError("permission_denied")
+
+	alice.send(Message{Type: "remove_member", Target: "carol"})
+	carol.waitFor("participants", gone("carol"))
+	carol.send(Message{Type: "estimate", PointLabel: "5"})
+	carol.waitForError("user_not_found")
+
+	// join し直せば戻れる
+	bob.send(Message{Type: "join", UserName: "bob", Token: bob.token})
+	bob.waitFor("joined", nil)
+	alice.waitFor("participants", func(r received) bool { return !gone("bob")(r) })
+}
+
+func TestWebSocket_UserNameBoundToToken(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	resp, err := http.Post(ts.URL+"/api/rooms", "application/json", strings.NewReader(`{"facilitators":["alice"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created CreateRoomResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	alice := ts.connect(t, "alice", created.RoomID)
+	bob := ts.connect(t, "bob", created.RoomID)
+	alice.join()
+	bob.join()
+	alice.waitForParticipants(map[string]bool{"alice": false, "bob": false})
+
+	// 進行役の名前を名乗っても、トークンがなければ入れず進行もできない
+	mallory := ts.connect(t, "mallory", created.RoomID)
+	mallory.send(Message{Type: "join", UserName: "alice"})
+	mallory.waitForError("user_name_taken")
+	mallory.send(Message{Type: "join", UserName: "alice", Token: bob.token})
+	mallory.waitForError("user_name_taken")
+	mallory.send(Message{Type: "set_role", UserName: "alice", Target: "bob", Role: "facilitator"})
+	mallory.waitForError("permission_denied")
+	mallory.send(Message{Type: "estimate", UserName: "alice", PointLabel: "13"})
+	mallory.waitForError("user_not_found")
+	bob.send(Message{Type: "reveal"})
+	bob.waitForError("permission_denied")
+
+	// 同じトークンなら別の接続からでも入り直せる
+	again := ts.connect(t, "alice", created.RoomID)
+	again.token = alice.token
+	again.join()
+	if again.token != alice.token {
+		t.Errorf("token changed on rejoin: %q, want %q", again.token, alice.token)
+	}
+	again.send(Message{Type: "estimate", UserName: "bob", PointLabel: "3"})
+	again.waitForParticipants(map[string]bool{"alice": true, "bob": false})
+	again.send(Message{Type: "reveal"})
+	again.waitForEstimates(map[string]string{"alice": "3", "bob": ""})
+}
+
+func TestWebSocket_AnonymousRoom(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	resp, err := http.Post(ts.URL+"/api/rooms", "application/json", strings.NewReader(`{"type":"team","anonymous":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created CreateRoomResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !created.Anonymous {
+		t.Fatalf("created = %+v, want an anonymous room", created)
+	}
+
+	alice := ts.connect(t, "alice", created.RoomID)
+	bob := ts.connect(t, "bob", created.RoomID)
+	carol := ts.connect(t, "carol", created.RoomID)
+	alice.join()
+	bob.join()
+	carol.join()
+	alice.send(Message{Type: "estimate", UserName: "alice", PointLabel: "8"})
+	bob.send(Message{Type: "estimate", UserName: "bob", PointLabel: "?"})
+	carol.send(Message{Type: "estimate", UserName: "carol", PointLabel: "3"})
+	alice.waitForParticipants(map[string]bool{"alice": true, "bob": true, "carol": true})
+
+	// 見積もりが出ている間は匿名をやめられない
+	alice.send(Message{Type: "set_anonymous", Anonymous: false})
+	alice.expectError("anonymity_locked")
+
+	alice.send(Message{Type: "reveal", UserName: "alice"})
+	var estimates EstimatesResponse
+	carol.waitFor("estimates", nil).decode(t, &estimates)
+	if !estimates.Anonymous {
+		t.Error("estimates are not marked anonymous")
+	}
+	var labels []string
+	for _, e := range estimates.Estimates {
+		if e.UserName != "" {
+			t.Errorf("estimate %+v has a user name", e)
+		}
+		labels = append(labels, e.PointLabel)
+	}
+	if fmt.Sprint(labels) != "[3 8 ?]" {
+		t.Errorf("points = %v, want sorted [3 8 ?]", labels)
+	}
+	stats := estimates.Stats
+	if stats.Votes != 3 || len(stats.Distribution) != 3 || stats.Average == nil || *stats.Average != 5.5 || *stats.Min != 3 || *stats.Max != 8 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	alice.send(Message{Type: "history"})
+	var history HistoryResponse
+	alice.waitFor("history", nil).decode(t, &history)
+	if len(history.Rounds) != 1 || !history.Rounds[0].Anonymous {
+		t.Fatalf("history = %+v, want 1 anonymous round", history.Rounds)
+	}
+	for _, e := range history.Rounds[0].Estimates {
+		if e.UserName != "" {
+			t.Errorf("round estimate %+v has a user name", e)
+		}
+	}
+
+	// 公開後もイベントから誰が何を出したかは分からない
+	get := func(path string, v interface{}) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var events EventsResponse
+	get("/api/rooms/"+created.RoomID+"/events", &events)
+	for _, e := range events.Events {
+		if e.Type == "estimate_set" && e.Point != "" {
+			t.Errorf("event %+v exposes the point", e)
+		}
+	}
+	var replay ReplayResponse
+	get("/api/rooms/"+created.RoomID+"/replay", &replay)
+	if !replay.Anonymous || len(replay.Estimates) != 3 || replay.Stats == nil {
+		t.Fatalf("replay = %+v, want anonymous estimates with stats", replay)
+	}
+	for _, e := range replay.Estimates {
+		if e.UserName != "" {
+			t.Errorf("replayed estimate %+v has a user name", e)
+		}
+	}
+
+	// リセットすれば変えられる
+	alice.send(Message{Type: "reset", UserName: "alice"})
+	alice.waitForParticipants(map[string]bool{"alice": false, "bob": false, "carol": false})
+	alice.send(Message{Type: "set_anonymous", Anonymous: false})
+	alice.waitFor("participants", func(r received) bool {
+		var participants ParticipantResponse
+		r.decode(t, &participants)
+		return !participants.Anonymous
+	})
+}
+
+func TestWebSocket_Rationale(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	resp, err := http.Post(ts.URL+"/api/rooms", "application/json", strings.NewReader(`{"type":"team"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created CreateRoomResponse
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	alice := ts.connect(t, "alice", created.RoomID)
+	bob := ts.connect(t, "bob", created.RoomID)
+	alice.join()
+	bob.join()
+	alice.send(Message{Type: "estimate", UserName: "alice", PointLabel: "13", Rationale: strings.Repeat("x", 281)})
+	alice.expectError("invalid_rationale")
+	alice.send(Message{Type: "estimate", UserName: "alice", PointLabel: "13", Rationale: "  needs a\n  migration "})
+	bob.send(Message{Type: "estimate", UserName: "bob", PointLabel: "3"})
+	alice.waitForParticipants(map[string]bool{"alice": true, "bob": true})
+
+	// 公開前は events API でも理由を伏せる
+	var events EventsResponse
+	eventsURL := ts.URL + "/api/rooms/" + created.RoomID + "/events"
+	getJSON := func(v interface{}) {
+		t.Helper()
+		resp, err := http.Get(eventsURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	getJSON(&events)
+	for _, e := range events.Events {
+		if e.Rationale != "" {
+			t.Errorf("unrevealed event %+v exposes the rationale", e)
+		}
+	}
+
+	alice.send(Message{Type: "reveal", UserName: "alice"})
+	estimates := bob.waitForEstimates(map[string]string{"alice": "13", "bob": "3"})
+	rationales := map[string]string{}
+	for _, e := range estimates.Estimates {
+		rationales[e.UserName] = e.Rationale
+	}
+	if rationales["alice"] != "needs a migration" || rationales["bob"] != "" {
+		t.Errorf("rationales = %q", rationales)
+	}
+
+	alice.send(Message{Type: "history"})
+	var history HistoryResponse
+	alice.waitFor("history", nil).decode(t, &history)
+	if len(history.Rounds) != 1 {
+		t.Fatalf("history = %+v, want 1 round", history.Rounds)
+	}
+	for _, e := range history.Rounds[0].Estimates {
+		if e.Rationale != rationales[e.UserName] {
+			t.Errorf("round estimate %+v, want rationale %q", e, rationales[e.UserName])
+		}
+	}
+	getJSON(&events)
+	found := false
+	for _, e := range events.Events {
+		found = found || e.Rationale == "needs a migration"
+	}
+	if !found {
+		t.Errorf("revealed events %+v have no rationale", events.Events)
+	}
+}
+
+func TestWebSocket_Chat(t *testing.T) {
+	env := defaultTestEnv()
+	env.ChatMessageRate = 0.001
+	env.ChatMessageBurst = 3
+	ts := newTestServer(t, env)
+	alice := ts.connect(t, "alice", "room1")
+	bob := ts.connect(t, "bob", "room1")
+	alice.send(Message{Type: "chat", Text: "hello"})
+	alice.expectError("user_not_found")
+	alice.join()
+	bob.join()
+	alice.waitForParticipants(map[string]bool{"alice": false, "bob": false})
+
+	alice.send(Message{Type: "chat", Text: "can you share the\nticket link?"})
+	var chat ChatResponse
+	bob.waitFor("chat", nil).decode(t, &chat)
+	if len(chat.Messages) != 1 || chat.Messages[0].UserName != "alice" || chat.Messages[0].Text != "can you share the ticket link?" || chat.Messages[0].Kind != "message" {
+		t.Fatalf("chat = %+v", chat.Messages)
+	}
+	bob.send(Message{Type: "react", Reaction: "💩"})
+	bob.expectError("invalid_reaction")
+	bob.send(Message{Type: "react", Reaction: "👍"})
+	alice.waitFor("chat", func(r received) bool {
+		var chat ChatResponse
+		r.decode(t, &chat)
+		return len(chat.Messages) == 1 && chat.Messages[0].Kind == "reaction" && chat.Messages[0].Text == "👍"
+	})
+	alice.send(Message{Type: "chat", Text: " "})
+	alice.expectError("invalid_text")
+
+	// 参加者ごとのバーストを使い切ると制限される
+	alice.send(Message{Type: "chat", Text: "2"})
+	alice.send(Message{Type: "chat", Text: "3"})
+	alice.expectError("rate_limited")
+
+	// 再接続しても残っている
+	carol := ts.connect(t, "carol", "room1")
+	carol.send(Message{Type: "chat_history"})
+	var history ChatResponse
+	carol.waitFor("chat_history", nil).decode(t, &history)
+	var texts []string
+	for _, m := range history.Messages {
+		texts = append(texts, m.Text)
+	}
+	if fmt.Sprint(texts) != "[can you share the ticket link? 👍 2]" {
+		t.Errorf("history = %v", texts)
+	}
+}
+
+func TestWebSocket_Revote(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	alice := ts.connect(t, "alice", "room1")
+	bob := ts.connect(t, "bob", "room1")
+	alice.join()
+	bob.join()
+	alice.send(Message{Type: "revote"})
+	alice.waitForError("not_revealed")
+
+	alice.send(Message{Type: "estimate", UserName: "alice", PointLabel: "3"})
+	bob.send(Message{Type: "estimate", UserName: "bob", PointLabel: "13", Rationale: "unknown API"})
+	alice.waitForParticipants(map[string]bool{"alice": true, "bob": true})
+	alice.send(Message{Type: "reveal"})
+	first := bob.waitForEstimates(map[string]string{"alice": "3", "bob": "13"})
+	if first.Round != 1 || len(first.PreviousRounds) != 0 {
+		t.Errorf("first reveal round = %d, previous = %v", first.Round, first.PreviousRounds)
+	}
+
+	// 議論してから見積もり直す
+	alice.send(Message{Type: "revote"})
+	participants := bob.waitForParticipants(map[string]bool{"alice": false, "bob": false})
+	if participants.Round != 2 || participants.State != "voting" {
+		t.Errorf("after revote round = %d, state = %s", participants.Round, participants.State)
+	}
+	alice.waitForParticipants(map[string]bool{"alice": false, "bob": false})
+	alice.send(Message{Type: "estimate", UserName: "alice", PointLabel: "5"})
+	bob.send(Message{Type: "estimate", UserName: "bob", PointLabel: "8"})
+	alice.waitForParticipants(map[string]bool{"alice": true, "bob": true})
+	alice.send(Message{Type: "reveal"})
+	second := bob.waitForEstimates(map[string]string{"alice": "5", "bob": "8"})
+	if second.Round != 2 || len(second.PreviousRounds) != 1 {
+		t.Fatalf("second reveal round = %d, previous = %v", second.Round, second.PreviousRounds)
+	}
+	previous := second.PreviousRounds[0]
+	if previous.Number != 1 || len(previous.Estimates) != 2 || previous.Estimates[1].Point != "13" || previous.Estimates[1].Rationale != "unknown API" {
+		t.Errorf("previous round = %+v", previous)
+	}
+
+	// リセットすると新しいストーリーになる
+	alice.send(Message{Type: "reset"})
+	alice.waitFor("participants", func(r received) bool {
+		var participants ParticipantResponse
+		r.decode(t, &participants)
+		return participants.Round == 1
+	})
+}
+
+func TestWebSocket_LockVotes(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	alice := ts.connect(t, "alice", "room1")
+	bob := ts.connect(t, "bob", "room1")
+	alice.join()
+	bob.join()
+	for _, point := range []string{"3", "5", "5", "8"} {
+		alice.send(Message{Type: "estimate", UserName: "alice", PointLabel: point})
+	}
+	bob.send(Message{Type: "estimate", UserName: "bob", PointLabel: "5"})
+	alice.waitForParticipants(map[string]bool{"alice": true, "bob": true})
+
+	alice.send(Message{Type: "unlock"})
+	alice.waitForError("invalid_state")
+	alice.send(Message{Type: "lock"})
+	bob.waitFor("participants", func(r received) bool {
+		var participants ParticipantResponse
+		r.decode(t, &participants)
+		return participants.State == "locked"
+	})
+	bob.send(Message{Type: "estimate", UserName: "bob", PointLabel: "13"})
+	bob.waitForError("votes_locked")
+
+	alice.send(Message{Type: "reveal"})
+	estimates := bob.waitForEstimates(map[string]string{"alice": "8", "bob": "5"})
+	for _, e := range estimates.Estimates {
+		want := map[string]int{"alice": 2, "bob": 0}[e.UserName]
+		if e.Changes != want {
+			t.Errorf("%s changes = %d, want %d", e.UserName, e.Changes, want)
+		}
+	}
+
+	// 次のラウンドでは数え直す
+	alice.send(Message{Type: "revote"})
+	alice.waitForParticipants(map[string]bool{"alice": false, "bob": false})
+	alice.send(Message{Type: "estimate", UserName: "alice", PointLabel: "5"})
+	alice.waitForParticipants(map[string]bool{"alice": true, "bob": false})
+	alice.send(Message{Type: "reveal"})
+	second := bob.waitForEstimates(map[string]string{"alice": "5", "bob": ""})
+	if second.Estimates[0].Changes != 0 || second.PreviousRounds[0].Estimates[0].Changes != 2 {
+		t.Errorf("second round = %+v, previous = %+v", second.Estimates, second.PreviousRounds[0].Estimates)
+	}
+}
+
+func TestWebSocket_StoryPhases(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	alice := ts.connect(t, "alice", "room1")
+	bob := ts.connect(t, "bob", "room1")
+	alice.join()
+	bob.join()
+	waitForState := func(c *testClient, state string) {
+		c.t.Helper()
+		c.waitFor("participants", func(r received) bool {
+			var participants ParticipantResponse
+			r.decode(t, &participants)
+			return string(participants.State) == state
+		})
+	}
+	waitForState(bob, "lobby")
+
+	alice.send(Message{Type: "discuss"})
+	alice.waitForError("invalid_state")
+	bob.send(Message{Type: "estimate", UserName: "bob", PointLabel: "5"})
+	waitForState(alice, "voting")
+	alice.send(Message{Type: "reveal"})
+	bob.waitForEstimates(map[string]string{"alice": "", "bob": "5"})
+	alice.send(Message{Type: "discuss"})
+	waitForState(bob, "discussion")
+	alice.send(Message{Type: "finalize"})
+	waitForState(bob, "finalized")
+
+	// 確定したストーリーは見積もり直せない
+	alice.send(Message{Type: "revote"})
+	alice.waitForError("invalid_state")
+	alice.send(Message{Type: "reveal"})
+	alice.waitForError("invalid_state")
+
+	// 次の見積もりで新しいストーリーになり、リセットすると誰も見積もっていない状態に戻る
+	bob.send(Message{Type: "estimate", UserName: "bob", PointLabel: "3"})
+	waitForState(alice, "voting")
+	alice.send(Message{Type: "reset"})
+	waitForState(bob, "lobby")
+}
+
+func TestMetrics(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	alice := ts.connect(t, "alice", "room1")
+	alice.send(Message{Type: "estimate", PointLabel: "3"})
+	alice.waitForError("user_not_found")
+	alice.join()
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"planning_poker_ws_connections ",
+		"planning_poker_active_rooms ",
+		`planning_poker_ws_messages_total{type="join"}`,
+		`planning_poker_ws_messages_total{type="estimate"}`,
+		`planning_poker_errors_total{code="user_not_found"}`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("/metrics does not contain %q", want)
+		}
+	}
+}
+
+func TestBroadcastFanout(t *testing.T) {
+	ts := newTestServer(t, defaultTestEnv())
+	var mu sync.Mutex
+	observed := map[string][]int{}
+	ts.server.fanout = newFanoutCounter(100 * time.Millisecond)
+	ts.server.fanout.observe = func(messageType string, connections int) {
+		mu.Lock()
+		defer mu.Unlock()
+		observed[messageType] = append(observed[messageType], connections)
+	}
+	alice := ts.connect(t, "alice", "room1")
+	bob := ts.connect(t, "bob", "room1")
+	// 見ているだけの接続にも送るので、参加者の数ではなく接続の数になる
+	carol := ts.connect(t, "carol", "room1")
+	alice.join()
+	bob.join()
+	alice.send(Message{Type: "estimate", PointLabel: "3"})
+	bob.waitForParticipants(map[string]bool{"alice": true, "bob": false})
+	alice.send(Message{Type: "reveal"})
+	alice.waitForEstimates(map[string]string{"alice": "3", "bob": ""})
+	bob.waitForEstimates(map[string]string{"alice": "3", "bob": ""})
+
+	// 1回の公開を、送れた接続の数で1回だけ数える
+	carol.waitForEstimates(map[string]string{"alice": "3", "bob": ""})
+	deadline := time.Now().Add(receiveTimeout)
+	for {
+		mu.Lock()
+		estimates := append([]int(nil), observed["estimates"]...)
+		participants := append([]int(nil), observed["participants"]...)
+		mu.Unlock()
+		if len(estimates) > 0 {
+			if len(estimates) != 1 || estimates[0] != 3 {
+				t.Errorf("estimates fanout = %v, want [3]", estimates)
+			}
+			for _, n := range participants {
+				if n > 3 {
+					t.Errorf("participants fanout = %v, want at most 3 connections", participants)
+					break
+				}
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("estimates fanout is not observed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"github.com/pistatium/planing_poker/internal"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	spanRecorder     *tracetest.SpanRecorder
+	spanRecorderOnce sync.Once
+)
+
+// recordSpans 終了したスパンを記録する
+// tracer はグローバルの TracerProvider に最初に設定したものへ委譲するので、テスト全体で1つを使い回す
+// 伝搬方式は本番と同じものを SetupTracing で設定する
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	spanRecorderOnce.Do(func() {
+		if _, err := internal.SetupTracing(context.Background(), internal.TracingExporterNone, "planning-poker-test"); err != nil {
+			t.Fatal(err)
+		}
+		spanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	})
+	return spanRecorder
+}
+
+// waitForSpan roomID のルームに対する name のスパンが終わるまで待つ
+func waitForSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string, roomID string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	deadline := time.Now().Add(receiveTimeout)
+	for {
+		for _, span := range recorder.Ended() {
+			if span.Name() != name {
+				continue
+			}
+			for _, attr := range span.Attributes() {
+				if attr.Key == "room.id" && attr.Value.AsString() == roomID {
+					return span
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("span %q for %s is not recorded", name, roomID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebSocket_Spans(t *testing.T) {
+	recorder := recordSpans(t)
+	ts := newTestServer(t, defaultTestEnv())
+	alice := ts.connect(t, "alice", "trace-room")
+	alice.join()
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	alice.send(Message{Type: "estimate", PointLabel: "3", TraceParent: traceParent})
+	alice.waitForParticipants(map[string]bool{"alice": true})
+
+	// メッセージの traceparent から、操作と応答の送信まで1つのトレースに繋がる
+	message := waitForSpan(t, recorder, "ws.message estimate", "trace-room")
+	if got := message.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("ws.message trace id = %s, want the one in traceparent", got)
+	}
+	if got := message.Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("ws.message parent = %s, want the span in traceparent", got)
+	}
+	operation := waitForSpan(t, recorder, "EventManager.SetEstimate", "trace-room")
+	if operation.Parent().SpanID() != message.SpanContext().SpanID() {
+		t.Errorf("EventManager.SetEstimate parent = %s, want ws.message %s", operation.Parent().SpanID(), message.SpanContext().SpanID())
+	}
+	// 送信者への応答も同じメッセージのスパンの下に入る
+	found := false
+	for _, span := range recorder.Ended() {
+		if span.Name() == "ws.send participants" && span.Parent().SpanID() == message.SpanContext().SpanID() {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("ws.send participants is not recorded under ws.message estimate")
+	}
+}